@@ -0,0 +1,526 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// backfill runs a Windowed processor over a long window as a child job
+	// for each calendar unit of it, with no more than the concurrency of
+	// them running at once
+	backfill struct {
+		Processor   string    `datastore:"processor"`
+		Config      []byte    `datastore:"config,noindex"`
+		Property    string    `datastore:"property,noindex"`
+		Unit        string    `datastore:"unit,noindex"`
+		Location    string    `datastore:"location,noindex"`
+		Concurrency int       `datastore:"concurrency,noindex"`
+		Shards      int       `datastore:"shards,noindex"`
+		Split       string    `datastore:"split,noindex"`
+		Status      string    `datastore:"status"`
+		Created     time.Time `datastore:"created"`
+		Updated     time.Time `datastore:"updated"`
+	}
+
+	// backfillUnit is the window of one calendar unit of a backfill, it's a
+	// child of the backfill numbered from 1 so they can be updated together.
+	// The status is pending until it's started, then the status of its job.
+	// Claimed is when it was set running, before its job was started.
+	backfillUnit struct {
+		From    time.Time      `datastore:"from,noindex"`
+		To      time.Time      `datastore:"to,noindex"`
+		Status  string         `datastore:"status"`
+		Job     *datastore.Key `datastore:"job"`
+		Error   string         `datastore:"error,noindex"`
+		Claimed time.Time      `datastore:"claimed,noindex"`
+		Updated time.Time      `datastore:"updated"`
+	}
+
+	// backfillOptions are how to split the window of a backfill and how many
+	// of its jobs can run at once
+	backfillOptions struct {
+		Unit        string
+		Location    *time.Location
+		Concurrency int
+	}
+
+	timeWindow struct {
+		From time.Time
+		To   time.Time
+	}
+
+	// backfillStatus is the status of a backfill and its units as json
+	backfillStatus struct {
+		ID          int64                 `json:"id"`
+		Processor   string                `json:"processor"`
+		Unit        string                `json:"unit"`
+		Location    string                `json:"location"`
+		Concurrency int                   `json:"concurrency"`
+		Status      string                `json:"status"`
+		Units       []*backfillUnitStatus `json:"units"`
+		Created     time.Time             `json:"created"`
+		Updated     time.Time             `json:"updated"`
+	}
+
+	backfillUnitStatus struct {
+		From   time.Time `json:"from"`
+		To     time.Time `json:"to"`
+		Status string    `json:"status"`
+		Job    int64     `json:"job,omitempty"`
+		Error  string    `json:"error,omitempty"`
+	}
+)
+
+const (
+	backfillKind     = "backfill"
+	backfillUnitKind = "backfill_unit"
+
+	backfillRunning   = "running"
+	backfillCompleted = "completed"
+	backfillFailed    = "failed"
+	unitPending       = "pending"
+
+	backfillDay   = "day"
+	backfillWeek  = "week"
+	backfillMonth = "month"
+
+	// the most units a backfill can be split into and jobs it can run at once
+	maxBackfillUnits       = 1000
+	maxBackfillConcurrency = 32
+)
+
+func init() {
+	// a backfill is started with the process endpoint, something like
+	// "/_ah/cron/process/aggregatePhotos?from=2015-01-01&backfill=day&tz=Europe/London&concurrency=4"
+	cron.Get("/backfill/:id", backfillStatusHandler)
+	cron.Post("/backfill/:id/retry", backfillRetryHandler)
+}
+
+// newBackfillOptions gets the backfill options from the params, the units
+// are in UTC with 4 running at once by default
+func newBackfillOptions(params ParamAdapter) (*backfillOptions, error) {
+	opts := &backfillOptions{Unit: params.Get("backfill"), Location: time.UTC, Concurrency: 4}
+	if s := params.Get("tz"); s != "" {
+		loc, err := time.LoadLocation(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tz %q", s)
+		}
+		opts.Location = loc
+	}
+	if s := params.Get("concurrency"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid concurrency %q", s)
+		}
+		opts.Concurrency = n
+	}
+	return opts, opts.validate()
+}
+
+func (opts *backfillOptions) validate() error {
+	if opts.Unit != backfillDay && opts.Unit != backfillWeek && opts.Unit != backfillMonth {
+		return fmt.Errorf("backfill must be %s, %s or %s", backfillDay, backfillWeek, backfillMonth)
+	}
+	if opts.Concurrency < 1 || opts.Concurrency > maxBackfillConcurrency {
+		return fmt.Errorf("concurrency must be between 1 and %d", maxBackfillConcurrency)
+	}
+	return nil
+}
+
+// splitCalendar splits [from, to) into windows for each calendar unit in the
+// location, weeks start on a Monday. The first and last windows are cut
+// short if the window doesn't start or end on the boundary of a unit.
+func splitCalendar(from, to time.Time, unit string, loc *time.Location) ([]*timeWindow, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("backfill window is empty")
+	}
+	t := from.In(loc)
+	year, month, day := t.Year(), t.Month(), t.Day()
+	switch unit {
+	case backfillDay:
+	case backfillWeek:
+		day -= (int(t.Weekday()) + 6) % 7
+	case backfillMonth:
+		day = 1
+	default:
+		return nil, fmt.Errorf("unknown backfill unit %s", unit)
+	}
+
+	windows := []*timeWindow{}
+	start := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	for start.Before(to) {
+		// the next unit is worked out from the date rather than adding a
+		// duration so days are 23 or 25 hours when daylight saving changes
+		switch unit {
+		case backfillDay:
+			day++
+		case backfillWeek:
+			day += 7
+		case backfillMonth:
+			month++
+		}
+		next := time.Date(year, month, day, 0, 0, 0, 0, loc)
+
+		w := &timeWindow{From: start.UTC(), To: next.UTC()}
+		if w.From.Before(from) {
+			w.From = from.UTC()
+		}
+		if w.To.After(to) {
+			w.To = to.UTC()
+		}
+		windows = append(windows, w)
+		if len(windows) > maxBackfillUnits {
+			return nil, fmt.Errorf("backfill can't be split into more than %d units", maxBackfillUnits)
+		}
+		start = next
+	}
+	return windows, nil
+}
+
+// startBackfill splits the window of a processor into units and starts the
+// first of them, the jobs for each unit are split into shards using the
+// job options
+func startBackfill(c context.Context, processor Processor, opts *jobOptions, bopts *backfillOptions) (*datastore.Key, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := bopts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.Watermark != "" || opts.Callback != "" {
+		return nil, fmt.Errorf("a backfill can't have a watermark or callback")
+	}
+	// the query is kept in the config the jobs for each unit start from
+	if err := applyQuery(processor, opts); err != nil {
+		return nil, err
+	}
+	w, ok := processor.(Windowed)
+	if !ok {
+		return nil, fmt.Errorf("processor %s can't be backfilled", processorName(processor))
+	}
+	r := w.PropertyRange()
+	from, ok := r.Start.(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("processor %s isn't windowed by time", processorName(processor))
+	}
+	to, _ := r.End.(time.Time)
+	windows, err := splitCalendar(from, to, bopts.Unit, bopts.Location)
+	if err != nil {
+		return nil, err
+	}
+	config, err := encodeProcessor(processor)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := getDatastore(c)
+	now := time.Now().UTC()
+	b := &backfill{
+		Processor:   processorName(processor),
+		Config:      config,
+		Property:    r.Property,
+		Unit:        bopts.Unit,
+		Location:    bopts.Location.String(),
+		Concurrency: bopts.Concurrency,
+		Shards:      opts.Shards,
+		Split:       opts.Split,
+		Status:      backfillRunning,
+		Created:     now,
+		Updated:     now,
+	}
+	key, err := ds.Put(c, datastore.NewIncompleteKey(c, backfillKind, nil), b)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(windows))
+	units := make([]*backfillUnit, len(windows))
+	for i, w := range windows {
+		keys[i] = backfillUnitKey(c, key, i+1)
+		units[i] = &backfillUnit{From: w.From, To: w.To, Status: unitPending, Updated: now}
+	}
+	if _, err := ds.PutMulti(c, keys, units); err != nil {
+		return nil, err
+	}
+
+	log.Infof(c, "started backfill %d for %s with %d units", key.IntID(), b.Processor, len(units))
+	return key, advanceBackfill(c, key, 0, "", "")
+}
+
+func backfillUnitKey(c context.Context, key *datastore.Key, unit int) *datastore.Key {
+	return datastore.NewKey(c, backfillUnitKind, "", int64(unit), key)
+}
+
+// advanceBackfill records the status a unit's job closed with, if there is
+// one, then starts as many pending units as the concurrency allows. It's
+// safe to call again if it fails.
+func advanceBackfill(c context.Context, key *datastore.Key, unit int, status, reason string) error {
+	var b *backfill
+	ready := map[int]*backfillUnit{}
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ready = map[int]*backfillUnit{}
+		ds := getDatastore(tc)
+		var units map[int]*backfillUnit
+		var err error
+		if b, units, err = loadBackfill(tc, key); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		updated := map[int]bool{}
+		if u, found := units[unit]; found && u.Status == jobRunning {
+			u.Status = status
+			u.Error = reason
+			u.Updated = now
+			updated[unit] = true
+		}
+
+		running, pending, failed := 0, 0, 0
+		for _, u := range units {
+			switch u.Status {
+			case jobRunning:
+				running++
+			case unitPending:
+				pending++
+			case jobFailed, jobCancelled:
+				failed++
+			}
+		}
+		// units are started in order
+		for n := 1; n <= len(units) && running < b.Concurrency && pending > 0; n++ {
+			if u := units[n]; u.Status == unitPending {
+				u.Status = jobRunning
+				u.Claimed = now
+				u.Updated = now
+				updated[n] = true
+				ready[n] = u
+				running++
+				pending--
+			}
+		}
+		if running == 0 && pending == 0 && b.Status == backfillRunning {
+			if failed > 0 {
+				b.Status = backfillFailed
+				log.Warningf(tc, "backfill %d failed, %d units didn't complete", key.IntID(), failed)
+			} else {
+				b.Status = backfillCompleted
+				log.Infof(tc, "completed backfill %d", key.IntID())
+			}
+		}
+
+		for n := range updated {
+			if _, err := ds.Put(tc, backfillUnitKey(tc, key, n), units[n]); err != nil {
+				return err
+			}
+		}
+		b.Updated = now
+		_, err = ds.Put(tc, key, b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the jobs aren't in the backfill's entity group so they're started
+	// once the units have been claimed
+	for n, u := range ready {
+		if err := startBackfillUnit(c, key, b, n, u); err != nil {
+			log.Errorf(c, "start backfill %d unit %d error %s", key.IntID(), n, err.Error())
+			if err := advanceBackfill(c, key, n, jobFailed, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startBackfillUnit starts the job for the window of a unit and records it
+// against the unit
+func startBackfillUnit(c context.Context, key *datastore.Key, b *backfill, unit int, u *backfillUnit) error {
+	processor, err := decodeProcessor(b.Config)
+	if err != nil {
+		return err
+	}
+	if err := processor.(Windowed).SetWindow(b.Property, u.From, u.To); err != nil {
+		return err
+	}
+	opts := &jobOptions{Shards: b.Shards, Split: b.Split, Backfill: key, Unit: unit}
+	jobKey, err := startJob(c, processor, opts)
+	if err != nil {
+		return err
+	}
+
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		unitKey := backfillUnitKey(tc, key, unit)
+		u := new(backfillUnit)
+		if err := ds.Get(tc, unitKey, u); err != nil {
+			return err
+		}
+		u.Job = jobKey
+		u.Updated = time.Now().UTC()
+		_, err := ds.Put(tc, unitKey, u)
+		return err
+	})
+}
+
+// retryBackfill sets the units of a backfill that failed or were cancelled
+// back to pending, along with any that were claimed long enough ago that
+// they never will get a job, and starts them again
+func retryBackfill(c context.Context, key *datastore.Key) error {
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		b, units, err := loadBackfill(tc, key)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for n, u := range units {
+			if u.Status == jobFailed || u.Status == jobCancelled || (u.Status == jobRunning && u.Job == nil && now.Sub(u.Claimed) > claimTimeout) {
+				u.Status = unitPending
+				u.Job = nil
+				u.Error = ""
+				u.Updated = now
+				if _, err := ds.Put(tc, backfillUnitKey(tc, key, n), u); err != nil {
+					return err
+				}
+			}
+		}
+		if b.Status == backfillFailed {
+			b.Status = backfillRunning
+		}
+		b.Updated = now
+		_, err = ds.Put(tc, key, b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof(c, "retrying backfill %d", key.IntID())
+	return advanceBackfill(c, key, 0, "", "")
+}
+
+// loadBackfill gets a backfill and its units by number
+func loadBackfill(c context.Context, key *datastore.Key) (*backfill, map[int]*backfillUnit, error) {
+	ds := getDatastore(c)
+	b := new(backfill)
+	if err := ds.Get(c, key, b); err != nil {
+		return nil, nil, err
+	}
+	units := make(map[int]*backfillUnit)
+	it := ds.Run(c, NewQuery(backfillUnitKind).Ancestor(key))
+	for {
+		u := new(backfillUnit)
+		k, err := it.Next(u)
+		if err == datastore.Done {
+			return b, units, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		units[int(k.IntID())] = u
+	}
+}
+
+// getBackfillStatus returns the status of a backfill and its units in order
+func getBackfillStatus(c context.Context, key *datastore.Key) (*backfillStatus, error) {
+	b, units, err := loadBackfill(c, key)
+	if err != nil {
+		return nil, err
+	}
+	status := &backfillStatus{
+		ID:          key.IntID(),
+		Processor:   b.Processor,
+		Unit:        b.Unit,
+		Location:    b.Location,
+		Concurrency: b.Concurrency,
+		Status:      b.Status,
+		Units:       []*backfillUnitStatus{},
+		Created:     b.Created,
+		Updated:     b.Updated,
+	}
+	for n := 1; n <= len(units); n++ {
+		u := units[n]
+		us := &backfillUnitStatus{
+			From:   u.From,
+			To:     u.To,
+			Status: u.Status,
+			Error:  u.Error,
+		}
+		if u.Job != nil {
+			us.Job = u.Job.IntID()
+		}
+		status.Units = append(status.Units, us)
+	}
+	return status, nil
+}
+
+// backfillHandler starts a backfill for the process endpoint
+func backfillHandler(c *echo.Context, processor Processor, opts *jobOptions) error {
+	ctx := appengine.NewContext(c.Request())
+
+	bopts, err := newBackfillOptions(newEchoParamAdapter(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	key, err := startBackfill(ctx, processor, opts, bopts)
+	if err != nil {
+		log.Errorf(ctx, "start backfill error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	status, err := getBackfillStatus(ctx, key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func backfillStatusHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	key, err := backfillKey(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	status, err := getBackfillStatus(ctx, key)
+	if err == datastore.ErrNoSuchEntity {
+		return echo.NewHTTPError(http.StatusNotFound, "backfill not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func backfillRetryHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	key, err := backfillKey(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if err := retryBackfill(ctx, key); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return echo.NewHTTPError(http.StatusNotFound, "backfill not found")
+		}
+		log.Errorf(ctx, "retry backfill error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func backfillKey(c context.Context, id string) (*datastore.Key, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid backfill id")
+	}
+	return datastore.NewKey(c, backfillKind, "", n, nil), nil
+}
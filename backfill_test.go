@@ -0,0 +1,270 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func jobByID(c context.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, jobKind, "", id, nil)
+}
+
+func TestSplitCalendar(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := func(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+		return time.Date(year, month, day, hour, 0, 0, 0, loc)
+	}
+	tests := []struct {
+		name     string
+		from, to time.Time
+		unit     string
+		loc      *time.Location
+		expected []time.Time
+	}{
+		{"days", date(2015, 1, 1, 0, time.UTC), date(2015, 1, 4, 0, time.UTC), backfillDay, time.UTC,
+			[]time.Time{date(2015, 1, 1, 0, time.UTC), date(2015, 1, 2, 0, time.UTC), date(2015, 1, 3, 0, time.UTC), date(2015, 1, 4, 0, time.UTC)}},
+		{"part days", date(2015, 1, 1, 12, time.UTC), date(2015, 1, 3, 6, time.UTC), backfillDay, time.UTC,
+			[]time.Time{date(2015, 1, 1, 12, time.UTC), date(2015, 1, 2, 0, time.UTC), date(2015, 1, 3, 0, time.UTC), date(2015, 1, 3, 6, time.UTC)}},
+		// 2015-01-01 is a Thursday
+		{"weeks", date(2015, 1, 1, 0, time.UTC), date(2015, 1, 20, 0, time.UTC), backfillWeek, time.UTC,
+			[]time.Time{date(2015, 1, 1, 0, time.UTC), date(2015, 1, 5, 0, time.UTC), date(2015, 1, 12, 0, time.UTC), date(2015, 1, 19, 0, time.UTC), date(2015, 1, 20, 0, time.UTC)}},
+		{"months", date(2015, 1, 15, 0, time.UTC), date(2015, 4, 1, 0, time.UTC), backfillMonth, time.UTC,
+			[]time.Time{date(2015, 1, 15, 0, time.UTC), date(2015, 2, 1, 0, time.UTC), date(2015, 3, 1, 0, time.UTC), date(2015, 4, 1, 0, time.UTC)}},
+		// the clocks went forward on 2015-03-08 so that day is 23 hours
+		{"daylight saving", date(2015, 3, 7, 0, ny), date(2015, 3, 10, 0, ny), backfillDay, ny,
+			[]time.Time{date(2015, 3, 7, 5, time.UTC), date(2015, 3, 8, 5, time.UTC), date(2015, 3, 9, 4, time.UTC), date(2015, 3, 10, 4, time.UTC)}},
+		{"local days", date(2015, 1, 1, 0, time.UTC), date(2015, 1, 2, 0, time.UTC), backfillDay, ny,
+			[]time.Time{date(2015, 1, 1, 0, time.UTC), date(2015, 1, 1, 5, time.UTC), date(2015, 1, 2, 0, time.UTC)}},
+	}
+	for _, test := range tests {
+		windows, err := splitCalendar(test.from, test.to, test.unit, test.loc)
+		if err != nil {
+			t.Errorf("%s error %s", test.name, err.Error())
+			continue
+		}
+		if len(windows) != len(test.expected)-1 {
+			t.Errorf("%s expected %d windows got %d", test.name, len(test.expected)-1, len(windows))
+			continue
+		}
+		for i, w := range windows {
+			if !w.From.Equal(test.expected[i]) || !w.To.Equal(test.expected[i+1]) {
+				t.Errorf("%s window %d expected %s to %s got %s to %s", test.name, i, test.expected[i], test.expected[i+1], w.From, w.To)
+			}
+		}
+	}
+
+	if _, err := splitCalendar(date(2015, 1, 2, 0, time.UTC), date(2015, 1, 1, 0, time.UTC), backfillDay, time.UTC); err == nil {
+		t.Errorf("expected error for an empty window")
+	}
+	if _, err := splitCalendar(date(2015, 1, 1, 0, time.UTC), date(2015, 1, 2, 0, time.UTC), "hour", time.UTC); err == nil {
+		t.Errorf("expected error for an unknown unit")
+	}
+	if _, err := splitCalendar(date(2000, 1, 1, 0, time.UTC), date(2015, 1, 1, 0, time.UTC), backfillDay, time.UTC); err == nil {
+		t.Errorf("expected error for too many units")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 40)
+
+	// January is split into 5 weeks
+	p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-02-01"})
+	opts, _ := newJobOptions(params{"shards": "2"})
+	bopts, err := newBackfillOptions(params{"backfill": backfillWeek, "concurrency": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := startBackfill(c, p, opts, bopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only as many units as the concurrency are started at once
+	status, err := getBackfillStatus(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Units) != 5 {
+		t.Fatalf("expected 5 units got %d", len(status.Units))
+	}
+	for i, u := range status.Units {
+		expected := unitPending
+		if i < 2 {
+			expected = jobRunning
+		}
+		if u.Status != expected {
+			t.Errorf("unit %d expected %s got %s", i+1, expected, u.Status)
+		}
+	}
+
+	runTasks(t, c, tasks)
+	status, err = getBackfillStatus(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != backfillCompleted {
+		t.Errorf("expected completed backfill got %s", status.Status)
+	}
+	var processed int64
+	for i, u := range status.Units {
+		if u.Status != jobCompleted || u.Job == 0 {
+			t.Errorf("unit %d expected completed with a job got %s %d", i+1, u.Status, u.Job)
+			continue
+		}
+		processed += jobProcessed(t, c, jobByID(c, u.Job))
+	}
+	if processed != 31 {
+		t.Errorf("expected 31 processed got %d", processed)
+	}
+}
+
+func TestBackfillRetry(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-01-11"})
+	opts, _ := newJobOptions(params{})
+	bopts, _ := newBackfillOptions(params{"backfill": backfillDay, "concurrency": "3"})
+	key, err := startBackfill(c, p, opts, bopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling the job of a unit fails the backfill once the rest finish,
+	// even if the job completes as it's cancelled
+	status, _ := getBackfillStatus(c, key)
+	if err := closeJob(c, jobByID(c, status.Units[1].Job), jobCancelled, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeJob(c, jobByID(c, status.Units[1].Job), jobCompleted, ""); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	status, _ = getBackfillStatus(c, key)
+	if status.Status != backfillFailed {
+		t.Errorf("expected failed backfill got %s", status.Status)
+	}
+	for i, u := range status.Units {
+		expected := jobCompleted
+		if i == 1 {
+			expected = jobCancelled
+		}
+		if u.Status != expected {
+			t.Errorf("unit %d expected %s got %s", i+1, expected, u.Status)
+		}
+	}
+	cancelled := status.Units[1].Job
+
+	// only the cancelled unit is run again
+	if err := retryBackfill(c, key); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	retried, _ := getBackfillStatus(c, key)
+	if retried.Status != backfillCompleted {
+		t.Errorf("expected completed backfill got %s", retried.Status)
+	}
+	for i, u := range retried.Units {
+		if u.Status != jobCompleted {
+			t.Errorf("unit %d expected completed got %s", i+1, u.Status)
+		}
+		if rerun := u.Job != status.Units[i].Job; rerun != (i == 1) {
+			t.Errorf("unit %d expected rerun %t", i+1, i == 1)
+		}
+	}
+	if n := jobProcessed(t, c, jobByID(c, retried.Units[1].Job)); n != 1 || retried.Units[1].Job == cancelled {
+		t.Errorf("expected the retried unit to process 1 photo in a new job got %d", n)
+	}
+}
+
+func TestBackfillRetryClaimed(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-01-03"})
+	opts, _ := newJobOptions(params{})
+	bopts, _ := newBackfillOptions(params{"backfill": backfillDay})
+	key, err := startBackfill(c, p, opts, bopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+
+	// as if the second unit had just been claimed and its job was still
+	// starting
+	claim := func(claimed time.Time) {
+		ds := getDatastore(c)
+		b := new(backfill)
+		if err := ds.Get(c, key, b); err != nil {
+			t.Fatal(err)
+		}
+		b.Status = backfillRunning
+		if _, err := ds.Put(c, key, b); err != nil {
+			t.Fatal(err)
+		}
+		unitKey := backfillUnitKey(c, key, 2)
+		u := new(backfillUnit)
+		if err := ds.Get(c, unitKey, u); err != nil {
+			t.Fatal(err)
+		}
+		u.Status = jobRunning
+		u.Job = nil
+		u.Claimed = claimed
+		if _, err := ds.Put(c, unitKey, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	claim(time.Now().UTC())
+	if err := retryBackfill(c, key); err != nil {
+		t.Fatal(err)
+	}
+	status, _ := getBackfillStatus(c, key)
+	if status.Units[1].Status != jobRunning || status.Units[1].Job != 0 || tasks.Len() != 0 {
+		t.Errorf("expected a unit that's starting to be left alone got %#v", status.Units[1])
+	}
+
+	// one claimed long enough ago is started again
+	claim(time.Now().UTC().Add(-2 * claimTimeout))
+	if err := retryBackfill(c, key); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	status, _ = getBackfillStatus(c, key)
+	if status.Status != backfillCompleted || status.Units[1].Status != jobCompleted || status.Units[1].Job == 0 {
+		t.Errorf("expected a stale claim to be started again got %s %#v", status.Status, status.Units[1])
+	}
+}
+
+func TestBackfillOptions(t *testing.T) {
+	c, _, _ := newTestContext(t)
+
+	invalid := []params{
+		{},
+		{"backfill": "hour"},
+		{"backfill": backfillDay, "tz": "Mars/Olympus_Mons"},
+		{"backfill": backfillDay, "concurrency": "0"},
+		{"backfill": backfillDay, "concurrency": "lots"},
+	}
+	for _, p := range invalid {
+		if _, err := newBackfillOptions(p); err == nil {
+			t.Errorf("%v expected error", p)
+		}
+	}
+
+	bopts, _ := newBackfillOptions(params{"backfill": backfillDay})
+	m, _ := newPhotosPerMonth(params{})
+	if _, err := startBackfill(c, m, &jobOptions{Shards: 1, Split: splitEven}, bopts); err == nil {
+		t.Errorf("expected error for a processor that isn't windowed")
+	}
+	p, _ := newLogPhotos(params{})
+	if _, err := startBackfill(c, p, &jobOptions{Shards: 1, Split: splitEven, Watermark: "uploaded"}, bopts); err == nil {
+		t.Errorf("expected error for a backfill with a watermark")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+	"google.golang.org/api/iterator"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/file"
+)
+
+// GCS can compose at most 32 objects in one request
+const maxComposeSources = 32
+
+type (
+	// BlobSink is where processors write files, the local filesystem when
+	// developing / testing and Cloud Storage in production. Names are
+	// relative to the location the sink was created for.
+	BlobSink interface {
+		// Create returns a writer for a new file, replacing any existing one
+		Create(c context.Context, name string) (io.WriteCloser, error)
+
+		// Compose concatenates the source files into a new file
+		Compose(c context.Context, name string, sources []string) error
+
+		// Delete removes a file
+		Delete(c context.Context, name string) error
+
+		// List returns the files whose names start with the prefix
+		List(c context.Context, prefix string) ([]BlobInfo, error)
+
+		// Open returns a reader for a file starting at the offset
+		Open(c context.Context, name string, offset int64) (io.ReadCloser, error)
+	}
+
+	// BlobInfo describes a file in a sink
+	BlobInfo struct {
+		Name string
+		Size int64
+	}
+
+	fileSink struct {
+		dir string
+	}
+
+	gcsSink struct {
+		bucket string
+		prefix string
+	}
+
+	// gcsWriter closes the client along with the object writer
+	gcsWriter struct {
+		*storage.Writer
+		client *storage.Client
+	}
+
+	// gcsReader closes the client along with the object reader
+	gcsReader struct {
+		*storage.Reader
+		client *storage.Client
+	}
+)
+
+// newBlobSink returns the sink for a location which can be a Cloud Storage
+// path ("gs://bucket/prefix") or a local directory ("file:///tmp/exports"
+// or just "/tmp/exports"). If no location is given it defaults to a temp
+// directory on the dev server or the app's default bucket in production.
+func newBlobSink(c context.Context, location string) (BlobSink, error) {
+	if location == "" {
+		if appengine.IsDevAppServer() {
+			return &fileSink{filepath.Join(os.TempDir(), "mapper")}, nil
+		}
+		bucket, err := file.DefaultBucketName(c)
+		if err != nil {
+			return nil, err
+		}
+		return &gcsSink{bucket: bucket}, nil
+	}
+
+	switch {
+	case strings.HasPrefix(location, "gs://"):
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("no bucket in %s", location)
+		}
+		sink := &gcsSink{bucket: parts[0]}
+		if len(parts) == 2 {
+			sink.prefix = strings.Trim(parts[1], "/")
+		}
+		return sink, nil
+	case strings.HasPrefix(location, "file://"):
+		return &fileSink{strings.TrimPrefix(location, "file://")}, nil
+	case strings.Contains(location, "://"):
+		return nil, fmt.Errorf("unsupported location %s", location)
+	}
+	return &fileSink{location}, nil
+}
+
+func (s *fileSink) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *fileSink) Create(c context.Context, name string) (io.WriteCloser, error) {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (s *fileSink) Compose(c context.Context, name string, sources []string) error {
+	w, err := s.Create(c, name)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		r, err := os.Open(s.path(source))
+		if err != nil {
+			w.Close()
+			return err
+		}
+		_, err = io.Copy(w, r)
+		r.Close()
+		if err != nil {
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (s *fileSink) Delete(c context.Context, name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *fileSink) List(c context.Context, prefix string) ([]BlobInfo, error) {
+	blobs := []BlobInfo{}
+	err := filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, prefix) {
+			blobs = append(blobs, BlobInfo{name, info.Size()})
+		}
+		return nil
+	})
+	return blobs, err
+}
+
+func (s *fileSink) Open(c context.Context, name string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *gcsSink) object(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *gcsSink) Create(c context.Context, name string) (io.WriteCloser, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	w := client.Bucket(s.bucket).Object(s.object(name)).NewWriter(c)
+	return &gcsWriter{w, client}, nil
+}
+
+func (s *gcsSink) Compose(c context.Context, name string, sources []string) error {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	bucket := client.Bucket(s.bucket)
+
+	compose := func(dst string, srcs []string) error {
+		objects := make([]*storage.ObjectHandle, len(srcs))
+		for i, src := range srcs {
+			objects[i] = bucket.Object(s.object(src))
+		}
+		_, err := bucket.Object(s.object(dst)).ComposerFrom(objects...).Run(c)
+		return err
+	}
+
+	// collapse the sources into intermediate objects until there are few
+	// enough to compose in one go
+	intermediates := []string{}
+	for len(sources) > maxComposeSources {
+		tmp := fmt.Sprintf("%s.compose-%d", name, len(intermediates))
+		if err := compose(tmp, sources[:maxComposeSources]); err != nil {
+			return err
+		}
+		intermediates = append(intermediates, tmp)
+		sources = append([]string{tmp}, sources[maxComposeSources:]...)
+	}
+	if err := compose(name, sources); err != nil {
+		return err
+	}
+	for _, tmp := range intermediates {
+		if err := bucket.Object(s.object(tmp)).Delete(c); err != nil {
+			log.Warningf(c, "delete %s error %s", tmp, err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *gcsSink) Delete(c context.Context, name string) error {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Bucket(s.bucket).Object(s.object(name)).Delete(c)
+}
+
+func (s *gcsSink) List(c context.Context, prefix string) ([]BlobInfo, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// object names are returned with the sink's prefix which we remove
+	strip := ""
+	if s.prefix != "" {
+		strip = s.prefix + "/"
+	}
+	blobs := []BlobInfo{}
+	it := client.Bucket(s.bucket).Objects(c, &storage.Query{Prefix: strip + prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, BlobInfo{strings.TrimPrefix(attrs.Name, strip), attrs.Size})
+	}
+	return blobs, nil
+}
+
+func (s *gcsSink) Open(c context.Context, name string, offset int64) (io.ReadCloser, error) {
+	client, err := storage.NewClient(c)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.Bucket(s.bucket).Object(s.object(name)).NewRangeReader(c, offset, -1)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &gcsReader{r, client}, nil
+}
+
+func (w *gcsWriter) Close() error {
+	defer w.client.Close()
+	return w.Writer.Close()
+}
+
+func (r *gcsReader) Close() error {
+	defer r.client.Close()
+	return r.Reader.Close()
+}
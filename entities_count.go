@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// countEntities counts the entities matching a query of any kind, e.g.
+	// "/_ah/cron/process/countEntities?kind=photo&filters=photographer.id=3"
+	// or with a json query instead of the kind, namespace and filters. It
+	// only ever reads keys so any projection in the query is ignored.
+	countEntities struct {
+		Kind      string
+		Namespace string
+		Filters   string
+		Query     *QuerySpec
+
+		// running total, exported so it is carried between tasks and merged
+		// from every shard
+		Count int64
+	}
+)
+
+func init() {
+	registerProcessor(newCountEntities)
+}
+
+func newCountEntities(params ParamAdapter) (Processor, error) {
+	p := new(countEntities)
+	if params == nil {
+		return p, nil
+	}
+
+	p.Kind = params.Get("kind")
+	p.Namespace = params.Get("namespace")
+	p.Filters = params.Get("filters")
+
+	// the query is set when the job starts
+	if params.Get("query") != "" {
+		if p.Kind != "" || p.Filters != "" {
+			return p, fmt.Errorf("count can't have a kind or filters and a query")
+		}
+		return p, nil
+	}
+
+	if p.Kind == "" {
+		return p, fmt.Errorf("kind or query is required")
+	}
+	if _, err := parseFilters(p.Filters); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+// SetQuery counts the entities matching the query instead of the kind and
+// filters
+func (x *countEntities) SetQuery(spec *QuerySpec) error {
+	if x.Kind != "" || x.Filters != "" {
+		return fmt.Errorf("count can't have a kind or filters and a query")
+	}
+	x.Query = spec
+	x.Kind = spec.Kind
+	x.Namespace = spec.Namespace
+	return nil
+}
+
+func (x *countEntities) Start(c context.Context) (*Query, interface{}) {
+	var q *Query
+	if x.Query != nil {
+		spec := *x.Query
+		spec.Projection = nil
+		q = spec.query()
+	} else {
+		filters, _ := parseFilters(x.Filters)
+		q = NewQuery(x.Kind)
+		q = q.Namespace(x.Namespace)
+		q = applyFilters(q, filters)
+	}
+	q = q.KeysOnly()
+	q = q.Limit(1000)
+
+	return q, nil
+}
+
+// SubQueries returns a sub-query for each value of any in filters in the
+// query
+func (x *countEntities) SubQueries() [][]filter {
+	if x.Query == nil {
+		return nil
+	}
+	return x.Query.subQueries()
+}
+
+func (x *countEntities) Process(c context.Context, key *datastore.Key) {
+	x.Count++
+}
+
+func (x *countEntities) Complete(c context.Context) {
+	// the count is carried over to the next slice and logged when the job
+	// ends
+}
+
+// Merge adds the count from another shard
+func (x *countEntities) Merge(other Processor) {
+	x.Count += other.(*countEntities).Count
+}
+
+// EndJob logs the total count
+func (x *countEntities) EndJob(c context.Context, stats *JobStats) error {
+	log.Infof(c, "counted %d %s entities", x.Count, x.Kind)
+	return nil
+}
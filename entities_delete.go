@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// DeleteMulti is limited to 500 keys per call
+const deleteBatchSize = 500
+
+type (
+	// deleteEntities deletes all entities of a kind matching the filters,
+	// e.g. "/_ah/cron/process/deleteEntities?kind=photo&filters=taken<2015-01-01"
+	// Unless the confirm parameter matches the kind it only counts the
+	// entities that would be deleted.
+	deleteEntities struct {
+		Kind      string
+		Namespace string
+		Filters   string
+		Confirmed bool
+
+		// running total, exported so it is carried between tasks
+		Count int64
+
+		// keys waiting to be deleted and the error deleting them if it
+		// failed, which fails the slice so it's retried
+		keys []*datastore.Key
+		err  error
+	}
+
+	// tombstone records the key of a deleted entity
+	tombstone struct {
+		Key     *datastore.Key `datastore:"key"`
+		Kind    string         `datastore:"kind"`
+		Deleted time.Time      `datastore:"deleted"`
+	}
+)
+
+func init() {
+	registerProcessor(newDeleteEntities)
+}
+
+func newDeleteEntities(params ParamAdapter) (Processor, error) {
+	p := new(deleteEntities)
+	if params == nil {
+		return p, nil
+	}
+
+	p.Kind = params.Get("kind")
+	p.Namespace = params.Get("namespace")
+	p.Filters = params.Get("filters")
+	p.Confirmed = p.Kind != "" && params.Get("confirm") == p.Kind
+
+	if p.Kind == "" {
+		return p, fmt.Errorf("kind is required")
+	}
+
+	filters, err := parseFilters(p.Filters)
+	if err != nil {
+		return p, err
+	}
+
+	// guard against accidentally wiping out a whole kind
+	if len(filters) == 0 && params.Get("all") != "true" {
+		return p, fmt.Errorf("filters are required to delete, use all=true to delete every %s", p.Kind)
+	}
+
+	return p, nil
+}
+
+func (x *deleteEntities) Start(c context.Context) (*Query, interface{}) {
+	x.keys = make([]*datastore.Key, 0, deleteBatchSize)
+	x.err = nil
+
+	// filters were validated when the processor was created
+	filters, _ := parseFilters(x.Filters)
+
+	q := NewQuery(x.Kind)
+	q = q.Namespace(x.Namespace)
+	q = applyFilters(q, filters)
+	q = q.Limit(deleteBatchSize)
+	q = q.KeysOnly()
+
+	return q, nil
+}
+
+func (x *deleteEntities) Process(c context.Context, key *datastore.Key) {
+	x.Count++
+	if !x.Confirmed || x.err != nil {
+		return
+	}
+
+	x.keys = append(x.keys, key)
+	if len(x.keys) >= deleteBatchSize {
+		x.err = x.flush(c)
+	}
+}
+
+func (x *deleteEntities) Complete(c context.Context) {
+	// the count is carried over to the next slice and logged when the job
+	// ends
+	if !x.Confirmed {
+		return
+	}
+
+	if x.err == nil {
+		x.err = x.flush(c)
+	}
+	if x.err != nil {
+		log.Errorf(c, "delete %s error %s", x.Kind, x.err.Error())
+	}
+}
+
+// EndSlice fails the slice if deleting failed, it's retried from where it
+// started so the keys that weren't deleted are queried again
+func (x *deleteEntities) EndSlice(c context.Context) error {
+	return x.err
+}
+
+// Merge adds the count from another shard
+func (x *deleteEntities) Merge(other Processor) {
+	x.Count += other.(*deleteEntities).Count
+}
+
+// EndJob logs the total deleted, or that would be for a dry-run
+func (x *deleteEntities) EndJob(c context.Context, stats *JobStats) error {
+	if !x.Confirmed {
+		log.Infof(c, "dry-run: would delete %d %s entities", x.Count, x.Kind)
+		return nil
+	}
+	log.Infof(c, "deleted %d %s entities", x.Count, x.Kind)
+	return nil
+}
+
+// flush writes tombstones for the pending keys and then deletes them. The
+// keys are cleared whether it works or not, if it fails the tombstones it
+// wrote are removed so they're only left for entities that were deleted.
+func (x *deleteEntities) flush(c context.Context) error {
+	if len(x.keys) == 0 {
+		return nil
+	}
+	defer func() { x.keys = x.keys[:0] }()
+
+	now := time.Now().UTC()
+	tombstoneKeys := make([]*datastore.Key, len(x.keys))
+	tombstones := make([]*tombstone, len(x.keys))
+	for i, key := range x.keys {
+		tombstoneKeys[i] = datastore.NewIncompleteKey(c, "tombstone", nil)
+		tombstones[i] = &tombstone{
+			Key:     key,
+			Kind:    key.Kind(),
+			Deleted: now,
+		}
+	}
+
+	// don't delete anything we haven't been able to record
+	ds := getDatastore(c)
+	tombstoneKeys, err := ds.PutMulti(c, tombstoneKeys, tombstones)
+	if err != nil {
+		return err
+	}
+
+	if err := ds.DeleteMulti(c, x.keys); err != nil {
+		// only the tombstones of the entities that weren't deleted go
+		failed := tombstoneKeys
+		if merr, ok := err.(appengine.MultiError); ok {
+			failed = []*datastore.Key{}
+			for i, e := range merr {
+				if e != nil {
+					failed = append(failed, tombstoneKeys[i])
+				}
+			}
+		}
+		if terr := ds.DeleteMulti(c, failed); terr != nil {
+			log.Errorf(c, "delete tombstones error %s", terr.Error())
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// exportEntities writes all entities of a kind to newline-delimited JSON
+	// or CSV files, e.g.
+	// "/_ah/cron/process/exportEntities?kind=photo&format=csv&dest=gs://bucket/exports"
+	// or with a json query instead of the kind, namespace and filters.
+	// Each slice is written to a separate part file which are combined into
+	// one file for each shard when the export is finished, then a manifest
+	// listing the shard files is written.
+	exportEntities struct {
+		Kind      string
+		Namespace string
+		Filters   string
+		Query     *QuerySpec
+		Format    string
+		Dest      string
+		Name      string
+		Shard     int
+		Columns   []string
+		Parts     []string
+		Rows      int64
+
+		// note non-exported members - they only live for one slice
+		entity interface{}
+		sink   BlobSink
+		file   io.WriteCloser
+		rows   rowWriter
+		merged []exportShard
+
+		// the error writing the slice, it fails the slice so it's retried
+		// and the part file written again
+		err error
+	}
+
+	// exportShard is what one shard of an export wrote
+	exportShard struct {
+		Shard int
+		Parts []string
+		Rows  int64
+	}
+
+	byShard []exportShard
+
+	// exportManifest describes the files written by an export
+	exportManifest struct {
+		Kind      string       `json:"kind"`
+		Namespace string       `json:"namespace,omitempty"`
+		Filters   string       `json:"filters,omitempty"`
+		Query     *QuerySpec   `json:"query,omitempty"`
+		Format    string       `json:"format"`
+		Columns   []string     `json:"columns,omitempty"`
+		Files     []exportFile `json:"files"`
+		Created   time.Time    `json:"created"`
+	}
+
+	exportFile struct {
+		Name string `json:"name"`
+		Rows int64  `json:"rows"`
+	}
+)
+
+func init() {
+	registerProcessor(newExportEntities)
+}
+
+func (s byShard) Len() int           { return len(s) }
+func (s byShard) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byShard) Less(i, j int) bool { return s[i].Shard < s[j].Shard }
+
+func newExportEntities(params ParamAdapter) (Processor, error) {
+	p := new(exportEntities)
+	if params == nil {
+		return p, nil
+	}
+
+	p.Kind = params.Get("kind")
+	p.Namespace = params.Get("namespace")
+	p.Filters = params.Get("filters")
+	p.Format = params.Get("format")
+	p.Dest = params.Get("dest")
+
+	// the kind comes from the query when the job starts if there is one
+	if p.Kind == "" && params.Get("query") == "" {
+		return p, fmt.Errorf("kind or query is required")
+	}
+	if p.Format == "" {
+		p.Format = "ndjson"
+	}
+	if _, ok := extension[p.Format]; !ok {
+		return p, fmt.Errorf("unsupported format %s", p.Format)
+	}
+	if _, err := parseFilters(p.Filters); err != nil {
+		return p, err
+	}
+	if p.Kind != "" {
+		if err := p.checkColumns(); err != nil {
+			return p, err
+		}
+	}
+
+	p.Name = exportName(p.Kind)
+
+	return p, nil
+}
+
+// SetQuery exports the entities matching the query instead of the kind
+// and filters
+func (x *exportEntities) SetQuery(spec *QuerySpec) error {
+	if spec.KeysOnly || len(spec.Projection) > 0 {
+		return fmt.Errorf("export query must load whole entities")
+	}
+	if x.Filters != "" {
+		return fmt.Errorf("export can't have filters and a query")
+	}
+	x.Query = spec
+	x.Kind = spec.Kind
+	x.Namespace = spec.Namespace
+	x.Name = exportName(x.Kind)
+	return x.checkColumns()
+}
+
+// checkColumns checks a CSV export has columns for the kind
+func (x *exportEntities) checkColumns() error {
+	if x.Format != "csv" {
+		return nil
+	}
+	_, err := columns(x.Kind)
+	return err
+}
+
+// exportName is the folder the files of an export go in, the time is to the
+// nanosecond so exports started together don't overwrite each other
+func exportName(kind string) string {
+	return fmt.Sprintf("%s-%s", kind, time.Now().UTC().Format("20060102-150405.000000000"))
+}
+
+func (x *exportEntities) Start(c context.Context) (*Query, interface{}) {
+	x.entity = newEntity(x.Kind)
+	x.file = nil
+	x.rows = nil
+	x.err = nil
+
+	var q *Query
+	if x.Query != nil {
+		q = x.Query.query()
+	} else {
+		filters, _ := parseFilters(x.Filters)
+		q = NewQuery(x.Kind)
+		q = q.Namespace(x.Namespace)
+		q = applyFilters(q, filters)
+	}
+	q = q.Limit(100)
+
+	return q, x.entity
+}
+
+// SubQueries returns a sub-query for each value of any in filters in the
+// query
+func (x *exportEntities) SubQueries() [][]filter {
+	if x.Query == nil {
+		return nil
+	}
+	return x.Query.subQueries()
+}
+
+func (x *exportEntities) Process(c context.Context, key *datastore.Key) {
+	if x.err != nil {
+		return
+	}
+
+	// the part file is only created once there is something to write to it
+	if x.rows == nil {
+		if x.err = x.create(c); x.err != nil {
+			log.Errorf(c, "create export file error %s", x.err.Error())
+			return
+		}
+	}
+
+	if x.err = x.rows.Write(key, x.entity); x.err != nil {
+		log.Errorf(c, "export %s error %s", key.String(), x.err.Error())
+		return
+	}
+	x.Rows++
+}
+
+func (x *exportEntities) Complete(c context.Context) {
+	if x.file == nil {
+		return
+	}
+	if err := x.rows.Flush(); err != nil && x.err == nil {
+		x.err = err
+	}
+	if err := x.file.Close(); err != nil && x.err == nil {
+		x.err = err
+	}
+	if x.err != nil {
+		log.Errorf(c, "export file error %s", x.err.Error())
+	}
+}
+
+// EndSlice fails the slice if anything couldn't be written so it isn't
+// left out of the export, the retried slice writes its part file again
+func (x *exportEntities) EndSlice(c context.Context) error {
+	return x.err
+}
+
+// BeginJob works out the CSV columns once so every shard writes the same
+func (x *exportEntities) BeginJob(c context.Context) error {
+	if x.Format != "csv" {
+		return nil
+	}
+	var err error
+	x.Columns, err = columns(x.Kind)
+	return err
+}
+
+// BeginShard sets the shard so each shard writes its own file
+func (x *exportEntities) BeginShard(c context.Context, shard int) error {
+	x.Shard = shard
+	return nil
+}
+
+// Merge collects the part files written by another shard
+func (x *exportEntities) Merge(other Processor) {
+	o := other.(*exportEntities)
+	x.merged = append(x.merged, exportShard{o.Shard, o.Parts, o.Rows})
+}
+
+// EndJob combines the part files into a file for each shard and writes the
+// manifest
+func (x *exportEntities) EndJob(c context.Context, stats *JobStats) error {
+	sink, err := newBlobSink(c, x.Dest)
+	if err != nil {
+		return err
+	}
+
+	shards := append([]exportShard{{x.Shard, x.Parts, x.Rows}}, x.merged...)
+	sort.Sort(byShard(shards))
+
+	manifest := &exportManifest{
+		Kind:      x.Kind,
+		Namespace: x.Namespace,
+		Filters:   x.Filters,
+		Query:     x.Query,
+		Format:    x.Format,
+		Columns:   x.Columns,
+		Files:     []exportFile{},
+		Created:   time.Now().UTC(),
+	}
+	var rows int64
+	for _, shard := range shards {
+		name, err := x.compose(c, sink, shard)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, exportFile{name, shard.Rows})
+		rows += shard.Rows
+	}
+
+	w, err := sink.Create(c, x.Name+"/manifest.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(manifest); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	log.Infof(c, "exported %d %s entities to %s", rows, x.Kind, x.Name)
+	return nil
+}
+
+// compose combines the part files of a shard into the shard file
+func (x *exportEntities) compose(c context.Context, sink BlobSink, shard exportShard) (string, error) {
+	name := x.shardFile(shard.Shard)
+	if len(shard.Parts) == 0 {
+		// nothing matched but still write the (empty) file for the shard
+		w, err := sink.Create(c, name)
+		if err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+	} else if err := sink.Compose(c, name, shard.Parts); err != nil {
+		return "", err
+	}
+	for _, part := range shard.Parts {
+		if err := sink.Delete(c, part); err != nil {
+			log.Warningf(c, "delete part %s error %s", part, err.Error())
+		}
+	}
+	return name, nil
+}
+
+func (x *exportEntities) shardFile(shard int) string {
+	return fmt.Sprintf("%s/shard-%04d%s", x.Name, shard, extension[x.Format])
+}
+
+// create opens a new part file for this slice
+func (x *exportEntities) create(c context.Context) error {
+	var err error
+	if x.sink == nil {
+		if x.sink, err = newBlobSink(c, x.Dest); err != nil {
+			return err
+		}
+	}
+
+	// the CSV header is only written to the first part of the shard
+	header := len(x.Parts) == 0
+
+	part := fmt.Sprintf("%s.part-%05d", x.shardFile(x.Shard), len(x.Parts))
+	if x.file, err = x.sink.Create(c, part); err != nil {
+		return err
+	}
+	if x.rows, err = newRowWriter(x.file, x.Format, x.Columns, header); err != nil {
+		x.file.Close()
+		x.file = nil
+		return err
+	}
+	x.Parts = append(x.Parts, part)
+	return nil
+}
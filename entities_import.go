@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// PutMulti is limited to 500 entities per call
+	importBatchSize = 500
+
+	// an import of a range stops once this many rows couldn't be imported,
+	// the file is most likely not what it's being imported as
+	maxBadRows = 100
+)
+
+type (
+	// importJob loads NDJSON or CSV files (such as those written by the
+	// exportEntities processor) into entities of a registered kind
+	importJob struct {
+		Kind      string
+		Namespace string
+		Source    string
+	}
+
+	// byteRange is the part of a file a single import task reads. A task
+	// handles every row that starts within the range, a CSV row can span
+	// lines when a quoted field has newlines. Bad counts the rows that
+	// couldn't be imported so far.
+	byteRange struct {
+		File   string
+		Format string
+		Offset int64
+		End    int64
+		Bad    int
+	}
+)
+
+var importFunc *taskFunc
+
+func init() {
+	// created in init because it's called inside the function itself
+	importFunc = newTaskFunc("import", importBytes)
+
+	// e.g. "/_ah/cron/import?kind=photo&source=gs://bucket/exports&files=photo-20160101-000000.000000000/"
+	cron.Get("/import", importHandler)
+}
+
+// callable handler to kick off an import
+func importHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	job := &importJob{
+		Kind:      c.Query("kind"),
+		Namespace: c.Query("namespace"),
+		Source:    c.Query("source"),
+	}
+	if _, found := kinds[job.Kind]; !found {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("kind %s not registered", job.Kind))
+	}
+
+	shards := 8
+	if s := c.Query("shards"); s != "" {
+		var err error
+		if shards, err = strconv.Atoi(s); err != nil || shards < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "shards must be a positive number")
+		}
+	}
+
+	sink, err := newBlobSink(ctx, job.Source)
+	if err != nil {
+		log.Errorf(ctx, "error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	blobs, err := sink.List(ctx, c.Query("files"))
+	if err != nil {
+		log.Errorf(ctx, "list files error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	ranges := splitBlobs(blobs, c.Query("format"), shards)
+	if len(ranges) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no files to import")
+	}
+	for _, r := range ranges {
+		if err := importFunc.Call(ctx, job, r); err != nil {
+			log.Errorf(ctx, "enqueue import error %s", err.Error())
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// splitBlobs splits the files into roughly equal byte ranges to be imported
+// in parallel. Files that aren't NDJSON or CSV are ignored unless a format
+// is specified. CSV files aren't split as a newline could be in a quoted
+// field rather than between rows.
+func splitBlobs(blobs []BlobInfo, format string, shards int) []*byteRange {
+	files := []BlobInfo{}
+	formats := []string{}
+	var total int64
+	for _, blob := range blobs {
+		f := format
+		if f == "" {
+			f = fileFormat(blob.Name)
+		}
+		if f == "" || blob.Size == 0 || path.Base(blob.Name) == "manifest.json" {
+			continue
+		}
+		files = append(files, blob)
+		formats = append(formats, f)
+		total += blob.Size
+	}
+
+	ranges := []*byteRange{}
+	if len(files) == 0 {
+		return ranges
+	}
+	target := total / int64(shards)
+	if target == 0 {
+		target = 1
+	}
+	for i, file := range files {
+		n := (file.Size + target - 1) / target
+		if formats[i] == "csv" {
+			n = 1
+		}
+		for j := int64(0); j < n; j++ {
+			ranges = append(ranges, &byteRange{
+				File:   file.Name,
+				Format: formats[i],
+				Offset: file.Size * j / n,
+				End:    file.Size * (j + 1) / n,
+			})
+		}
+	}
+	return ranges
+}
+
+func fileFormat(name string) string {
+	for format, ext := range extension {
+		if strings.HasSuffix(name, ext) {
+			return format
+		}
+	}
+	return ""
+}
+
+func importBytes(c context.Context, job *importJob, r *byteRange) error {
+	// use the full 10 minutes allowed (assuming front-end instance type)
+	c, _ = context.WithTimeout(c, time.Duration(10)*time.Minute)
+
+	var err error
+	if job.Namespace != "" {
+		if c, err = appengine.Namespace(c, job.Namespace); err != nil {
+			log.Errorf(c, "namespace error %s", err.Error())
+			return err
+		}
+	}
+
+	t, found := kinds[job.Kind]
+	if !found {
+		log.Errorf(c, "kind %s not registered", job.Kind)
+		return nil
+	}
+
+	sink, err := newBlobSink(c, job.Source)
+	if err != nil {
+		log.Errorf(c, "error %s", err.Error())
+		return err
+	}
+
+	// start one byte early so we can tell if the range starts on a new line
+	start := r.Offset
+	if start > 0 {
+		start--
+	}
+	reader, err := sink.Open(c, r.File, start)
+	if err != nil {
+		log.Errorf(c, "open %s error %s", r.File, err.Error())
+		return err
+	}
+	defer reader.Close()
+	br := bufio.NewReader(reader)
+	pos := start
+
+	var columns []string
+	if r.Format == "csv" {
+		if columns, err = readHeader(c, sink, r.File); err != nil {
+			log.Errorf(c, "read header %s error %s", r.File, err.Error())
+			return err
+		}
+	}
+
+	// skip any partial line (it belongs to the previous range) or the header
+	if r.Offset > 0 || r.Format == "csv" {
+		line, err := readRow(br, r.Format)
+		pos += int64(len(line))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Errorf(c, "read %s error %s", r.File, err.Error())
+			return err
+		}
+	}
+
+	// continue in a new task after 5 minutes
+	deadline := time.Now().Add(time.Duration(5) * time.Minute)
+
+	keys := make([]*datastore.Key, 0, importBatchSize)
+	entities := make([]interface{}, 0, importBatchSize)
+	imported := 0
+	put := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if _, err := getDatastore(c).PutMulti(c, keys, entities); err != nil {
+			return err
+		}
+		imported += len(keys)
+		keys = keys[:0]
+		entities = entities[:0]
+		return nil
+	}
+
+	for pos < r.End {
+		lineStart := pos
+		line, readErr := readRow(br, r.Format)
+		pos += int64(len(line))
+		if readErr != nil && readErr != io.EOF {
+			log.Errorf(c, "read %s error %s", r.File, readErr.Error())
+			return readErr
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			entity, encoded, err := decodeRow(t, r.Format, columns, line)
+			var key *datastore.Key
+			if err == nil {
+				key, err = importKey(c, job.Kind, encoded, entity, r.File, lineStart)
+			}
+			if err != nil {
+				// skip bad rows rather than failing the whole import, unless
+				// there are so many that the file can't be what it seems
+				r.Bad++
+				log.Warningf(c, "%s at %d error %s", r.File, lineStart, err.Error())
+				if r.Bad > maxBadRows {
+					log.Errorf(c, "stopped importing %s at %d after %d bad rows", r.File, lineStart, r.Bad)
+					return put()
+				}
+			} else {
+				keys = append(keys, key)
+				entities = append(entities, entity)
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+
+		if len(keys) == importBatchSize {
+			if err := put(); err != nil {
+				log.Errorf(c, "put error %s", err.Error())
+				return err
+			}
+			if time.Now().After(deadline) && pos < r.End {
+				log.Debugf(c, "imported %d rows from %s, continuing at %d", imported, r.File, pos)
+				r.Offset = pos
+				// the task is retried if the rest of the range can't be
+				// continued, the rows already put are put again
+				if err := importFunc.Call(c, job, r); err != nil {
+					log.Errorf(c, "continue import error %s", err.Error())
+					return err
+				}
+				return nil
+			}
+		}
+	}
+
+	if err := put(); err != nil {
+		log.Errorf(c, "put error %s", err.Error())
+		return err
+	}
+	log.Debugf(c, "imported %d rows from %s", imported, r.File)
+	if r.Bad > 0 {
+		log.Errorf(c, "skipped %d bad rows importing %s", r.Bad, r.File)
+	}
+
+	return nil
+}
+
+// readRow reads the next row, a CSV row carries on over newlines until the
+// quotes in it are balanced
+func readRow(br *bufio.Reader, format string) ([]byte, error) {
+	row, err := br.ReadBytes('\n')
+	for format == "csv" && err == nil && bytes.Count(row, []byte{'"'})%2 == 1 {
+		var more []byte
+		more, err = br.ReadBytes('\n')
+		row = append(row, more...)
+	}
+	return row, err
+}
+
+// importKey returns the key for an imported entity. Keys are deterministic
+// so re-running an import overwrites rather than duplicates entities: the
+// exported key or ID if there is one, otherwise one derived from the
+// position of the row in the file.
+func importKey(c context.Context, kind, encoded string, entity interface{}, file string, offset int64) (*datastore.Key, error) {
+	if encoded != "" {
+		key, err := datastore.DecodeKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if key.Kind() != kind {
+			return nil, fmt.Errorf("key %s is not a %s", key.String(), kind)
+		}
+		// the export may have come from another app or namespace
+		return localKey(c, key), nil
+	}
+	if k, ok := entity.(keyIDer); ok && k.KeyID() != 0 {
+		return datastore.NewKey(c, kind, "", k.KeyID(), nil), nil
+	}
+	name := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%s:%d", file, offset))))
+	return datastore.NewKey(c, kind, name, 0, nil), nil
+}
+
+// localKey recreates the key for the current app and namespace
+func localKey(c context.Context, key *datastore.Key) *datastore.Key {
+	var parent *datastore.Key
+	if key.Parent() != nil {
+		parent = localKey(c, key.Parent())
+	}
+	return datastore.NewKey(c, key.Kind(), key.StringID(), key.IntID(), parent)
+}
+
+func readHeader(c context.Context, sink BlobSink, file string) ([]string, error) {
+	reader, err := sink.Open(c, file, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	line, err := readRow(bufio.NewReader(reader), "csv")
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return csv.NewReader(bytes.NewReader(line)).Read()
+}
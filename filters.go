@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// filter is a single property filter parsed from a request parameter
+	filter struct {
+		Property string
+		Operator string
+		Value    interface{}
+	}
+)
+
+// operators supported by the datastore, longest first so that "<=" isn't
+// mistaken for "<"
+var filterOperators = []string{"<=", ">=", "<", ">", "="}
+
+// parseFilters parses a comma separated list of filters such as
+// "taken<2015-01-01,photographer.id=3". Values are converted to the first
+// type they parse as: integer, float, date (yyyy-mm-dd), bool or string.
+// A value in double quotes is always treated as a string, values have to be
+// quoted if they contain a comma or operator and can't contain quotes.
+func parseFilters(s string) ([]filter, error) {
+	filters := []filter{}
+	if strings.TrimSpace(s) == "" {
+		return filters, nil
+	}
+	for {
+		f, rest, err := parseFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+		if rest == "" {
+			return filters, nil
+		}
+		// the filter is followed by a comma and the next one
+		s = rest[1:]
+	}
+}
+
+// parseFilter parses the filter at the start of s and returns the rest of
+// s after it, which is empty or starts with the comma before the next one
+func parseFilter(s string) (filter, string, error) {
+	// the operator is the first one in the filter, properties can't
+	// contain them
+	i := strings.IndexAny(s, `<>=,"`)
+	if i < 0 || s[i] == ',' || s[i] == '"' {
+		end := strings.Index(s, ",")
+		if end < 0 {
+			end = len(s)
+		}
+		return filter{}, "", fmt.Errorf("filter %q has no operator", s[:end])
+	}
+	op := s[i : i+1]
+	for _, o := range filterOperators {
+		if strings.HasPrefix(s[i:], o) {
+			op = o
+			break
+		}
+	}
+	property := strings.TrimSpace(s[:i])
+	if property == "" {
+		return filter{}, "", fmt.Errorf("filter %q has no property", s)
+	}
+
+	value := strings.TrimLeft(s[i+len(op):], " ")
+	var raw, rest string
+	if strings.HasPrefix(value, `"`) {
+		end := strings.Index(value[1:], `"`)
+		if end < 0 {
+			return filter{}, "", fmt.Errorf("filter %s has an unterminated value", property)
+		}
+		raw, rest = value[:end+2], strings.TrimLeft(value[end+2:], " ")
+		if rest != "" && rest[0] != ',' {
+			return filter{}, "", fmt.Errorf("filter %s has %q after its value", property, rest)
+		}
+	} else {
+		raw = value
+		if end := strings.Index(value, ","); end >= 0 {
+			raw, rest = value[:end], value[end:]
+		}
+		if strings.ContainsAny(raw, `<>="`) {
+			return filter{}, "", fmt.Errorf("filter %s value %q must be quoted", property, strings.TrimSpace(raw))
+		}
+	}
+	return filter{
+		Property: property,
+		Operator: op,
+		Value:    parseValue(strings.TrimSpace(raw)),
+	}, rest, nil
+}
+
+func parseValue(s string) interface{} {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return s[1 : len(s)-1]
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if t, err := time.Parse(dateFormat, s); err == nil {
+		return t
+	}
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+	return s
+}
+
+// applyFilters adds the filters to the query
+func applyFilters(q *Query, filters []filter) *Query {
+	for _, f := range filters {
+		q = q.Filter(f.Property+" "+f.Operator, f.Value)
+	}
+	return q
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFilters(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected []filter
+	}{
+		{"", []filter{}},
+		{"taken<2015-01-01, photographer.id=3", []filter{
+			{"taken", "<", time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{"photographer.id", "=", int64(3)},
+		}},
+		{"width>=8000", []filter{{"width", ">=", int64(8000)}}},
+		// quoted values can contain commas and operators
+		{`name="a, b",title="x<=y" , id>2`, []filter{
+			{"name", "=", "a, b"},
+			{"title", "=", "x<=y"},
+			{"id", ">", int64(2)},
+		}},
+		{`id="3"`, []filter{{"id", "=", "3"}}},
+	}
+	for _, test := range tests {
+		filters, err := parseFilters(test.s)
+		if err != nil {
+			t.Errorf("%s error %v", test.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(filters, test.expected) {
+			t.Errorf("%s expected %v got %v", test.s, test.expected, filters)
+		}
+	}
+
+	for _, s := range []string{
+		"taken",
+		"=3",
+		"id=3,",
+		"name=a<=b",
+		`name="a`,
+		`name="a"b`,
+		`"name"=a`,
+	} {
+		if filters, err := parseFilters(s); err == nil {
+			t.Errorf("%s expected error got %v", s, filters)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+var useAetest = flag.Bool("aetest", false, "run datastore tests against the dev appserver instead of in memory")
+
+func TestMain(m *testing.M) {
+	// keys created outside of App Engine get their app ID from the environment
+	os.Setenv("GAE_APPLICATION", "s~testapp")
+
+	// make every slice continue in a new task so continuations get tested
+	sliceTimeout = 0
+
+	os.Exit(m.Run())
+}
+
+// newTestContext returns a context using an in-memory datastore and task
+// queue with anything logged written to the test log
+func newTestContext(t *testing.T) (context.Context, *memoryStore, *memoryTasks) {
+	store := newMemoryStore()
+	tasks := new(memoryTasks)
+	c := context.Background()
+	c = withDatastore(c, store)
+	c = withTasks(c, tasks)
+	c = withLog(c, func(level, message string) {
+		t.Logf("%s: %s", level, message)
+	})
+	return c, store, tasks
+}
+
+// newDatastoreContext returns a context for tests that only need a
+// datastore, the in-memory one unless the -aetest flag is set. The
+// function returned must be called when the test is done.
+func newDatastoreContext(t *testing.T) (context.Context, func()) {
+	if *useAetest {
+		c, done, err := aetest.NewContext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, done
+	}
+	c, _, _ := newTestContext(t)
+	return c, func() {}
+}
+
+// runTasks runs the queued tasks and all the tasks they queue in turn
+func runTasks(t *testing.T, c context.Context, tasks *memoryTasks) {
+	if err := tasks.Run(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runProcessor runs a processor end-to-end through all its continuations
+func runProcessor(t *testing.T, c context.Context, tasks *memoryTasks, processor Processor) {
+	runShards(t, c, tasks, processor, 1)
+}
+
+// runShards runs a processor split into shards end-to-end and returns the
+// key of the job
+func runShards(t *testing.T, c context.Context, tasks *memoryTasks, processor Processor, shards int) *datastore.Key {
+	key, err := startJob(c, processor, &jobOptions{Shards: shards, Split: splitEven})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	return key
+}
+
+// putPhotos creates n photos, one per day from 2015-01-01, by photographers
+// 1 to 4 in turn
+func putPhotos(t *testing.T, c context.Context, n int) {
+	photographers := []Photographer{
+		{1, "Mr Canon"},
+		{2, "Miss Nikon"},
+		{3, "Mrs Pentax"},
+		{4, "Ms Sony"},
+	}
+	ds := getDatastore(c)
+	for i := 0; i < n; i++ {
+		taken := time.Date(2015, 1, 1+i, 12, 0, 0, 0, time.UTC)
+		p := &Photo{
+			Photographer: photographers[i%len(photographers)],
+			Uploaded:     taken.Add(time.Hour),
+			Width:        8000,
+			Height:       6000,
+			Taken:        taken,
+		}
+		k := datastore.NewKey(c, "photo", "", int64(i+1), nil)
+		if _, err := ds.Put(c, k, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// params is a ParamAdapter for creating processors in tests
+type params map[string]string
+
+func (p params) Get(name string) string {
+	return p[name]
+}
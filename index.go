@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+type (
+	// compositeIndex is an index defined in index.yaml
+	compositeIndex struct {
+		Kind       string
+		Ancestor   bool
+		Properties []order
+	}
+)
+
+var (
+	// the indexes projection queries are checked against, the file is only
+	// there on the dev server as it isn't deployed with the app
+	indexFile = "index.yaml"
+)
+
+// checkIndex returns an error if a projection query needs a composite index
+// that isn't in index.yaml, so the job fails to start rather than every one
+// of its tasks. Other queries are left to the datastore as they always
+// have been.
+func checkIndex(q *Query) error {
+	if len(q.projection) == 0 {
+		return nil
+	}
+	required := requiredIndex(q)
+	if required == nil {
+		return nil
+	}
+	indexes, err := loadIndexes(indexFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index.serves(required, equalityProperties(q)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("query for %s needs an index in %s\n%s", q.kind, indexFile, required)
+}
+
+// equalityProperties returns the properties with equality filters, other
+// than the key which every index has
+func equalityProperties(q *Query) []string {
+	properties := []string{}
+	seen := map[string]bool{}
+	for _, f := range q.filters {
+		if f.Operator == "=" && f.Property != "__key__" && !seen[f.Property] {
+			properties = append(properties, f.Property)
+			seen[f.Property] = true
+		}
+	}
+	return properties
+}
+
+// requiredIndex returns the composite index a query needs, or nil if the
+// built-in indexes are enough. The equality filters come first, then the
+// sort orders starting with any inequality property and then any other
+// projected properties.
+func requiredIndex(q *Query) *compositeIndex {
+	index := &compositeIndex{Kind: q.kind, Ancestor: q.ancestor != nil}
+	equality := equalityProperties(q)
+	seen := map[string]bool{}
+	for _, p := range equality {
+		index.Properties = append(index.Properties, order{Property: p})
+		seen[p] = true
+	}
+
+	orders := q.orders
+	// a final key order is the order of every index anyway
+	if n := len(orders); n > 0 && orders[n-1].Property == "__key__" && !orders[n-1].Descending {
+		orders = orders[:n-1]
+	}
+	for _, f := range q.filters {
+		if f.Operator != "=" && f.Property != "__key__" && (len(orders) == 0 || orders[0].Property != f.Property) {
+			orders = append([]order{{Property: f.Property}}, orders...)
+			break
+		}
+	}
+	sorted := 0
+	for _, o := range orders {
+		if !seen[o.Property] {
+			index.Properties = append(index.Properties, o)
+			seen[o.Property] = true
+			sorted++
+		}
+	}
+	for _, p := range q.projection {
+		if !seen[p] {
+			index.Properties = append(index.Properties, order{Property: p})
+			seen[p] = true
+			sorted++
+		}
+	}
+
+	// equality filters alone are merged from the built-in indexes, as is a
+	// single property without an ancestor
+	if sorted == 0 || (!index.Ancestor && len(equality) == 0 && sorted == 1) {
+		return nil
+	}
+	return index
+}
+
+// serves returns whether the index can be used for the required index, the
+// equality properties can be in any order and the directions of them and
+// the projected properties after the sort orders don't matter
+func (index *compositeIndex) serves(required *compositeIndex, equality []string) bool {
+	if index.Kind != required.Kind || index.Ancestor != required.Ancestor || len(index.Properties) != len(required.Properties) {
+		return false
+	}
+	prefix := map[string]bool{}
+	for _, p := range index.Properties[:len(equality)] {
+		prefix[p.Property] = true
+	}
+	for _, p := range equality {
+		if !prefix[p] {
+			return false
+		}
+	}
+	for i := len(equality); i < len(required.Properties); i++ {
+		if index.Properties[i] != required.Properties[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the index as it would be in index.yaml
+func (index *compositeIndex) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "- kind: %s\n", index.Kind)
+	if index.Ancestor {
+		buf.WriteString("  ancestor: yes\n")
+	}
+	buf.WriteString("  properties:\n")
+	for _, p := range index.Properties {
+		fmt.Fprintf(&buf, "  - name: %s\n", p.Property)
+		if p.Descending {
+			buf.WriteString("    direction: desc\n")
+		}
+	}
+	return buf.String()
+}
+
+// loadIndexes reads the composite indexes from an index.yaml file
+func loadIndexes(filename string) ([]*compositeIndex, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseIndexes(data)
+}
+
+// parseIndexes parses as much of the index.yaml format as the indexes use,
+// a list of kinds each with an optional ancestor and a list of properties
+// with an optional direction
+func parseIndexes(data []byte) ([]*compositeIndex, error) {
+	indexes := []*compositeIndex{}
+	var index *compositeIndex
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		item := strings.HasPrefix(text, "- ")
+		text = strings.TrimSpace(strings.TrimPrefix(text, "- "))
+		if text == "" || text == "indexes:" {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid index line %d %q", line, scanner.Text())
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		switch name {
+		case "kind", "ancestor", "properties":
+			if item || index == nil {
+				index = new(compositeIndex)
+				indexes = append(indexes, index)
+			}
+			switch name {
+			case "kind":
+				index.Kind = value
+			case "ancestor":
+				index.Ancestor = value == "yes" || value == "true"
+			}
+		case "name", "direction":
+			if index == nil {
+				return nil, fmt.Errorf("index property before a kind on line %d", line)
+			}
+			if item || len(index.Properties) == 0 {
+				index.Properties = append(index.Properties, order{})
+			}
+			p := &index.Properties[len(index.Properties)-1]
+			if name == "name" {
+				p.Property = value
+			} else if value == "desc" || value == "descending" {
+				p.Descending = true
+			} else if value != "asc" && value != "ascending" {
+				return nil, fmt.Errorf("invalid index direction %q on line %d", value, line)
+			}
+		default:
+			return nil, fmt.Errorf("unknown index setting %q on line %d", name, line)
+		}
+	}
+	return indexes, scanner.Err()
+}
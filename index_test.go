@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestParseIndexes(t *testing.T) {
+	indexes, err := parseIndexes([]byte(`indexes:
+
+# comments are ignored
+- kind: photo
+  ancestor: yes
+  properties:
+  - name: photographer.id
+  - name: taken
+    direction: desc
+
+- kind: video
+  properties:
+  - name: uploaded   # so is this
+    direction: asc
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*compositeIndex{
+		{"photo", true, []order{{"photographer.id", false}, {"taken", true}}},
+		{"video", false, []order{{"uploaded", false}}},
+	}
+	if !reflect.DeepEqual(indexes, expected) {
+		t.Errorf("expected %v got %v", expected, indexes)
+	}
+
+	for _, invalid := range []string{
+		"- name: taken",
+		"- kind: photo\n  properties:\n  - name: taken\n    direction: up",
+		"- kind: photo\n  size: 10",
+		"- kind photo",
+	} {
+		if _, err := parseIndexes([]byte(invalid)); err == nil {
+			t.Errorf("%q expected error", invalid)
+		}
+	}
+
+	// the app's own indexes can be read
+	if _, err := loadIndexes("index.yaml"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequiredIndex(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	photo := NewQuery("photo")
+
+	tests := []struct {
+		name     string
+		q        *Query
+		expected *compositeIndex
+	}{
+		{"kind", photo, nil},
+		{"single property", photo.Filter("taken >=", from).Order("-taken"), nil},
+		{"equality", photo.Filter("photographer.id =", 1).Filter("uploaded =", from), nil},
+		{"single projection", photo.Project("taken"), nil},
+		{"key order", photo.Filter("taken >=", from).Order("taken").Order("__key__"), nil},
+		{"projection", photo.Filter("taken >=", from).Project("photographer.id"),
+			&compositeIndex{"photo", false, []order{{"taken", false}, {"photographer.id", false}}}},
+		{"equality and order", photo.Filter("photographer.id =", 1).Order("-taken"),
+			&compositeIndex{"photo", false, []order{{"photographer.id", false}, {"taken", true}}}},
+		{"ancestor", photo.Ancestor(datastore.NewKey(c, "photographer", "", 1, nil)).Order("taken"),
+			&compositeIndex{"photo", true, []order{{"taken", false}}}},
+	}
+	for _, test := range tests {
+		if index := requiredIndex(test.q); !reflect.DeepEqual(index, test.expected) {
+			t.Errorf("%s expected index %v got %v", test.name, test.expected, index)
+		}
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(file string) { indexFile = file }(indexFile)
+
+	// without an index file there's nothing to check against
+	indexFile = filepath.Join(dir, "index.yaml")
+	q := NewQuery("photo").Filter("photographer.id =", 1).Order("-taken").Project("uploaded")
+	if err := checkIndex(q); err != nil {
+		t.Errorf("expected no error without an index file got %s", err.Error())
+	}
+
+	// the equality properties can be in any order but not the sort orders
+	if err := ioutil.WriteFile(indexFile, []byte(`indexes:
+- kind: photo
+  properties:
+  - name: photographer.id
+  - name: taken
+    direction: desc
+  - name: uploaded
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		q     *Query
+		valid bool
+	}{
+		{"indexed", q, true},
+		{"not a projection", NewQuery("photo").Filter("photographer.id =", 1).Order("taken"), true},
+		{"built-in", NewQuery("photo").Project("taken"), true},
+		{"direction", NewQuery("photo").Filter("photographer.id =", 1).Order("taken").Project("uploaded"), false},
+		{"missing property", NewQuery("photo").Filter("photographer.id =", 1).Order("-taken").Project("uploaded", "name"), false},
+		{"other kind", NewQuery("video").Filter("photographer.id =", 1).Order("-taken").Project("uploaded"), false},
+	}
+	for _, test := range tests {
+		if err := checkIndex(test.q); (err == nil) != test.valid {
+			t.Errorf("%s expected valid %t got %v", test.name, test.valid, err)
+		}
+	}
+
+	// a job doesn't start without the index its projection needs
+	c, _, _ := newTestContext(t)
+	p, _ := newAggregatePhotos(params{"from": "2015-01-01", "to": "2015-02-01"})
+	if _, err := startJob(c, p, &jobOptions{Shards: 1, Split: splitEven}); err == nil {
+		t.Errorf("expected error starting a job without its index")
+	}
+}
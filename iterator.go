@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// resumingIterator runs a query and keeps the keys of the results read
+	// since the cursor it started from, if reading the results fails with
+	// an error that may not happen again the query is run again from that
+	// cursor, skipping the results already read, rather than failing the
+	// task which would start the slice over and process everything again.
+	// Results are skipped by key rather than counted so none are missed if
+	// processing them moved entities out of the query. A cursor is only got
+	// from the query when it's asked for.
+	resumingIterator struct {
+		c       context.Context
+		q       *Query
+		it      Iterator
+		read    map[string]bool
+		retries int
+	}
+)
+
+var (
+	// how many times a query is resumed after errors before the slice
+	// fails, and how long to wait before the first time, the wait doubles
+	// each time
+	iterationRetries = 5
+	iterationBackoff = time.Duration(100) * time.Millisecond
+)
+
+// runResuming runs the query, resuming it after errors
+func runResuming(c context.Context, q *Query) *resumingIterator {
+	return &resumingIterator{c: c, q: q, it: getDatastore(c).Run(c, q), read: map[string]bool{}}
+}
+
+func (r *resumingIterator) Next(dst interface{}) (*datastore.Key, error) {
+	for {
+		if r.q.limit > 0 && len(r.read) >= r.q.limit {
+			return nil, datastore.Done
+		}
+		key, err := r.it.Next(dst)
+		if err == nil {
+			if r.read[key.Encode()] {
+				resetEntity(dst)
+				continue
+			}
+			r.read[key.Encode()] = true
+			return key, nil
+		}
+		if err == datastore.Done || !resumable(r.c, err) || r.retries >= iterationRetries {
+			return key, err
+		}
+
+		wait := iterationBackoff << uint(r.retries)
+		r.retries++
+		log.Warningf(r.c, "query for %s error %s, resuming in %s", r.q.kind, err.Error(), wait)
+		time.Sleep(wait)
+		// the query runs again from the cursor it started from, with the
+		// same limit as the results read before that are skipped
+		r.it = getDatastore(r.c).Run(r.c, r.q)
+	}
+}
+
+// Cursor returns the cursor after the last result, or where the query
+// started if there hasn't been one
+func (r *resumingIterator) Cursor() (string, error) {
+	if len(r.read) == 0 {
+		return r.q.start, nil
+	}
+	return r.it.Cursor()
+}
+
+// resumable returns whether a query that failed with the error could work
+// if it's run again, the datastore times out or has internal errors now and
+// then but once the request's own deadline has passed there's no point
+func resumable(c context.Context, err error) bool {
+	if c.Err() != nil {
+		return false
+	}
+	return appengine.IsTimeoutError(err) || strings.Contains(err.Error(), "datastore_v3: INTERNAL_ERROR")
+}
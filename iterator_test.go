@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// flakyStore runs queries that fail with the error after returning
+	// some results, until it has failed as many times as it's told to
+	flakyStore struct {
+		*memoryStore
+		err      error
+		after    int
+		failures int
+		runs     int
+		cursors  int
+	}
+
+	flakyIterator struct {
+		Iterator
+		store *flakyStore
+		read  int
+	}
+)
+
+func (s *flakyStore) Run(c context.Context, q *Query) Iterator {
+	s.runs++
+	return &flakyIterator{Iterator: s.memoryStore.Run(c, q), store: s}
+}
+
+func (i *flakyIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if i.read == i.store.after && i.store.failures > 0 {
+		i.store.failures--
+		return nil, i.store.err
+	}
+	i.read++
+	return i.Iterator.Next(dst)
+}
+
+func (i *flakyIterator) Cursor() (string, error) {
+	i.store.cursors++
+	return i.Iterator.Cursor()
+}
+
+func TestResumingIterator(t *testing.T) {
+	defer func(backoff time.Duration) { iterationBackoff = backoff }(iterationBackoff)
+	iterationBackoff = time.Millisecond
+
+	internal := errors.New("API error 3 (datastore_v3: INTERNAL_ERROR): try again")
+	tests := []struct {
+		name     string
+		err      error
+		failures int
+		runs     int
+		ok       bool
+	}{
+		// a finished query is run again from its cursor to find there are
+		// no more results
+		{"timeout", context.DeadlineExceeded, 2, 4, true},
+		{"internal", internal, iterationRetries, iterationRetries + 2, true},
+		{"too many", internal, iterationRetries + 1, iterationRetries + 1, false},
+		{"other", errors.New("boom"), 1, 1, false},
+	}
+	for _, test := range tests {
+		c, store, _ := newTestContext(t)
+		putPhotos(t, c, 10)
+		flaky := &flakyStore{memoryStore: store, err: test.err, after: 1, failures: test.failures}
+		c = withDatastore(c, flaky)
+
+		// every photo is processed once, however many times the query fails
+		processed := map[int64]int{}
+		fn := func(c context.Context, key *datastore.Key) error {
+			processed[key.IntID()]++
+			return nil
+		}
+		cursor, total, _, err := runQuery(c, fn, NewQuery("photo"), nil, nil, "", time.Now().Add(time.Minute))
+		if (err == nil) != test.ok {
+			t.Errorf("%s expected ok %t got %v", test.name, test.ok, err)
+		}
+		if flaky.runs != test.runs {
+			t.Errorf("%s expected %d runs got %d", test.name, test.runs, flaky.runs)
+		}
+		// a cursor is only got at the end of the batch, not for each result
+		if test.ok && flaky.cursors != 1 {
+			t.Errorf("%s expected 1 cursor got %d", test.name, flaky.cursors)
+		}
+		if !test.ok {
+			continue
+		}
+		if cursor != "" || total != 10 || len(processed) != 10 {
+			t.Errorf("%s expected all 10 processed got %d %d", test.name, total, len(processed))
+		}
+		for id, n := range processed {
+			if n != 1 {
+				t.Errorf("%s photo %d processed %d times", test.name, id, n)
+			}
+		}
+	}
+}
+
+func TestResumingIteratorMovedEntities(t *testing.T) {
+	defer func(backoff time.Duration) { iterationBackoff = backoff }(iterationBackoff)
+	iterationBackoff = time.Millisecond
+
+	c, store, _ := newTestContext(t)
+	putPhotos(t, c, 10)
+	flaky := &flakyStore{memoryStore: store, err: context.DeadlineExceeded, after: 3, failures: 1}
+	c = withDatastore(c, flaky)
+
+	// processing a photo moves it out of the query, the query resumed from
+	// its cursor doesn't skip any that haven't been processed
+	processed := map[int64]int{}
+	fn := func(c context.Context, key *datastore.Key) error {
+		processed[key.IntID()]++
+		p := new(Photo)
+		if err := getDatastore(c).Get(c, key, p); err != nil {
+			return err
+		}
+		p.Photographer.ID = 9
+		_, err := getDatastore(c).Put(c, key, p)
+		return err
+	}
+	q := NewQuery("photo").Filter("photographer.id <", int64(9)).Limit(5)
+	cursor, total, _, err := runQuery(c, fn, q, nil, nil, "", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "" || total != 10 || len(processed) != 10 {
+		t.Errorf("expected all 10 processed got %d %d", total, len(processed))
+	}
+	for id, n := range processed {
+		if n != 1 {
+			t.Errorf("photo %d processed %d times", id, n)
+		}
+	}
+}
+
+func TestResumable(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	if !resumable(c, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline to be resumable")
+	}
+	if resumable(c, datastore.ErrInvalidEntityType) {
+		t.Errorf("expected an invalid entity not to be resumable")
+	}
+	done, cancel := context.WithCancel(c)
+	cancel()
+	if resumable(done, context.DeadlineExceeded) {
+		t.Errorf("expected nothing to be resumable once the context is done")
+	}
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// job tracks a processing run across all of its shards
+	job struct {
+		Processor string         `datastore:"processor"`
+		Shards    int            `datastore:"shards,noindex"`
+		Active    int            `datastore:"active,noindex"`
+		Finalizer int            `datastore:"finalizer,noindex"`
+		Config    []byte         `datastore:"config,noindex"`
+		Pipeline  *datastore.Key `datastore:"pipeline"`
+		Stage     string         `datastore:"stage,noindex"`
+		Backfill  *datastore.Key `datastore:"backfill"`
+		Unit      int            `datastore:"unit,noindex"`
+		Callback  string         `datastore:"callback,noindex"`
+		Queue     string         `datastore:"callback_queue,noindex"`
+		Watermark string         `datastore:"watermark,noindex"`
+		Until     time.Time      `datastore:"until,noindex"`
+		OnPanic   string         `datastore:"on_panic,noindex"`
+		MaxPanics int            `datastore:"max_panics,noindex"`
+		Panics    int            `datastore:"panics,noindex"`
+		Ended     bool           `datastore:"ended,noindex"`
+		Status    string         `datastore:"status"`
+		Error     string         `datastore:"error,noindex"`
+		Created   time.Time      `datastore:"created"`
+		Updated   time.Time      `datastore:"updated"`
+	}
+
+	// shard tracks the progress of one part of a job, it's a child of the
+	// job so that the job and shard can be updated together
+	shard struct {
+		Range      string    `datastore:"range,noindex"`
+		Cursor     string    `datastore:"cursor,noindex"`
+		Processed  int64     `datastore:"processed,noindex"`
+		Contended  int64     `datastore:"contended,noindex"`
+		Slices     int       `datastore:"slices,noindex"`
+		Status     string    `datastore:"status"`
+		State      []byte    `datastore:"state,noindex"`
+		Rebalance  bool      `datastore:"rebalance,noindex"`
+		Rebalanced time.Time `datastore:"rebalanced,noindex"`
+		Started    time.Time `datastore:"started,noindex"`
+		Updated    time.Time `datastore:"updated"`
+	}
+
+	// shardTask is passed from each task of a shard to the next
+	shardTask struct {
+		Job    *datastore.Key
+		Shard  int
+		Slice  int
+		Range  ShardInput
+		Cursor string
+	}
+
+	// ShardInput is the part of a processor's input that one shard works
+	// on, such as a KeyRange or PropertyRange. A nil ShardInput is all of it.
+	ShardInput interface {
+		// Filter restricts a query to the input
+		Filter(q *Query) *Query
+
+		// SplitRemaining splits what is left of the input after the last
+		// key processed, the part kept must start after the last key and
+		// end where the tail starts. The shard runs the part kept from its
+		// start as a cursor is only valid for the query it came from. The
+		// tail is nil if it can't be split.
+		SplitRemaining(c context.Context, last *datastore.Key) (ShardInput, ShardInput, error)
+	}
+
+	// JobStats summarises a job once all of its shards have finished
+	JobStats struct {
+		Job       int64
+		Processor string
+		Shards    int
+		Processed int64
+		Contended int64
+		Panics    int
+		Slices    int
+		Started   time.Time
+		Finished  time.Time
+	}
+
+	// jobOptions are the settings for splitting a job into shards, the
+	// pipeline stage or backfill unit that it's for if there is one and
+	// where to send the summary when it closes. The callback is a webhook
+	// URL unless a queue is set, then it's the path of a task added to that
+	// queue. With a watermark property a Windowed processor runs from where
+	// the last run finished, less the overlap, up to now. A MultiQuerier
+	// runs a shard for each sub-query unless they're merged into one. A
+	// query given as json is run by a Queryable processor instead of its
+	// own. An entity that panics is skipped or fails its slice, and the job
+	// fails once there have been the maximum number of panics. A job run in
+	// all namespaces is split into ranges of namespaces instead.
+	jobOptions struct {
+		Shards        int
+		Split         string
+		Namespaces    string
+		Pipeline      *datastore.Key
+		Stage         string
+		Backfill      *datastore.Key
+		Unit          int
+		Callback      string
+		CallbackQueue string
+		Watermark     string
+		Overlap       time.Duration
+		Multi         string
+		Query         *QuerySpec
+		OnPanic       string
+		MaxPanics     int
+	}
+
+	byDuration []time.Duration
+	byInt64    []int64
+)
+
+const (
+	jobKind   = "job"
+	shardKind = "shard"
+
+	jobRunning    = "running"
+	jobReducing   = "reducing"
+	jobCompleted  = "completed"
+	jobFailed     = "failed"
+	jobCancelled  = "cancelled"
+	shardRunning  = "running"
+	shardComplete = "completed"
+
+	// the most shards a job can be split into
+	maxShards = 256
+
+	// how a PropertyRange is split, into equal sized intervals or using a
+	// sample of the values so each shard has about as many entities, and
+	// how the namespaces of a job run in all of them are split, in halves
+	// or by how many entities each namespace has
+	splitEven    = "even"
+	splitSample  = "sample"
+	splitDensity = "density"
+
+	// a running shard is a straggler if it looks like it will take this
+	// many times as long as the median completed shard
+	stragglerFactor = 2
+)
+
+var (
+	// shards aren't split until they have run for at least this long, as
+	// the tail will start from scratch in a new task
+	stragglerMinimum = time.Duration(1) * time.Minute
+)
+
+func (s byDuration) Len() int           { return len(s) }
+func (s byDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool { return s[i] < s[j] }
+
+func (s byInt64) Len() int           { return len(s) }
+func (s byInt64) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byInt64) Less(i, j int) bool { return s[i] < s[j] }
+
+func init() {
+	// so either type of range can be sent in tasks
+	gob.Register(&KeyRange{})
+	gob.Register(&PropertyRange{})
+}
+
+// newJobOptions gets the job options from the params, a single shard by
+// default
+func newJobOptions(params ParamAdapter) (*jobOptions, error) {
+	opts := &jobOptions{Shards: 1, Split: splitEven}
+	if s := params.Get("shards"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shards %q", s)
+		}
+		opts.Shards = n
+	}
+	if s := params.Get("split"); s != "" {
+		opts.Split = s
+	}
+	if s := params.Get("multi"); s != "" {
+		opts.Multi = s
+	}
+	opts.Namespaces = params.Get("namespaces")
+	var err error
+	if opts.Query, err = queryParam(params); err != nil {
+		return nil, err
+	}
+	opts.OnPanic = params.Get("on_panic")
+	if s := params.Get("max_panics"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_panics %q", s)
+		}
+		opts.MaxPanics = n
+	}
+	opts.Callback = params.Get("callback")
+	opts.CallbackQueue = params.Get("callback_queue")
+	opts.Watermark = params.Get("watermark")
+	if s := params.Get("overlap"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid overlap %q", s)
+		}
+		opts.Overlap = d
+	}
+	return opts, opts.validate()
+}
+
+func (opts *jobOptions) validate() error {
+	if opts.Shards < 1 || opts.Shards > maxShards {
+		return fmt.Errorf("shards must be between 1 and %d", maxShards)
+	}
+	if opts.Split != splitEven && opts.Split != splitSample && opts.Split != splitDensity {
+		return fmt.Errorf("split must be %s, %s or %s", splitEven, splitSample, splitDensity)
+	}
+	if opts.Namespaces != "" && opts.Namespaces != namespacesAll {
+		return fmt.Errorf("namespaces must be %s", namespacesAll)
+	}
+	if opts.Split == splitSample && opts.Namespaces == namespacesAll {
+		return fmt.Errorf("split must be %s or %s for all namespaces", splitEven, splitDensity)
+	}
+	if opts.Split == splitDensity && opts.Namespaces != namespacesAll {
+		return fmt.Errorf("split %s is only for all namespaces", splitDensity)
+	}
+	if opts.Multi != "" && opts.Multi != multiShards && opts.Multi != multiMerge {
+		return fmt.Errorf("multi must be %s or %s", multiShards, multiMerge)
+	}
+	if opts.CallbackQueue != "" {
+		if !strings.HasPrefix(opts.Callback, "/") {
+			return fmt.Errorf("callback must be a path when a callback queue is set")
+		}
+	} else if opts.Callback != "" {
+		u, err := url.Parse(opts.Callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("callback must be an http or https URL")
+		}
+	}
+	if opts.Overlap < 0 || (opts.Overlap > 0 && opts.Watermark == "") {
+		return fmt.Errorf("overlap must be positive and needs a watermark")
+	}
+	if opts.OnPanic != "" && opts.OnPanic != panicSkip && opts.OnPanic != panicFail {
+		return fmt.Errorf("on_panic must be %s or %s", panicSkip, panicFail)
+	}
+	if opts.MaxPanics < 0 {
+		return fmt.Errorf("max_panics can't be negative")
+	}
+	if opts.Query != nil {
+		if err := opts.Query.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startJob splits the input of a processor into at most the number of
+// shards in the options and queues the first task for each of them
+func startJob(c context.Context, processor Processor, opts *jobOptions) (*datastore.Key, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := applyQuery(processor, opts); err != nil {
+		return nil, err
+	}
+	var until time.Time
+	if opts.Watermark != "" {
+		var err error
+		if until, err = applyWatermark(c, processor, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkIndexes(c, processor); err != nil {
+		return nil, err
+	}
+	ranges, err := splitInput(c, processor, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, ok := processor.(JobBeginner); ok {
+		if err := b.BeginJob(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// kept so that shards split off stragglers can start from scratch
+	config, err := encodeProcessor(processor)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := getDatastore(c)
+	now := time.Now().UTC()
+	j := &job{
+		Processor: processorName(processor),
+		Shards:    len(ranges),
+		Active:    len(ranges),
+		Config:    config,
+		Pipeline:  opts.Pipeline,
+		Stage:     opts.Stage,
+		Backfill:  opts.Backfill,
+		Unit:      opts.Unit,
+		Callback:  opts.Callback,
+		Queue:     opts.CallbackQueue,
+		Watermark: opts.Watermark,
+		Until:     until,
+		OnPanic:   opts.OnPanic,
+		MaxPanics: opts.MaxPanics,
+		Status:    jobRunning,
+		Created:   now,
+		Updated:   now,
+	}
+	jobKey, err := ds.Put(c, datastore.NewIncompleteKey(c, jobKind, nil), j)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(ranges))
+	shards := make([]*shard, len(ranges))
+	for i, r := range ranges {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = shardKey(c, jobKey, i)
+		shards[i] = &shard{
+			Range:   string(data),
+			Status:  shardRunning,
+			Started: now,
+			Updated: now,
+		}
+	}
+	if _, err := ds.PutMulti(c, keys, shards); err != nil {
+		return nil, err
+	}
+
+	for i, r := range ranges {
+		if err := processFunc.Call(c, processor, &shardTask{Job: jobKey, Shard: i, Range: r}); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Infof(c, "started job %d for %s with %d shards", jobKey.IntID(), j.Processor, j.Shards)
+	return jobKey, nil
+}
+
+// splitInput splits the input of a processor into shards. Processors that
+// are a PropertyRanger are split on their property range, any others by
+// key range. The sub-queries of a MultiQuerier are never split further. A
+// job in all namespaces is split by namespace, even with a single shard.
+func splitInput(c context.Context, processor Processor, opts *jobOptions) ([]ShardInput, error) {
+	q, _ := processor.Start(c)
+	if m, ok := processor.(MultiQuerier); ok {
+		if queries := m.SubQueries(); len(queries) > 1 {
+			return splitQueries(queries, q, opts)
+		}
+	}
+	if opts.Namespaces == namespacesAll {
+		return splitNamespaces(c, q, opts)
+	}
+
+	// a single shard uses the processor's query as it is
+	if opts.Shards == 1 {
+		return []ShardInput{nil}, nil
+	}
+
+	inputs := []ShardInput{}
+	if pr, ok := processor.(PropertyRanger); ok {
+		var ranges []*PropertyRange
+		var err error
+		if opts.Split == splitSample {
+			ranges, err = pr.PropertyRange().SplitBySample(c, q.kind, q.namespace, opts.Shards, scatterOversampling)
+		} else {
+			ranges, err = pr.PropertyRange().Split(opts.Shards)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ranges {
+			inputs = append(inputs, r)
+		}
+		return inputs, nil
+	}
+
+	if err := q.keyShardable(); err != nil {
+		return nil, err
+	}
+	ranges, err := splitByScatter(c, q.kind, q.namespace, opts.Shards, scatterOversampling)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		inputs = append(inputs, r)
+	}
+	return inputs, nil
+}
+
+// checkIndexes checks the indexes a processor's query needs are defined,
+// including those for each of its sub-queries
+func checkIndexes(c context.Context, processor Processor) error {
+	q, _ := processor.Start(c)
+	if err := checkIndex(q); err != nil {
+		return err
+	}
+	if m, ok := processor.(MultiQuerier); ok {
+		for _, filters := range m.SubQueries() {
+			if err := checkIndex(applyFilters(q, filters)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func shardKey(c context.Context, jobKey *datastore.Key, index int) *datastore.Key {
+	return datastore.NewKey(c, shardKind, "", int64(index+1), jobKey)
+}
+
+// updateShard records the progress of a shard at the end of a slice, it
+// returns whether the shard has been picked as a straggler to be split
+func updateShard(c context.Context, task *shardTask, stats *sliceStats) (bool, error) {
+	rebalance := false
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		key := shardKey(tc, task.Job, task.Shard)
+		s := new(shard)
+		if err := ds.Get(tc, key, s); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		rebalance = s.Rebalance
+		s.Cursor = task.Cursor
+		s.Processed += stats.Processed
+		s.Contended += stats.Contended
+		s.Slices++
+		s.Rebalance = false
+		if rebalance {
+			s.Rebalanced = now
+		}
+		s.Updated = now
+		_, err := ds.Put(tc, key, s)
+		return err
+	})
+	return rebalance, err
+}
+
+// splitShard splits the rest of the input of a shard after the last key it
+// processed and hands the tail to a new shard, it returns the input that
+// the shard keeps
+func splitShard(c context.Context, task *shardTask, last *datastore.Key) (ShardInput, error) {
+	if task.Range == nil || last == nil {
+		return task.Range, nil
+	}
+	// the entities aren't in the job's entity group so this is done before
+	// the transaction
+	keep, tail, err := task.Range.SplitRemaining(c, last)
+	if err != nil || tail == nil {
+		return task.Range, err
+	}
+	keepData, err := json.Marshal(keep)
+	if err != nil {
+		return nil, err
+	}
+	tailData, err := json.Marshal(tail)
+	if err != nil {
+		return nil, err
+	}
+
+	split := false
+	err = getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		j := new(job)
+		if err := ds.Get(tc, task.Job, j); err != nil {
+			return err
+		}
+		if j.Shards >= maxShards || j.Config == nil {
+			return nil
+		}
+		processor, err := decodeProcessor(j.Config)
+		if err != nil {
+			return err
+		}
+
+		key := shardKey(tc, task.Job, task.Shard)
+		s := new(shard)
+		if err := ds.Get(tc, key, s); err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		s.Range = string(keepData)
+		s.Cursor = ""
+		s.Updated = now
+		if _, err := ds.Put(tc, key, s); err != nil {
+			return err
+		}
+
+		index := j.Shards
+		t := &shard{
+			Range:   string(tailData),
+			Status:  shardRunning,
+			Started: now,
+			Updated: now,
+		}
+		if _, err := ds.Put(tc, shardKey(tc, task.Job, index), t); err != nil {
+			return err
+		}
+
+		j.Shards++
+		j.Active++
+		j.Updated = now
+		if _, err := ds.Put(tc, task.Job, j); err != nil {
+			return err
+		}
+
+		split = true
+		return processFunc.Call(tc, processor, &shardTask{Job: task.Job, Shard: index, Range: tail})
+	})
+	if err != nil || !split {
+		return task.Range, err
+	}
+
+	log.Infof(c, "split shard %d of job %d, the rest is %s", task.Shard, task.Job.IntID(), string(tailData))
+	return keep, nil
+}
+
+// rebalanceJob looks for straggling shards of a job and flags them so they
+// split off the rest of their input at the end of their next slice
+func rebalanceJob(c context.Context, jobKey *datastore.Key) error {
+	ds := getDatastore(c)
+	it := ds.Run(c, NewQuery(shardKind).Ancestor(jobKey).Order("__key__"))
+	keys := []*datastore.Key{}
+	shards := []*shard{}
+	for {
+		s := new(shard)
+		key, err := it.Next(s)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		shards = append(shards, s)
+	}
+
+	for _, i := range findStragglers(shards, time.Now().UTC()) {
+		key := keys[i]
+		err := ds.RunInTransaction(c, func(tc context.Context) error {
+			s := new(shard)
+			if err := getDatastore(tc).Get(tc, key, s); err != nil {
+				return err
+			}
+			if s.Status != shardRunning || s.Rebalance {
+				return nil
+			}
+			s.Rebalance = true
+			_, err := getDatastore(tc).Put(tc, key, s)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Infof(c, "shard %d of job %d is straggling", key.IntID()-1, jobKey.IntID())
+	}
+	return nil
+}
+
+// findStragglers returns the indexes of the running shards that are far
+// behind the rest. Once at least half the shards have completed, a shard
+// that has run longer than the median completed shard is a straggler if,
+// at the rate it's going, it will take more than stragglerFactor times as
+// long. What it has left is estimated from the median size of the
+// completed shards, or at least another slice if it's already bigger.
+func findStragglers(shards []*shard, now time.Time) []int {
+	durations := []time.Duration{}
+	sizes := []int64{}
+	for _, s := range shards {
+		if s.Status == shardComplete {
+			durations = append(durations, s.Updated.Sub(s.Started))
+			sizes = append(sizes, s.Processed)
+		}
+	}
+	if len(durations) == 0 || len(durations)*2 < len(shards) {
+		return nil
+	}
+	sort.Sort(byDuration(durations))
+	sort.Sort(byInt64(sizes))
+	duration, size := durations[len(durations)/2], sizes[len(sizes)/2]
+
+	stragglers := []int{}
+	for i, s := range shards {
+		if s.Status != shardRunning || s.Rebalance {
+			continue
+		}
+		// give it time since it started or was last split
+		since := s.Started
+		if s.Rebalanced.After(since) {
+			since = s.Rebalanced
+		}
+		if now.Sub(since) < stragglerMinimum || now.Sub(since) <= duration {
+			continue
+		}
+
+		elapsed := now.Sub(s.Started)
+		if s.Processed == 0 {
+			stragglers = append(stragglers, i)
+			continue
+		}
+		remaining := size - s.Processed
+		if slice := s.Processed / int64(s.Slices); remaining < slice {
+			remaining = slice
+		}
+		rate := float64(s.Processed) / float64(elapsed)
+		estimate := elapsed + time.Duration(float64(remaining)/rate)
+		if estimate > stragglerFactor*duration {
+			stragglers = append(stragglers, i)
+		}
+	}
+	return stragglers
+}
+
+// finishShard marks a shard as complete and, if it was the last shard of
+// the job to complete, merges the results of the other shards into the
+// processor and finishes the job. It's safe to call again if it fails.
+func finishShard(c context.Context, processor Processor, task *shardTask, stats *sliceStats) error {
+	var state []byte
+	if _, ok := processor.(Merger); ok {
+		var err error
+		if state, err = encodeProcessor(processor); err != nil {
+			return err
+		}
+	}
+
+	last := false
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		j := new(job)
+		if err := ds.Get(tc, task.Job, j); err != nil {
+			return err
+		}
+		key := shardKey(tc, task.Job, task.Shard)
+		s := new(shard)
+		if err := ds.Get(tc, key, s); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if s.Status != shardComplete {
+			s.Status = shardComplete
+			s.Cursor = ""
+			s.Processed += stats.Processed
+			s.Contended += stats.Contended
+			s.Slices++
+			s.State = state
+			s.Updated = now
+			if _, err := ds.Put(tc, key, s); err != nil {
+				return err
+			}
+
+			j.Active--
+			if j.Active == 0 {
+				j.Finalizer = task.Shard
+			}
+			j.Updated = now
+			if _, err := ds.Put(tc, task.Job, j); err != nil {
+				return err
+			}
+		}
+		last = j.Active == 0 && j.Status == jobRunning && j.Finalizer == task.Shard
+		return nil
+	})
+	if err != nil || !last {
+		return err
+	}
+
+	return finishJob(c, processor, task)
+}
+
+// finishJob is called once all the shards have completed
+func finishJob(c context.Context, processor Processor, task *shardTask) error {
+	ds := getDatastore(c)
+	j := new(job)
+	if err := ds.Get(c, task.Job, j); err != nil {
+		return err
+	}
+	others, stats, err := shardResults(c, task, j)
+	if err != nil {
+		return err
+	}
+	if m, ok := processor.(Merger); ok {
+		for _, other := range others {
+			m.Merge(other)
+		}
+	}
+
+	if stats.Contended > 0 {
+		log.Warningf(c, "job %d skipped %d entities after their transactions failed because of contention", task.Job.IntID(), stats.Contended)
+	}
+
+	// the job isn't complete until the values a mapper emitted are reduced,
+	// so EndJob is called once they have been
+	if m, ok := processor.(Mapper); ok {
+		log.Infof(c, "mapped job %d for %s, %d processed by %d shards in %d slices", task.Job.IntID(), j.Processor, stats.Processed, stats.Shards, stats.Slices)
+		return startReduce(c, m, task.Job, stats)
+	}
+
+	if err := endJob(c, processor, task.Job, j, stats); err != nil {
+		return err
+	}
+	if err := closeJob(c, task.Job, jobCompleted, ""); err != nil {
+		return err
+	}
+
+	log.Infof(c, "completed job %d for %s, %d processed by %d shards in %d slices", task.Job.IntID(), j.Processor, stats.Processed, stats.Shards, stats.Slices)
+	return nil
+}
+
+// endJob calls EndJob on the processor, it isn't called again if the task
+// is retried after it worked
+func endJob(c context.Context, processor Processor, jobKey *datastore.Key, j *job, stats *JobStats) error {
+	e, ok := processor.(JobEnder)
+	if !ok || j.Ended {
+		return nil
+	}
+	if err := e.EndJob(c, stats); err != nil {
+		log.Errorf(c, "end job error %s", err.Error())
+		return err
+	}
+	if err := endedJob(c, jobKey); err != nil {
+		log.Errorf(c, "record end job error %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+// endedJob records that EndJob has been called for a job
+func endedJob(c context.Context, jobKey *datastore.Key) error {
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		j := new(job)
+		if err := ds.Get(tc, jobKey, j); err != nil {
+			return err
+		}
+		j.Ended = true
+		j.Updated = time.Now().UTC()
+		_, err := ds.Put(tc, jobKey, j)
+		return err
+	})
+}
+
+// shardResults returns the final state of the processors of the other
+// shards of the job, in shard order, and the stats for the whole job
+func shardResults(c context.Context, task *shardTask, j *job) ([]Processor, *JobStats, error) {
+	stats := &JobStats{
+		Job:       task.Job.IntID(),
+		Processor: j.Processor,
+		Shards:    j.Shards,
+		Panics:    j.Panics,
+		Started:   j.Created,
+		Finished:  time.Now().UTC(),
+	}
+	it := getDatastore(c).Run(c, NewQuery(shardKind).Ancestor(task.Job).Order("__key__"))
+	processors := []Processor{}
+	for {
+		s := new(shard)
+		key, err := it.Next(s)
+		if err == datastore.Done {
+			return processors, stats, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		stats.Processed += s.Processed
+		stats.Contended += s.Contended
+		stats.Slices += s.Slices
+		if key.IntID() == shardKey(c, task.Job, task.Shard).IntID() || s.State == nil {
+			continue
+		}
+		processor, err := decodeProcessor(s.State)
+		if err != nil {
+			return nil, nil, err
+		}
+		processors = append(processors, processor)
+	}
+}
+
+func encodeProcessor(processor Processor) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&processor); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeProcessor(data []byte) (Processor, error) {
+	var processor Processor
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&processor); err != nil {
+		return nil, err
+	}
+	return processor, nil
+}
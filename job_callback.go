@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/urlfetch"
+)
+
+type (
+	// jobSummary is the json posted to a job's callback when it closes
+	jobSummary struct {
+		Job       int64     `json:"job"`
+		Processor string    `json:"processor"`
+		Status    string    `json:"status"`
+		Error     string    `json:"error,omitempty"`
+		Shards    int       `json:"shards"`
+		Processed int64     `json:"processed"`
+		Contended int64     `json:"contended,omitempty"`
+		Panics    int       `json:"panics,omitempty"`
+		Started   time.Time `json:"started"`
+		Finished  time.Time `json:"finished"`
+	}
+)
+
+var (
+	// how many times a webhook is tried and how long to wait before the
+	// first retry, the wait doubles each time
+	webhookAttempts = 5
+	webhookBackoff  = time.Duration(10) * time.Second
+
+	// how many times a task of a job is retried before the job fails
+	taskRetryLimit = 10
+
+	webhookFunc   *taskFunc
+	jobClosedFunc *taskFunc
+)
+
+func init() {
+	webhookFunc = newTaskFunc("webhook", callWebhook)
+	jobClosedFunc = newTaskFunc("closed", jobClosed)
+
+	// cancel endpoint will be something like "/_ah/cron/job/123/cancel"
+	cron.Post("/job/:id/cancel", cancelJobHandler)
+}
+
+func withHTTPClient(c context.Context, client *http.Client) context.Context {
+	return context.WithValue(c, httpClientContextKey, client)
+}
+
+func getHTTPClient(c context.Context) *http.Client {
+	if client, ok := c.Value(httpClientContextKey).(*http.Client); ok {
+		return client
+	}
+	return urlfetch.Client(c)
+}
+
+// closed is whether the job has finished one way or another
+func (j *job) closed() bool {
+	return j.Status == jobCompleted || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+// closeJob sets the final status of a job and sends its callback, its
+// watermark, pipeline and backfill are moved on by a task queued in the same
+// transaction so that only the call that closes the job does it. A job is
+// only closed once so it's safe to call again if it fails.
+func closeJob(c context.Context, key *datastore.Key, status, reason string) error {
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		j := new(job)
+		if err := ds.Get(tc, key, j); err != nil {
+			return err
+		}
+		if j.closed() {
+			return nil
+		}
+		j.Status = status
+		j.Error = reason
+		j.Updated = time.Now().UTC()
+		if _, err := ds.Put(tc, key, j); err != nil {
+			return err
+		}
+		if err := notifyJob(tc, key, j); err != nil {
+			return err
+		}
+		if j.Pipeline == nil && j.Backfill == nil && (j.Watermark == "" || status != jobCompleted) {
+			return nil
+		}
+		return jobClosedFunc.Call(tc, key)
+	})
+}
+
+// jobClosed moves on the watermark, pipeline and backfill of a job once it
+// has closed, the task is retried until it works
+func jobClosed(c context.Context, key *datastore.Key) error {
+	j := new(job)
+	if err := getDatastore(c).Get(c, key, j); err != nil {
+		return err
+	}
+	if j.Watermark != "" && j.Status == jobCompleted {
+		if err := advanceWatermark(c, key, j); err != nil {
+			log.Errorf(c, "advance watermark error %s", err.Error())
+			return err
+		}
+	}
+	if j.Pipeline != nil {
+		var err error
+		if j.Status == jobCompleted {
+			err = advancePipeline(c, j.Pipeline, j.Stage)
+		} else {
+			why := fmt.Sprintf("job %d %s", key.IntID(), j.Status)
+			if j.Error != "" {
+				why += ": " + j.Error
+			}
+			err = failStage(c, j.Pipeline, j.Stage, why)
+		}
+		if err != nil {
+			log.Errorf(c, "pipeline %d stage %s error %s", j.Pipeline.IntID(), j.Stage, err.Error())
+			return err
+		}
+	}
+	if j.Backfill != nil {
+		if err := advanceBackfill(c, j.Backfill, j.Unit, j.Status, j.Error); err != nil {
+			log.Errorf(c, "backfill %d unit %d error %s", j.Backfill.IntID(), j.Unit, err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyJob queues the callback for a closed job, it's called in the
+// transaction that closes it so the callback is only sent once
+func notifyJob(c context.Context, key *datastore.Key, j *job) error {
+	if j.Callback == "" {
+		return nil
+	}
+	summary := &jobSummary{
+		Job:       key.IntID(),
+		Processor: j.Processor,
+		Status:    j.Status,
+		Error:     j.Error,
+		Shards:    j.Shards,
+		Panics:    j.Panics,
+		Started:   j.Created,
+		Finished:  j.Updated,
+	}
+	it := getDatastore(c).Run(c, NewQuery(shardKind).Ancestor(key))
+	for {
+		s := new(shard)
+		_, err := it.Next(s)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		summary.Processed += s.Processed
+		summary.Contended += s.Contended
+	}
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	if j.Queue != "" {
+		return getTasks(c).Post(c, j.Queue, j.Callback, payload)
+	}
+	return webhookFunc.Call(c, j.Callback, payload, 0)
+}
+
+// callWebhook posts the summary of a job to its webhook, retrying with an
+// increasing delay until it's accepted or has been tried too many times
+func callWebhook(c context.Context, url string, payload []byte, attempt int) error {
+	err := postWebhook(c, url, payload)
+	if err == nil {
+		log.Debugf(c, "webhook %s called", url)
+		return nil
+	}
+
+	attempt++
+	if attempt >= webhookAttempts {
+		log.Errorf(c, "webhook %s error %s, giving up after %d attempts", url, err.Error(), attempt)
+		return nil
+	}
+	log.Warningf(c, "webhook %s error %s", url, err.Error())
+	return webhookFunc.CallAfter(c, webhookBackoff<<uint(attempt-1), url, payload, attempt)
+}
+
+func postWebhook(c context.Context, url string, payload []byte) error {
+	resp, err := getHTTPClient(c).Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// failTask fails the job once a task of it has been retried too many times,
+// otherwise the error is returned so the task is retried
+func failTask(c context.Context, key *datastore.Key, err error) error {
+	if err == nil || taskRetries(c) < taskRetryLimit {
+		return err
+	}
+	log.Errorf(c, "job %d failed after %d retries error %s", key.IntID(), taskRetries(c), err.Error())
+	return closeJob(c, key, jobFailed, err.Error())
+}
+
+// taskRetries is how many times the current task has been retried
+func taskRetries(c context.Context) int {
+	headers, err := delay.RequestHeaders(c)
+	if err != nil {
+		return 0
+	}
+	return int(headers.TaskRetryCount)
+}
+
+func cancelJobHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid job id")
+	}
+	key := datastore.NewKey(ctx, jobKind, "", id, nil)
+	if err := closeJob(ctx, key, jobCancelled, ""); err != nil {
+		log.Errorf(ctx, "cancel job error %s", err.Error())
+		if err == datastore.ErrNoSuchEntity {
+			return echo.NewHTTPError(http.StatusNotFound, "job not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	log.Infof(ctx, "cancelled job %d", id)
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// webhookServer records the summaries posted to it, failing the first
+// requests with the statuses given
+type webhookServer struct {
+	mu        sync.Mutex
+	failures  []int
+	requests  int
+	summaries []*jobSummary
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if len(s.failures) > 0 {
+		w.WriteHeader(s.failures[0])
+		s.failures = s.failures[1:]
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	summary := new(jobSummary)
+	if err := json.Unmarshal(body, summary); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.summaries = append(s.summaries, summary)
+}
+
+func TestJobCallbackWebhook(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 20)
+
+	hook := &webhookServer{failures: []int{http.StatusInternalServerError, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	c = withHTTPClient(c, server.Client())
+
+	p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-02-01"})
+	opts, err := newJobOptions(params{"shards": "2", "callback": server.URL + "/done"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := startJob(c, p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+
+	// the webhook is retried until it succeeds
+	if hook.requests != 3 {
+		t.Errorf("expected 3 webhook requests got %d", hook.requests)
+	}
+	if len(hook.summaries) != 1 {
+		t.Fatalf("expected 1 summary got %d", len(hook.summaries))
+	}
+	summary := hook.summaries[0]
+	if summary.Job != key.IntID() || summary.Processor != "logPhotos" || summary.Status != jobCompleted {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if summary.Shards != 2 || summary.Processed != 20 {
+		t.Errorf("expected 20 processed by 2 shards got %d by %d", summary.Processed, summary.Shards)
+	}
+}
+
+func TestJobCallbackWebhookGivesUp(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+
+	hook := new(webhookServer)
+	for i := 0; i < 10; i++ {
+		hook.failures = append(hook.failures, http.StatusInternalServerError)
+	}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+	c = withHTTPClient(c, server.Client())
+
+	if err := webhookFunc.Call(c, server.URL, []byte("{}"), 0); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	if hook.requests != webhookAttempts {
+		t.Errorf("expected %d webhook requests got %d", webhookAttempts, hook.requests)
+	}
+}
+
+func TestJobCallbackQueue(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-02-01"})
+	opts, err := newJobOptions(params{"callback": "/tasks/done", "callback_queue": "notify"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startJob(c, p, opts); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+
+	posted := tasks.Posted()
+	if len(posted) != 1 {
+		t.Fatalf("expected 1 posted task got %d", len(posted))
+	}
+	if posted[0].queue != "notify" || posted[0].path != "/tasks/done" {
+		t.Errorf("expected task for /tasks/done on notify got %s on %s", posted[0].path, posted[0].queue)
+	}
+	summary := new(jobSummary)
+	if err := json.Unmarshal(posted[0].payload, summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Status != jobCompleted || summary.Processed != 10 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 20)
+
+	p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-02-01"})
+	opts, _ := newJobOptions(params{"shards": "2", "callback": "/tasks/done", "callback_queue": "notify"})
+	key, err := startJob(c, p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeJob(c, key, jobCancelled, ""); err != nil {
+		t.Fatal(err)
+	}
+	// closing it again is ignored
+	if err := closeJob(c, key, jobFailed, "too late"); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+
+	j := new(job)
+	if err := getDatastore(c).Get(c, key, j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobCancelled || j.Active != 2 {
+		t.Errorf("expected cancelled job with 2 unfinished shards got %s with %d", j.Status, j.Active)
+	}
+
+	posted := tasks.Posted()
+	if len(posted) != 1 {
+		t.Fatalf("expected 1 posted task got %d", len(posted))
+	}
+	summary := new(jobSummary)
+	if err := json.Unmarshal(posted[0].payload, summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Status != jobCancelled || summary.Processed != 0 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
+
+func TestJobCallbackOptions(t *testing.T) {
+	tests := []struct {
+		params params
+		valid  bool
+	}{
+		{params{}, true},
+		{params{"callback": "https://example.com/done"}, true},
+		{params{"callback": "/done"}, false},
+		{params{"callback": "ftp://example.com/done"}, false},
+		{params{"callback": "/done", "callback_queue": "notify"}, true},
+		{params{"callback": "https://example.com/done", "callback_queue": "notify"}, false},
+		{params{"callback_queue": "notify"}, false},
+	}
+	for _, test := range tests {
+		_, err := newJobOptions(test.params)
+		if (err == nil) != test.valid {
+			t.Errorf("%v expected valid %t got error %v", test.params, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// jobPanic is a panic recovered from a processor, it's a child of the
+	// job. The key is the entity being processed or nil if it was Complete
+	// that panicked.
+	jobPanic struct {
+		Shard   int            `datastore:"shard"`
+		Slice   int            `datastore:"slice,noindex"`
+		Key     *datastore.Key `datastore:"key"`
+		Value   string         `datastore:"value,noindex"`
+		Stack   string         `datastore:"stack,noindex"`
+		Created time.Time      `datastore:"created"`
+	}
+
+	// panicStatus is a recorded panic as json
+	panicStatus struct {
+		Shard   int       `json:"shard"`
+		Slice   int       `json:"slice"`
+		Key     string    `json:"key,omitempty"`
+		Value   string    `json:"value"`
+		Stack   string    `json:"stack"`
+		Created time.Time `json:"created"`
+	}
+)
+
+const (
+	jobPanicKind = "job_panic"
+
+	// what happens to an entity that panics, it's skipped or the slice
+	// fails so it's retried from the start of the slice
+	panicSkip = "skip"
+	panicFail = "fail"
+)
+
+var (
+	// how many panics a job has before it fails unless it sets a maximum
+	defaultMaxPanics = 10
+
+	// errJobAborted stops a slice when the job has failed because of panics
+	errJobAborted = errors.New("job aborted")
+)
+
+func init() {
+	cron.Get("/job/:id/panics", jobPanicsHandler)
+}
+
+// isolatePanics recovers a panic processing an entity so that it doesn't
+// crash the task, it's recorded against the job and the entity is skipped
+// or the slice fails depending on the job's policy
+func isolatePanics(fn entityFunc, task *shardTask, policy string) entityFunc {
+	return func(c context.Context, key *datastore.Key) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = handlePanic(c, task, key, r, debug.Stack(), policy)
+			}
+		}()
+		return fn(c, key)
+	}
+}
+
+// completeSlice calls Complete for the processor, a panic is recorded and
+// always fails the slice as whatever it was writing would be lost
+func completeSlice(c context.Context, processor Processor, task *shardTask) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = handlePanic(c, task, nil, r, debug.Stack(), panicFail)
+		}
+	}()
+	processor.Complete(c)
+	return nil
+}
+
+// handlePanic records a panic and fails the job if it has had too many, it
+// returns the error for the slice if it should stop
+func handlePanic(c context.Context, task *shardTask, key *datastore.Key, value interface{}, stack []byte, policy string) error {
+	what := "complete"
+	if key != nil {
+		what = "process " + key.String()
+	}
+	log.Errorf(c, "%s panic %v\n%s", what, value, stack)
+
+	p := &jobPanic{
+		Shard:   task.Shard,
+		Slice:   task.Slice,
+		Key:     key,
+		Value:   fmt.Sprint(value),
+		Stack:   string(stack),
+		Created: time.Now().UTC(),
+	}
+	abort, err := recordPanic(c, task.Job, p)
+	if err != nil {
+		log.Errorf(c, "record panic error %s", err.Error())
+		return err
+	}
+	if abort {
+		reason := fmt.Sprintf("too many panics, the last was %s: %s", what, p.Value)
+		if err := closeJob(c, task.Job, jobFailed, reason); err != nil {
+			return err
+		}
+		return errJobAborted
+	}
+	if policy == panicFail {
+		return fmt.Errorf("%s panic %s", what, p.Value)
+	}
+	return nil
+}
+
+// recordPanic stores the panic and counts it against the job, it returns
+// whether the job has had as many panics as it's allowed
+func recordPanic(c context.Context, jobKey *datastore.Key, p *jobPanic) (bool, error) {
+	abort := false
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		j := new(job)
+		if err := ds.Get(tc, jobKey, j); err != nil {
+			return err
+		}
+		if _, err := ds.Put(tc, datastore.NewIncompleteKey(tc, jobPanicKind, jobKey), p); err != nil {
+			return err
+		}
+		j.Panics++
+		j.Updated = time.Now().UTC()
+		if _, err := ds.Put(tc, jobKey, j); err != nil {
+			return err
+		}
+		max := j.MaxPanics
+		if max == 0 {
+			max = defaultMaxPanics
+		}
+		abort = j.Panics >= max
+		return nil
+	})
+	return abort, err
+}
+
+// getJobPanics returns the panics recorded against a job in the order they
+// happened
+func getJobPanics(c context.Context, jobKey *datastore.Key) ([]*panicStatus, error) {
+	if err := getDatastore(c).Get(c, jobKey, new(job)); err != nil {
+		return nil, err
+	}
+	it := getDatastore(c).Run(c, NewQuery(jobPanicKind).Ancestor(jobKey).Order("created"))
+	panics := []*panicStatus{}
+	for {
+		p := new(jobPanic)
+		_, err := it.Next(p)
+		if err == datastore.Done {
+			return panics, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		status := &panicStatus{
+			Shard:   p.Shard,
+			Slice:   p.Slice,
+			Value:   p.Value,
+			Stack:   p.Stack,
+			Created: p.Created,
+		}
+		if p.Key != nil {
+			status.Key = p.Key.String()
+		}
+		panics = append(panics, status)
+	}
+}
+
+func jobPanicsHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid job id")
+	}
+	panics, err := getJobPanics(ctx, datastore.NewKey(ctx, jobKind, "", id, nil))
+	if err == datastore.ErrNoSuchEntity {
+		return echo.NewHTTPError(http.StatusNotFound, "job not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, panics)
+}
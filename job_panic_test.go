@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// panicPhotos counts the photos, panicking on those with an ID divisible
+// by Every and at the end of each slice if PanicComplete is set
+type panicPhotos struct {
+	Every         int64
+	PanicComplete bool
+	Count         int64
+}
+
+func init() {
+	gob.Register(new(panicPhotos))
+}
+
+func (x *panicPhotos) Start(c context.Context) (*Query, interface{}) {
+	return NewQuery("photo").Limit(5).KeysOnly(), nil
+}
+
+func (x *panicPhotos) Process(c context.Context, key *datastore.Key) {
+	if x.Every > 0 && key.IntID()%x.Every == 0 {
+		var photos map[int64]*Photo
+		photos[key.IntID()].Width++
+	}
+	x.Count++
+}
+
+func (x *panicPhotos) Complete(c context.Context) {
+	if x.PanicComplete {
+		panic("can't complete")
+	}
+}
+
+func (x *panicPhotos) Merge(other Processor) {
+	x.Count += other.(*panicPhotos).Count
+}
+
+func getJob(t *testing.T, c context.Context, key *datastore.Key) *job {
+	j := new(job)
+	if err := getDatastore(c).Get(c, key, j); err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestPanicSkip(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 20)
+
+	// photos 5, 10, 15 and 20 panic and are skipped
+	key, err := startJob(c, &panicPhotos{Every: 5}, &jobOptions{Shards: 1, Split: splitEven})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	if j := getJob(t, c, key); j.Status != jobCompleted || j.Panics != 4 {
+		t.Errorf("expected completed job with 4 panics got %s %d", j.Status, j.Panics)
+	}
+
+	panics, err := getJobPanics(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(panics) != 4 {
+		t.Fatalf("expected 4 panics recorded got %d", len(panics))
+	}
+	for i, p := range panics {
+		expected := datastore.NewKey(c, "photo", "", int64(5*(i+1)), nil).String()
+		if p.Key != expected || !strings.Contains(p.Value, "nil pointer") || !strings.Contains(p.Stack, "panicPhotos") {
+			t.Errorf("panic %d expected for %s with a stack got %s %s\n%s", i, expected, p.Key, p.Value, p.Stack)
+		}
+	}
+}
+
+func TestPanicAbort(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 20)
+
+	// the job fails at the third panic rather than carrying on
+	opts, err := newJobOptions(params{"max_panics": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := startJob(c, &panicPhotos{Every: 5}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	j := getJob(t, c, key)
+	if j.Status != jobFailed || j.Panics != 3 || !strings.Contains(j.Error, "too many panics") {
+		t.Errorf("expected failed job with 3 panics got %s %d %s", j.Status, j.Panics, j.Error)
+	}
+}
+
+func TestPanicFail(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	putPhotos(t, c, 4)
+
+	// each time the slice is retried it panics again until the job fails
+	p := &panicPhotos{Every: 3}
+	opts, _ := newJobOptions(params{"on_panic": panicFail, "max_panics": "3"})
+	key, err := startJob(c, p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt <= 3; attempt++ {
+		err := process(c, p, &shardTask{Job: key})
+		if failed := err != nil; failed != (attempt < 3) {
+			t.Errorf("attempt %d expected failed %t got %v", attempt, attempt < 3, err)
+		}
+	}
+	if j := getJob(t, c, key); j.Status != jobFailed || j.Panics != 3 {
+		t.Errorf("expected failed job with 3 panics got %s %d", j.Status, j.Panics)
+	}
+
+	// a panic in Complete always fails the slice
+	c, _, _ = newTestContext(t)
+	putPhotos(t, c, 4)
+	p = &panicPhotos{PanicComplete: true}
+	key, err = startJob(c, p, &jobOptions{Shards: 1, Split: splitEven})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process(c, p, &shardTask{Job: key}); err == nil || !strings.Contains(err.Error(), "can't complete") {
+		t.Errorf("expected complete panic error got %v", err)
+	}
+	if panics, _ := getJobPanics(c, key); len(panics) != 1 || panics[0].Key != "" {
+		t.Errorf("expected a panic without a key got %v", panics)
+	}
+
+	if _, err := newJobOptions(params{"on_panic": "ignore"}); err == nil {
+		t.Errorf("expected error for an unknown panic policy")
+	}
+}
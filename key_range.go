@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+
+	"math/big"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// KeyRange represents a range of keys of a kind within a namespace, a
+	// nil Start or End leaves that side of the range open. It can be
+	// encoded as json or gob so it can be used as the input for a shard.
+	KeyRange struct {
+		Kind         string         `json:"kind"`
+		Namespace    string         `json:"namespace"`
+		Ancestor     *datastore.Key `json:"ancestor,omitempty"`
+		Start        *datastore.Key `json:"start,omitempty"`
+		IncludeStart bool           `json:"include_start"`
+		End          *datastore.Key `json:"end,omitempty"`
+		IncludeEnd   bool           `json:"include_end"`
+	}
+
+	byKey []*datastore.Key
+)
+
+// how many scatter samples to take for each shard, more gives more evenly
+// sized shards
+const scatterOversampling = 32
+
+// key names are split as sequences of code points, surrogates aren't
+// valid in utf8 so they're skipped to keep every midpoint a valid string
+const (
+	surrogateMin  = 0xD800
+	surrogateSize = 0x800
+	runeBase      = utf8.MaxRune + 1 - surrogateSize
+)
+
+// NewKeyRange creates a range covering every key of a kind in a namespace
+func NewKeyRange(kind, namespace string) *KeyRange {
+	return &KeyRange{
+		Kind:         kind,
+		Namespace:    namespace,
+		IncludeStart: true,
+		IncludeEnd:   true,
+	}
+}
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byKey) Less(i, j int) bool { return compareKeys(s[i], s[j]) < 0 }
+
+// IsBounded returns whether both ends of the range are set
+func (r *KeyRange) IsBounded() bool {
+	return r.Start != nil && r.End != nil
+}
+
+// Filter restricts a query to the keys in the range
+func (r *KeyRange) Filter(q *Query) *Query {
+	if r.Ancestor != nil {
+		q = q.Ancestor(r.Ancestor)
+	}
+	if r.Start != nil {
+		if r.IncludeStart {
+			q = q.Filter("__key__ >=", r.Start)
+		} else {
+			q = q.Filter("__key__ >", r.Start)
+		}
+	}
+	if r.End != nil {
+		if r.IncludeEnd {
+			q = q.Filter("__key__ <=", r.End)
+		} else {
+			q = q.Filter("__key__ <", r.End)
+		}
+	}
+	return q
+}
+
+// query returns an unordered Query for the entities in the range
+func (r *KeyRange) query() *Query {
+	q := NewQuery(r.Kind)
+	if r.Namespace != "" {
+		q = q.Namespace(r.Namespace)
+	}
+	return r.Filter(q)
+}
+
+// MakeDatastoreQuery returns a Query for the entities in the range in key
+// order, starting from the cursor if there is one
+func (r *KeyRange) MakeDatastoreQuery(c context.Context, cursor string) *Query {
+	q := r.query().Order("__key__")
+	if cursor != "" {
+		q = q.Start(cursor)
+	}
+	return q
+}
+
+// WithStartAfter returns a copy of this KeyRange that starts after the key
+func (r *KeyRange) WithStartAfter(key *datastore.Key) *KeyRange {
+	x := *r
+	x.Start = key
+	x.IncludeStart = false
+	return &x
+}
+
+// Bounded returns a copy of this KeyRange with any open ends replaced by
+// the first and last keys that actually exist, nil is returned if there are
+// no entities in the range
+func (r *KeyRange) Bounded(c context.Context) (*KeyRange, error) {
+	x := *r
+	keys, err := getAllKeys(c, r.query().Order("__key__").Limit(1))
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if x.Start == nil {
+		x.Start = keys[0]
+		x.IncludeStart = true
+	}
+
+	if x.End == nil {
+		keys, err := getAllKeys(c, r.query().Order("-__key__").Limit(1))
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		x.End = keys[0]
+		x.IncludeEnd = true
+	}
+	return &x, nil
+}
+
+// Split splits a bounded KeyRange into two nearly equal-sized ranges by
+// key, it returns this KeyRange and nil if it can't be split further. Keys
+// are split on the first part of their path that differs so ranges with
+// an ancestor are split on the descendant keys.
+func (r *KeyRange) Split(c context.Context) (*KeyRange, *KeyRange, error) {
+	if !r.IsBounded() {
+		return nil, nil, fmt.Errorf("key range for %s must have a start and end to split", r.Kind)
+	}
+	if compareKeys(r.Start, r.End) > 0 {
+		return nil, nil, fmt.Errorf("key range start %s is after end %s", r.Start, r.End)
+	}
+
+	mid, err := midKey(c, r.Start, r.End)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mid == nil {
+		return r, nil, nil
+	}
+
+	left := *r
+	left.End = mid
+	left.IncludeEnd = true
+	right := *r
+	right.Start = mid
+	right.IncludeStart = false
+	return &left, &right, nil
+}
+
+// SplitRemaining splits what is left of the range after the last key that
+// was processed in two, the tail is nil if it can't be split. The range
+// kept starts after the last key and ends where the tail starts, and the
+// tail keeps the end of the range.
+func (r *KeyRange) SplitRemaining(c context.Context, last *datastore.Key) (ShardInput, ShardInput, error) {
+	rest, err := r.WithStartAfter(last).Bounded(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rest == nil {
+		return r, nil, nil
+	}
+	left, right, err := rest.Split(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if right == nil || compareKeys(left.End, last) == 0 {
+		// there's nothing between them to keep
+		return r, nil, nil
+	}
+
+	keep := *r
+	keep.Start = last
+	keep.IncludeStart = false
+	keep.End = left.End
+	keep.IncludeEnd = left.IncludeEnd
+	tail := *right
+	tail.End = r.End
+	tail.IncludeEnd = r.IncludeEnd
+	return &keep, &tail, nil
+}
+
+// midKey returns a key between start and end or nil if there isn't one
+// that can be worked out from the keys alone
+func midKey(c context.Context, start, end *datastore.Key) (*datastore.Key, error) {
+	sp, ep := keyPath(start), keyPath(end)
+	i := 0
+	for i < len(sp) && i < len(ep) && compareKeys(sp[i], ep[i]) == 0 {
+		i++
+	}
+	if i == len(sp) || i == len(ep) {
+		// the keys are the same or one is the ancestor of the other
+		return nil, nil
+	}
+	s, e := sp[i], ep[i]
+	if s.Kind() != e.Kind() {
+		return nil, nil
+	}
+
+	c, err := appengine.Namespace(c, start.Namespace())
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case s.StringID() == "" && e.StringID() == "":
+		id := s.IntID() + (e.IntID()-s.IntID())/2
+		return datastore.NewKey(c, s.Kind(), "", id, s.Parent()), nil
+	case s.StringID() == "":
+		// ids sort before names so split between the two
+		return datastore.NewKey(c, s.Kind(), "", math.MaxInt64, s.Parent()), nil
+	default:
+		name := midString(s.StringID(), e.StringID())
+		return datastore.NewKey(c, s.Kind(), name, 0, s.Parent()), nil
+	}
+}
+
+// midString returns a string that sorts between a and b
+func midString(a, b string) string {
+	ar, br := []rune(a), []rune(b)
+	length := len(ar)
+	if len(br) > length {
+		length = len(br)
+	}
+	length++
+
+	base := big.NewInt(runeBase)
+	ordinal := func(runes []rune) *big.Int {
+		n := new(big.Int)
+		for i := 0; i < length; i++ {
+			n.Mul(n, base)
+			if i < len(runes) {
+				n.Add(n, big.NewInt(runeIndex(runes[i])))
+			}
+		}
+		return n
+	}
+
+	mid := new(big.Int).Add(ordinal(ar), ordinal(br))
+	mid.Div(mid, big.NewInt(2))
+
+	runes := make([]rune, length)
+	digit := new(big.Int)
+	for i := length - 1; i >= 0; i-- {
+		mid.DivMod(mid, base, digit)
+		runes[i] = indexRune(digit.Int64())
+	}
+	for len(runes) > 0 && runes[len(runes)-1] == 0 {
+		runes = runes[:len(runes)-1]
+	}
+
+	s := string(runes)
+	if s < a || s > b {
+		// only possible for invalid utf8 which doesn't sort by code point
+		return a
+	}
+	return s
+}
+
+func runeIndex(r rune) int64 {
+	if r >= surrogateMin {
+		return int64(r) - surrogateSize
+	}
+	return int64(r)
+}
+
+func indexRune(i int64) rune {
+	if i >= surrogateMin {
+		return rune(i + surrogateSize)
+	}
+	return rune(i)
+}
+
+// splitByScatter splits the keys of a kind into at most n ranges using a
+// sample of the keys with the __scatter__ property (which the datastore
+// sets on a random subset of entities) as the boundaries. If there are too
+// few samples to make n ranges a single range is returned.
+func splitByScatter(c context.Context, kind, namespace string, n, oversampling int) ([]*KeyRange, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("n must be >= 1")
+	}
+	if n == 1 {
+		return []*KeyRange{NewKeyRange(kind, namespace)}, nil
+	}
+
+	q := NewQuery(kind).Order("__scatter__").Limit(n * oversampling)
+	if namespace != "" {
+		q = q.Namespace(namespace)
+	}
+	keys, err := getAllKeys(c, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) < n-1 {
+		log.Debugf(c, "only %d scatter samples for %s so using one shard", len(keys), kind)
+		return []*KeyRange{NewKeyRange(kind, namespace)}, nil
+	}
+	sort.Sort(byKey(keys))
+
+	// pick evenly spaced samples as the split points
+	points := []*datastore.Key{}
+	for i := 1; i < n; i++ {
+		key := keys[len(keys)*i/n]
+		if len(points) == 0 || !points[len(points)-1].Equal(key) {
+			points = append(points, key)
+		}
+	}
+
+	ranges := []*KeyRange{}
+	var start *datastore.Key
+	for _, point := range points {
+		r := NewKeyRange(kind, namespace)
+		r.Start = start
+		r.End = point
+		r.IncludeEnd = false
+		ranges = append(ranges, r)
+		start = point
+	}
+	r := NewKeyRange(kind, namespace)
+	r.Start = start
+	ranges = append(ranges, r)
+	return ranges, nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// putKeys stores a pet for each key
+func putKeys(t *testing.T, c context.Context, keys []*datastore.Key) {
+	pets := make([]*pet, len(keys))
+	for i := range pets {
+		pets[i] = &pet{Value: int64(i)}
+	}
+	if _, err := getDatastore(c).PutMulti(c, keys, pets); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rangeKeys returns the keys in a range, a batch at a time resuming from
+// the cursor
+func rangeKeys(t *testing.T, c context.Context, r *KeyRange) []*datastore.Key {
+	keys := []*datastore.Key{}
+	cursor := ""
+	for {
+		it := getDatastore(c).Run(c, r.MakeDatastoreQuery(c, cursor).KeysOnly().Limit(3))
+		count := 0
+		for {
+			key, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			count++
+		}
+		if count == 0 {
+			return keys
+		}
+		cursor, _ = it.Cursor()
+	}
+}
+
+// splitAll keeps splitting every range in turn until there are n or they
+// can't be split any more
+func splitAll(t *testing.T, c context.Context, r *KeyRange, n int) []*KeyRange {
+	ranges := []*KeyRange{r}
+	for split := true; split && len(ranges) < n; {
+		split = false
+		next := []*KeyRange{}
+		for i, r := range ranges {
+			if len(next)+len(ranges)-i >= n {
+				next = append(next, ranges[i:]...)
+				break
+			}
+			left, right, err := r.Split(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if right == nil {
+				next = append(next, r)
+				continue
+			}
+			next = append(next, left, right)
+			split = true
+		}
+		ranges = next
+	}
+	return ranges
+}
+
+func TestKeyRangeQuery(t *testing.T) {
+	t.Parallel()
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	keys := []*datastore.Key{}
+	for i := int64(1); i <= 10; i++ {
+		keys = append(keys, datastore.NewKey(c, "pet", "", i, nil))
+	}
+	putKeys(t, c, keys)
+
+	tests := []struct {
+		start, end               int64
+		includeStart, includeEnd bool
+		expected                 []*datastore.Key
+	}{
+		{0, 0, true, true, keys},
+		{3, 7, true, true, keys[2:7]},
+		{3, 7, false, true, keys[3:7]},
+		{3, 7, true, false, keys[2:6]},
+		{3, 7, false, false, keys[3:6]},
+		{3, 3, true, true, keys[2:3]},
+		{3, 3, false, true, []*datastore.Key{}},
+		{0, 4, true, false, keys[:3]},
+		{8, 0, false, true, keys[8:]},
+	}
+	for _, test := range tests {
+		r := NewKeyRange("pet", "")
+		if test.start != 0 {
+			r.Start = datastore.NewKey(c, "pet", "", test.start, nil)
+		}
+		if test.end != 0 {
+			r.End = datastore.NewKey(c, "pet", "", test.end, nil)
+		}
+		r.IncludeStart, r.IncludeEnd = test.includeStart, test.includeEnd
+
+		if got := rangeKeys(t, c, r); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%d-%d %t %t expected %v got %v", test.start, test.end, test.includeStart, test.includeEnd, test.expected, got)
+		}
+	}
+
+	// resuming after a key excludes it
+	r := NewKeyRange("pet", "").WithStartAfter(keys[4])
+	if got := rangeKeys(t, c, r); !reflect.DeepEqual(got, keys[5:]) {
+		t.Errorf("start after expected %v got %v", keys[5:], got)
+	}
+}
+
+func TestKeyRangeNamespaceAndAncestor(t *testing.T) {
+	t.Parallel()
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	ns, _ := appengine.Namespace(c, "other")
+	putKeys(t, c, []*datastore.Key{datastore.NewKey(c, "pet", "", 1, nil)})
+	putKeys(t, ns, []*datastore.Key{datastore.NewKey(ns, "pet", "", 2, nil)})
+
+	got := rangeKeys(t, c, NewKeyRange("pet", "other"))
+	if len(got) != 1 || got[0].IntID() != 2 || got[0].Namespace() != "other" {
+		t.Errorf("expected the pet in the other namespace got %v", got)
+	}
+
+	parent := datastore.NewKey(c, "owner", "", 1, nil)
+	children := []*datastore.Key{}
+	for i := int64(1); i <= 20; i++ {
+		children = append(children, datastore.NewKey(c, "pet", "", i, parent))
+	}
+	putKeys(t, c, children)
+
+	r := NewKeyRange("pet", "")
+	r.Ancestor = parent
+	r, err := r.Bounded(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := splitAll(t, c, r, 4)
+	if len(ranges) != 4 {
+		t.Fatalf("expected 4 ranges got %d", len(ranges))
+	}
+	all := []*datastore.Key{}
+	for _, r := range ranges {
+		keys := rangeKeys(t, c, r)
+		if len(keys) != 5 {
+			t.Errorf("expected 5 keys in %s-%s got %d", r.Start, r.End, len(keys))
+		}
+		all = append(all, keys...)
+	}
+	if !reflect.DeepEqual(all, children) {
+		t.Errorf("expected the children got %v", all)
+	}
+}
+
+func TestKeyRangeSplit(t *testing.T) {
+	t.Parallel()
+	c, _, _ := newTestContext(t)
+
+	id := func(i int64) *datastore.Key { return datastore.NewKey(c, "pet", "", i, nil) }
+	name := func(s string) *datastore.Key { return datastore.NewKey(c, "pet", s, 0, nil) }
+	parent := id(5)
+	child := func(i int64) *datastore.Key { return datastore.NewKey(c, "pet", "", i, parent) }
+
+	tests := []struct {
+		start, end, mid *datastore.Key
+	}{
+		{id(1), id(9), id(5)},
+		{id(1), id(2), id(1)},
+		{id(1), id(math.MaxInt64), id(1 + (math.MaxInt64-1)/2)},
+		{id(7), name("a"), id(math.MaxInt64)},
+		{name("a"), name("c"), name("b")},
+		// half way through the code points after "a"
+		{name("a"), name("b"), name("a\U00088400")},
+		{child(1), child(9), child(5)},
+		{id(1), child(9), id(3)},
+		{child(1), id(9), id(7)},
+		{id(1), id(1), nil},
+		{parent, child(3), nil},
+		{child(1), datastore.NewKey(c, "toy", "", 1, parent), nil},
+	}
+	for _, test := range tests {
+		r := &KeyRange{Kind: "pet", Start: test.start, End: test.end, IncludeStart: true, IncludeEnd: true}
+		left, right, err := r.Split(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.mid == nil {
+			if right != nil || left != r {
+				t.Errorf("%s-%s expected no split got %s", test.start, test.end, left.End)
+			}
+			continue
+		}
+		if !left.End.Equal(test.mid) {
+			t.Errorf("%s-%s expected split at %s got %s", test.start, test.end, test.mid, left.End)
+		}
+		if !left.Start.Equal(test.start) || !left.IncludeStart || !left.IncludeEnd {
+			t.Errorf("%s-%s left is %s-%s", test.start, test.end, left.Start, left.End)
+		}
+		if !right.Start.Equal(left.End) || right.IncludeStart || !right.End.Equal(test.end) || !right.IncludeEnd {
+			t.Errorf("%s-%s right is %s-%s", test.start, test.end, right.Start, right.End)
+		}
+	}
+
+	if _, _, err := NewKeyRange("pet", "").Split(c); err == nil {
+		t.Errorf("expected error splitting an open range")
+	}
+	r := &KeyRange{Kind: "pet", Start: id(2), End: id(1)}
+	if _, _, err := r.Split(c); err == nil {
+		t.Errorf("expected error splitting an inverted range")
+	}
+}
+
+func TestKeyRangeSplitCovers(t *testing.T) {
+	t.Parallel()
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	keys := []*datastore.Key{}
+	for i := int64(1); i <= 30; i++ {
+		keys = append(keys, datastore.NewKey(c, "pet", "", i*i*i, nil))
+	}
+	for i := 0; i < 30; i++ {
+		keys = append(keys, datastore.NewKey(c, "pet", fmt.Sprintf("name-%02d", i), 0, nil))
+	}
+	putKeys(t, c, keys)
+
+	r, err := NewKeyRange("pet", "").Bounded(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Start.Equal(keys[0]) || !r.End.Equal(keys[len(keys)-1]) {
+		t.Errorf("expected bounds %s-%s got %s-%s", keys[0], keys[len(keys)-1], r.Start, r.End)
+	}
+
+	for _, n := range []int{1, 2, 3, 8, 20} {
+		ranges := splitAll(t, c, r, n)
+		if len(ranges) != n {
+			t.Errorf("expected %d ranges got %d", n, len(ranges))
+		}
+		all := []*datastore.Key{}
+		for _, r := range ranges {
+			all = append(all, rangeKeys(t, c, r)...)
+		}
+		if !reflect.DeepEqual(all, keys) {
+			t.Errorf("%d ranges expected every key once got %v", n, all)
+		}
+	}
+
+	// nothing to bound in an empty kind
+	if r, err := NewKeyRange("missing", "").Bounded(c); err != nil || r != nil {
+		t.Errorf("expected no range got %v %v", r, err)
+	}
+}
+
+func TestKeyRangeEncoding(t *testing.T) {
+	t.Parallel()
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	keys := []*datastore.Key{}
+	for i := int64(1); i <= 10; i++ {
+		keys = append(keys, datastore.NewKey(c, "pet", "", i, nil))
+	}
+	putKeys(t, c, keys)
+
+	r := NewKeyRange("pet", "")
+	r.Start = keys[1]
+	r.End = keys[8]
+	r.IncludeEnd = false
+
+	// take the cursor part way through
+	it := getDatastore(c).Run(c, r.MakeDatastoreQuery(c, "").KeysOnly().Limit(3))
+	for {
+		if _, err := it.Next(nil); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursor, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := new(KeyRange)
+	if err := json.Unmarshal(data, fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(r); err != nil {
+		t.Fatal(err)
+	}
+	fromGob := new(KeyRange)
+	if err := gob.NewDecoder(buf).Decode(fromGob); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, decoded := range map[string]*KeyRange{"json": fromJSON, "gob": fromGob} {
+		if !decoded.Start.Equal(r.Start) || !decoded.End.Equal(r.End) || decoded.IncludeStart != r.IncludeStart || decoded.IncludeEnd != r.IncludeEnd || decoded.Kind != r.Kind {
+			t.Errorf("%s expected %v got %v", name, r, decoded)
+		}
+		it := getDatastore(c).Run(c, decoded.MakeDatastoreQuery(c, cursor).KeysOnly())
+		got := []*datastore.Key{}
+		for {
+			key, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, key)
+		}
+		if !reflect.DeepEqual(got, keys[4:8]) {
+			t.Errorf("%s resumed expected %v got %v", name, keys[4:8], got)
+		}
+	}
+}
+
+func TestKeyRangeSplitRemaining(t *testing.T) {
+	t.Parallel()
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	keys := []*datastore.Key{}
+	for i := int64(1); i <= 10; i++ {
+		keys = append(keys, datastore.NewKey(c, "pet", "", i, nil))
+	}
+	putKeys(t, c, keys)
+	r := NewKeyRange("pet", "")
+
+	// part way through, the range kept starts after the last key
+	it := getDatastore(c).Run(c, r.MakeDatastoreQuery(c, "").KeysOnly().Limit(3))
+	var last *datastore.Key
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		last = key
+	}
+
+	keep, tail, err := r.SplitRemaining(c, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tail == nil {
+		t.Fatalf("expected the rest of %v to be split", r)
+	}
+	if tail.(*KeyRange).End != nil {
+		t.Errorf("expected the tail to keep the open end got %v", tail)
+	}
+	got, err := getAllKeys(c, keep.(*KeyRange).MakeDatastoreQuery(c, "").KeysOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest := rangeKeys(t, c, tail.(*KeyRange))
+	if len(got) == 0 || len(rest) == 0 || !reflect.DeepEqual(append(got, rest...), keys[3:]) {
+		t.Errorf("expected the rest split in two got %v and %v", got, rest)
+	}
+
+	// nothing left to split
+	for _, key := range []*datastore.Key{keys[8], keys[9]} {
+		if keep, tail, err := r.SplitRemaining(c, key); err != nil || tail != nil || keep != r {
+			t.Errorf("expected no split after %v got %v %v %v", key, keep, tail, err)
+		}
+	}
+}
+
+func TestMidString(t *testing.T) {
+	t.Parallel()
+	between := func(a, b string) bool {
+		if !utf8.ValidString(a) || !utf8.ValidString(b) {
+			return true
+		}
+		if a > b {
+			a, b = b, a
+		}
+		mid := midString(a, b)
+		return a <= mid && mid <= b && utf8.ValidString(mid)
+	}
+	if err := quick.Check(between, nil); err != nil {
+		t.Error(err)
+	}
+
+	for _, test := range [][2]string{{"", "a"}, {"a", "a"}, {"퟿", ""}, {"a", "a\x00"}, {"", ""}} {
+		if !between(test[0], test[1]) {
+			t.Errorf("%q-%q got %q", test[0], test[1], midString(test[0], test[1]))
+		}
+	}
+}
+
+func TestSplitByScatter(t *testing.T) {
+	t.Parallel()
+	c, _, _ := newTestContext(t)
+
+	keys := []*datastore.Key{}
+	for i := int64(1); i <= 100; i++ {
+		keys = append(keys, datastore.NewKey(c, "pet", "", i, nil))
+	}
+	putKeys(t, c, keys)
+	ns, _ := appengine.Namespace(c, "other")
+	putKeys(t, ns, []*datastore.Key{datastore.NewKey(ns, "pet", "", 1, nil), datastore.NewKey(ns, "pet", "", 2, nil)})
+
+	for _, n := range []int{1, 2, 4, 7} {
+		ranges, err := splitByScatter(c, "pet", "", n, scatterOversampling)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranges) != n {
+			t.Fatalf("expected %d ranges got %d", n, len(ranges))
+		}
+		if ranges[0].Start != nil || ranges[n-1].End != nil {
+			t.Errorf("expected the first and last ranges to be open")
+		}
+		all := []*datastore.Key{}
+		for _, r := range ranges {
+			got := rangeKeys(t, c, r)
+			// with fewer samples than keys the ranges are only roughly even
+			if len(got) < 100/n-5 || len(got) > 100/n+5 {
+				t.Errorf("%d ranges expected about %d keys got %d", n, 100/n, len(got))
+			}
+			all = append(all, got...)
+		}
+		if !reflect.DeepEqual(all, keys) {
+			t.Errorf("%d ranges expected every key once got %v", n, all)
+		}
+	}
+
+	// fewer samples makes less balanced ranges
+	ranges, err := splitByScatter(c, "pet", "", 4, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 4 {
+		t.Errorf("expected 4 ranges got %d", len(ranges))
+	}
+
+	// too few samples for the shards
+	for _, kind := range []string{"pet", "missing"} {
+		namespace := "other"
+		if kind == "missing" {
+			namespace = ""
+		}
+		ranges, err := splitByScatter(c, kind, namespace, 8, scatterOversampling)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranges) != 1 || ranges[0].Start != nil || ranges[0].End != nil {
+			t.Errorf("%s expected one open range got %v", kind, ranges)
+		}
+	}
+	if got := rangeKeys(t, c, NewKeyRange("pet", "other")); len(got) != 2 {
+		t.Errorf("expected 2 keys in the other namespace got %d", len(got))
+	}
+
+	if _, err := splitByScatter(c, "pet", "", 0, scatterOversampling); err == nil {
+		t.Errorf("expected error splitting into 0 ranges")
+	}
+}
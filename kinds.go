@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// keySetter is implemented by models that keep their key ID in a field
+	// which isn't saved as a property (such as Photo.ID)
+	keySetter interface {
+		SetKey(key *datastore.Key)
+	}
+
+	// keyIDer is implemented by models that keep their key ID in a field,
+	// it returns zero if the ID isn't set
+	keyIDer interface {
+		KeyID() int64
+	}
+)
+
+// struct types used to load entities of each kind for the generic processors
+// (export / import). Any kind not registered is handled as a PropertyList
+var kinds = make(map[string]reflect.Type)
+
+func registerKind(kind string, entity interface{}) {
+	t := reflect.TypeOf(entity)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	kinds[kind] = t
+}
+
+// newEntity returns a pointer to a new struct for the kind, or a pointer to
+// a PropertyList if the kind hasn't been registered
+func newEntity(kind string) interface{} {
+	t, found := kinds[kind]
+	if !found {
+		return new(datastore.PropertyList)
+	}
+	return reflect.New(t).Interface()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	aelog "google.golang.org/appengine/log"
+)
+
+type (
+	// logger has the same methods as the appengine log package which panics
+	// if it isn't used with an App Engine context. This lets the processors
+	// be run with a plain context (e.g. in tests) by putting a logFunc in it.
+	logger struct{}
+
+	logFunc func(level, message string)
+)
+
+// log is used in place of the appengine log package
+var log logger
+
+func withLog(c context.Context, fn logFunc) context.Context {
+	return context.WithValue(c, logContextKey, fn)
+}
+
+func (logger) Debugf(c context.Context, format string, args ...interface{}) {
+	if fn, ok := c.Value(logContextKey).(logFunc); ok {
+		fn("DEBUG", fmt.Sprintf(format, args...))
+		return
+	}
+	aelog.Debugf(c, format, args...)
+}
+
+func (logger) Infof(c context.Context, format string, args ...interface{}) {
+	if fn, ok := c.Value(logContextKey).(logFunc); ok {
+		fn("INFO", fmt.Sprintf(format, args...))
+		return
+	}
+	aelog.Infof(c, format, args...)
+}
+
+func (logger) Warningf(c context.Context, format string, args ...interface{}) {
+	if fn, ok := c.Value(logContextKey).(logFunc); ok {
+		fn("WARNING", fmt.Sprintf(format, args...))
+		return
+	}
+	aelog.Warningf(c, format, args...)
+}
+
+func (logger) Errorf(c context.Context, format string, args ...interface{}) {
+	if fn, ok := c.Value(logContextKey).(logFunc); ok {
+		fn("ERROR", fmt.Sprintf(format, args...))
+		return
+	}
+	aelog.Errorf(c, format, args...)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// Mapper is a processor that calls Emit with values for keys as it
+	// processes each entity. Once every shard has finished, the values are
+	// grouped by key and the Reducer is called once for each key.
+	Mapper interface {
+		Processor
+
+		// Reducer returns the reducer for the values, it must be registered
+		// with registerReducer
+		Reducer() Reducer
+	}
+
+	// Reducer is called once for each key that was emitted with all of the
+	// values emitted for it. Exported state is kept from one task to the
+	// next. Returning an error causes the key to be retried.
+	Reducer interface {
+		Reduce(c context.Context, key string, values []interface{}) error
+	}
+
+	// emitter collects the values emitted for each key during a slice
+	emitter struct {
+		values map[string][][]byte
+	}
+
+	// mappedValue is the values emitted for a key during a slice, they're
+	// stored under a key for the slice in the job until they have been
+	// reduced. A key with a lot of values can have more than one.
+	mappedValue struct {
+		Key    string   `datastore:"key"`
+		Values [][]byte `datastore:"values,noindex"`
+	}
+
+	// reduceTask is passed from each task of the reduce to the next, the
+	// keys up to and including After have been reduced. The mapper, with
+	// the other shards merged into it, and the stats of the map are kept
+	// for EndJob once every key is reduced.
+	reduceTask struct {
+		Job     *datastore.Key
+		Reducer Reducer
+		Mapper  Processor
+		Stats   *JobStats
+		Started bool
+		After   string
+		Keys    int
+	}
+)
+
+const (
+	mappedValueKind = "_mr_value"
+	mappedSliceKind = "_mr_slice"
+
+	// the most entities to put or delete at once
+	mappedBatchSize = 500
+
+	// the values for a key are split over more entities past this size, to
+	// stay well under the 1MB limit
+	mappedValueSize = 512 * 1024
+)
+
+var reduceFunc *taskFunc
+
+func init() {
+	reduceFunc = newTaskFunc("reduce", reduce)
+}
+
+// registerReducer registers a reducer type with the gob serializer so it
+// can be passed between tasks
+func registerReducer(reducer Reducer) {
+	gob.Register(reducer)
+}
+
+// Emit emits a value for a key from the Process method of a Mapper, the
+// value is gob encoded so any type other than the basic ones needs to be
+// registered with gob
+func Emit(c context.Context, key string, value interface{}) error {
+	em, ok := c.Value(emitterContextKey).(*emitter)
+	if !ok {
+		return fmt.Errorf("emit can only be called while a mapper is processing")
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(&value); err != nil {
+		return err
+	}
+	if em.values == nil {
+		em.values = map[string][][]byte{}
+	}
+	em.values[key] = append(em.values[key], buf.Bytes())
+	return nil
+}
+
+func withEmitter(c context.Context, em *emitter) context.Context {
+	return context.WithValue(c, emitterContextKey, em)
+}
+
+// flush stores the values emitted during a slice, combined by key. They
+// are stored under a key for the shard and slice, what a retried slice
+// stored before is deleted first so none of it is reduced twice.
+func (em *emitter) flush(c context.Context, task *shardTask) error {
+	ds := getDatastore(c)
+	parent := datastore.NewKey(c, mappedSliceKind, fmt.Sprintf("%d-%d", task.Shard, task.Slice), 0, task.Job)
+	old, err := getAllKeys(c, NewQuery(mappedValueKind).Ancestor(parent).KeysOnly())
+	if err != nil {
+		return err
+	}
+	if err := deleteMapped(c, old); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(em.values))
+	for key := range em.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := []*mappedValue{}
+	for _, key := range keys {
+		v := &mappedValue{Key: key}
+		size := 0
+		for _, value := range em.values[key] {
+			if size > 0 && size+len(value) > mappedValueSize {
+				values = append(values, v)
+				v = &mappedValue{Key: key}
+				size = 0
+			}
+			v.Values = append(v.Values, value)
+			size += len(value)
+		}
+		values = append(values, v)
+	}
+
+	for start := 0; start < len(values); start += mappedBatchSize {
+		end := start + mappedBatchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		keys := make([]*datastore.Key, 0, end-start)
+		for i := start; i < end; i++ {
+			keys = append(keys, datastore.NewKey(c, mappedValueKind, "", int64(i+1), parent))
+		}
+		if _, err := ds.PutMulti(c, keys, values[start:end]); err != nil {
+			return err
+		}
+	}
+	em.values = nil
+	return nil
+}
+
+// deleteMapped deletes stored values in batches
+func deleteMapped(c context.Context, keys []*datastore.Key) error {
+	ds := getDatastore(c)
+	for start := 0; start < len(keys); start += mappedBatchSize {
+		end := start + mappedBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := ds.DeleteMulti(c, keys[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startReduce marks the job as reducing and queues the first reduce task,
+// it's done in a transaction so it only happens once
+func startReduce(c context.Context, mapper Mapper, jobKey *datastore.Key, stats *JobStats) error {
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		j := new(job)
+		if err := ds.Get(tc, jobKey, j); err != nil {
+			return err
+		}
+		if j.Status != jobRunning {
+			return nil
+		}
+		j.Status = jobReducing
+		j.Updated = time.Now().UTC()
+		if _, err := ds.Put(tc, jobKey, j); err != nil {
+			return err
+		}
+		return reduceFunc.Call(tc, &reduceTask{Job: jobKey, Reducer: mapper.Reducer(), Mapper: mapper, Stats: stats})
+	})
+}
+
+// reduce reads the emitted values in key order and calls the reducer for
+// each key, continuing in a new task after the first key it finishes once
+// the slice has timed out. Values are deleted once they've been reduced.
+func reduce(c context.Context, task *reduceTask) (err error) {
+	// a task that keeps failing fails the job instead of retrying forever
+	defer func() { err = failTask(c, task.Job, err) }()
+
+	// the job may have been cancelled since the task was queued
+	j := new(job)
+	if err := getDatastore(c).Get(c, task.Job, j); err != nil {
+		return err
+	}
+	if j.Status != jobReducing {
+		log.Infof(c, "job %d is %s, not reducing", task.Job.IntID(), j.Status)
+		return nil
+	}
+
+	deadline := time.Now().Add(sliceTimeout)
+
+	q := NewQuery(mappedValueKind).Ancestor(task.Job).Order("key")
+	if task.Started {
+		q = q.Filter("key >", task.After)
+	}
+	it := getDatastore(c).Run(c, q)
+
+	var key string
+	values := []interface{}{}
+	keys := []*datastore.Key{}
+	for {
+		v := new(mappedValue)
+		k, err := it.Next(v)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Errorf(c, "get value error %s", err.Error())
+			return err
+		}
+
+		if len(keys) > 0 && v.Key != key {
+			if err := reduceKey(c, task, key, values, keys); err != nil {
+				return err
+			}
+			if !time.Now().Before(deadline) {
+				return reduceFunc.Call(c, task)
+			}
+			values = values[:0]
+			keys = keys[:0]
+		}
+
+		for _, data := range v.Values {
+			var value interface{}
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&value); err != nil {
+				log.Errorf(c, "decode value error %s", err.Error())
+				return err
+			}
+			values = append(values, value)
+		}
+		key = v.Key
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		if err := reduceKey(c, task, key, values, keys); err != nil {
+			return err
+		}
+	}
+
+	return finishReduce(c, task)
+}
+
+// reduceKey calls the reducer for one key and deletes its values
+func reduceKey(c context.Context, task *reduceTask, key string, values []interface{}, keys []*datastore.Key) error {
+	if err := task.Reducer.Reduce(c, key, values); err != nil {
+		log.Errorf(c, "reduce %s error %s", key, err.Error())
+		return err
+	}
+	if err := deleteMapped(c, keys); err != nil {
+		return err
+	}
+	task.Started = true
+	task.After = key
+	task.Keys++
+	return nil
+}
+
+// finishReduce ends the job and marks it as completed once every key is
+// reduced
+func finishReduce(c context.Context, task *reduceTask) error {
+	if task.Mapper != nil {
+		j := new(job)
+		if err := getDatastore(c).Get(c, task.Job, j); err != nil {
+			return err
+		}
+		task.Stats.Finished = time.Now().UTC()
+		if err := endJob(c, task.Mapper, task.Job, j, task.Stats); err != nil {
+			return err
+		}
+	}
+	if err := closeJob(c, task.Job, jobCompleted, ""); err != nil {
+		return err
+	}
+
+	log.Infof(c, "completed job %d, reduced %d keys", task.Job.IntID(), task.Keys)
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPhotosPerMonth(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 100)
+
+	// photos are one a day by photographers 1 to 4 in turn from 2015-01-01
+	expected := map[string]int64{}
+	for i := 0; i < 100; i++ {
+		taken := time.Date(2015, 1, 1+i, 12, 0, 0, 0, time.UTC)
+		expected[fmt.Sprintf("%d/%s", i%4+1, taken.Format("2006-01"))]++
+	}
+
+	p, _ := newPhotosPerMonth(params{})
+	key := runShards(t, c, tasks, p, 3)
+
+	j := new(job)
+	ds := getDatastore(c)
+	if err := ds.Get(c, key, j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobCompleted {
+		t.Errorf("expected completed job got %s", j.Status)
+	}
+
+	it := ds.Run(c, NewQuery(photographerMonthKind))
+	got := map[string]int64{}
+	for {
+		m := new(photographerMonth)
+		k, err := it.Next(m)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.StringID() != fmt.Sprintf("%d/%s", m.Photographer, m.Month.Format("2006-01")) {
+			t.Errorf("expected %s to match %#v", k.StringID(), m)
+		}
+		got[k.StringID()] = m.Count
+	}
+	if len(got) != len(expected) {
+		t.Errorf("expected %d counts got %d", len(expected), len(got))
+	}
+	for k, n := range expected {
+		if got[k] != n {
+			t.Errorf("%s expected %d got %d", k, n, got[k])
+		}
+	}
+
+	// the emitted values are cleaned up once they're reduced
+	if n := countKind(t, c, mappedValueKind); n != 0 {
+		t.Errorf("expected no values left got %d", n)
+	}
+}
+
+// endedMapper records what had been reduced when EndJob was called
+type endedMapper struct {
+	photosPerMonth
+	Shards int
+}
+
+var endedMapperCalls []string
+
+func init() {
+	gob.Register(new(endedMapper))
+}
+
+func (x *endedMapper) Merge(other Processor) {
+	x.Shards++
+}
+
+func (x *endedMapper) EndJob(c context.Context, stats *JobStats) error {
+	endedMapperCalls = append(endedMapperCalls, fmt.Sprintf("merged=%d processed=%d months=%d values=%d",
+		x.Shards, stats.Processed, countKind(nil, c, photographerMonthKind), countKind(nil, c, mappedValueKind)))
+	return nil
+}
+
+func TestMapperEndJob(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 20)
+
+	// EndJob is called once, after the values have been reduced
+	endedMapperCalls = nil
+	key := runShards(t, c, tasks, new(endedMapper), 3)
+	if expected := []string{"merged=2 processed=20 months=4 values=0"}; fmt.Sprint(endedMapperCalls) != fmt.Sprint(expected) {
+		t.Errorf("expected EndJob calls %v got %v", expected, endedMapperCalls)
+	}
+	j := new(job)
+	if err := getDatastore(c).Get(c, key, j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobCompleted || !j.Ended {
+		t.Errorf("expected an ended, completed job got %s ended %t", j.Status, j.Ended)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	if err := Emit(c, "a", int64(1)); err == nil {
+		t.Errorf("expected error emitting outside of a mapper")
+	}
+
+	em := new(emitter)
+	ec := withEmitter(c, em)
+	if err := Emit(ec, "a", int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Emit(ec, "a", struct{ unregistered int }{}); err == nil {
+		t.Errorf("expected error emitting a value gob can't encode")
+	}
+
+	// the values are combined by key, and a retried slice replaces what it
+	// stored before even when it emits less than it did
+	jobKey := datastore.NewKey(c, jobKind, "", 1, nil)
+	emit := func(task *shardTask, n, keys int) {
+		em.values = nil
+		for j := 0; j < n; j++ {
+			Emit(ec, fmt.Sprintf("%d", j%keys), int64(j))
+		}
+		if err := em.flush(c, task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	emit(&shardTask{Job: jobKey, Shard: 1, Slice: 3}, 10, 2)
+	task := &shardTask{Job: jobKey, Shard: 2, Slice: 3}
+	emit(task, 600, 7)
+	if n := countKind(t, c, mappedValueKind); n != 9 {
+		t.Errorf("expected 9 combined values got %d", n)
+	}
+	emit(task, 100, 3)
+	it := getDatastore(c).Run(c, NewQuery(mappedValueKind).Ancestor(jobKey))
+	counts := map[string]int{}
+	for {
+		v := new(mappedValue)
+		if _, err := it.Next(v); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		counts[v.Key] += len(v.Values)
+	}
+	if fmt.Sprint(counts) != "map[0:39 1:38 2:33]" {
+		t.Errorf("expected the retried slice's values and the other slice's got %v", counts)
+	}
+
+	// a key with too many values for one entity is split over more
+	em.values = nil
+	for j := 0; j < 3; j++ {
+		Emit(ec, "big", make([]byte, mappedValueSize/2))
+	}
+	if err := em.flush(c, &shardTask{Job: jobKey, Shard: 3}); err != nil {
+		t.Fatal(err)
+	}
+	big, err := getAllKeys(c, NewQuery(mappedValueKind).Ancestor(jobKey).Filter("key =", "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(big) != 3 {
+		t.Errorf("expected the big values in 3 entities got %d", len(big))
+	}
+	if len(em.values) != 0 {
+		t.Errorf("expected values to be cleared once stored")
+	}
+}
+
+// keysReducer records the keys and values it's given
+type keysReducer struct {
+	Keys []string
+}
+
+var reduced []*keysReducer
+
+func init() {
+	registerReducer(new(keysReducer))
+}
+
+func (r *keysReducer) Reduce(c context.Context, key string, values []interface{}) error {
+	r.Keys = append(r.Keys, fmt.Sprintf("%s=%d", key, len(values)))
+	if key == "c" {
+		reduced = append(reduced, r)
+	}
+	return nil
+}
+
+func TestReduce(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	ds := getDatastore(c)
+	jobKey, err := ds.Put(c, datastore.NewIncompleteKey(c, jobKind, nil), &job{Status: jobReducing})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	em := new(emitter)
+	ec := withEmitter(c, em)
+	for _, k := range []string{"b", "a", "c", "b", "a", "b"} {
+		Emit(ec, k, k)
+	}
+	if err := em.flush(c, &shardTask{Job: jobKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	// every key is reduced once, in order, continuing in a new task each
+	// time as the slice timeout is 0
+	reduced = nil
+	reduceFunc.Call(c, &reduceTask{Job: jobKey, Reducer: new(keysReducer)})
+	runTasks(t, c, tasks)
+	if len(reduced) != 1 || fmt.Sprint(reduced[0].Keys) != "[a=2 b=3 c=1]" {
+		t.Errorf("expected each key reduced once got %#v", reduced)
+	}
+	j := new(job)
+	if err := ds.Get(c, jobKey, j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobCompleted {
+		t.Errorf("expected completed job got %s", j.Status)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"time"
+
+	"google.golang.org/appengine/datastore"
 )
 
 type (
@@ -15,9 +17,23 @@ type (
 	Photo struct {
 		ID    			 int64        `json:"id"           datastore:"-"`
 		Photographer Photographer `json:"photographer" datastore:"photographer"`
-		Uploaded     time.Time    `json:"uploaded"     datastore:"uploaded,noindex"`
+		Uploaded     time.Time    `json:"uploaded"     datastore:"uploaded"`
 		Width        int          `json:"width"        datastore:"width,noindex"`
 		Height       int          `json:"height"       datastore:"height,noindex"`
 		Taken        time.Time    `json:"taken"        datastore:"taken"`
 	}
 )
+
+func init() {
+	registerKind("photo", Photo{})
+}
+
+// SetKey sets the ID from the key as it isn't saved as a property
+func (p *Photo) SetKey(key *datastore.Key) {
+	p.ID = key.IntID()
+}
+
+// KeyID returns the ID to use for the photo's key
+func (p *Photo) KeyID() int64 {
+	return p.ID
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// MultiQuerier is a processor whose input is the union of several
+	// queries, such as one for each value of an IN filter which the
+	// datastore doesn't have. Each sub-query is the query from Start with
+	// the filters of the sub-query added. Entities that match more than one
+	// sub-query are only processed once.
+	MultiQuerier interface {
+		SubQueries() [][]filter
+	}
+
+	// SubQuery is the input of a shard that runs one of the sub-queries of
+	// a MultiQuerier. The filters of the sub-queries before it are kept so
+	// that entities they match are left to their shards.
+	SubQuery struct {
+		Filters []filter
+		Earlier [][]filter
+	}
+
+	// MergedQueries is the input of a single shard that runs every
+	// sub-query of a MultiQuerier at once, merging the results in key order
+	MergedQueries struct {
+		Queries [][]filter
+	}
+
+	// mergePosition is how far one of the merged queries has got, they're
+	// kept as json in the shard's cursor. The query has read one result
+	// ahead of the others when the slice ends, so the cursor is after that
+	// result and its key is kept to start from.
+	mergePosition struct {
+		Cursor string         `json:"cursor,omitempty"`
+		Next   *datastore.Key `json:"next,omitempty"`
+		Done   bool           `json:"done,omitempty"`
+	}
+
+	// mergeHead is the next result of one of the merged queries
+	mergeHead struct {
+		it     Iterator
+		key    *datastore.Key
+		entity *datastore.PropertyList
+	}
+)
+
+const (
+	// a multi-query runs a shard for each sub-query or merges them in one
+	multiShards = "shards"
+	multiMerge  = "merge"
+)
+
+func init() {
+	// so either input can be sent in tasks, along with the filter values
+	gob.Register(&SubQuery{})
+	gob.Register(&MergedQueries{})
+	gob.Register(&datastore.Key{})
+}
+
+// splitQueries returns the inputs for the sub-queries of a job, the errors
+// are bad requests as the job can never run the way it was asked for
+func splitQueries(queries [][]filter, q *Query, opts *jobOptions) ([]ShardInput, error) {
+	if len(queries) > maxSubQueries {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("a job can't have more than %d sub-queries", maxSubQueries))
+	}
+	if opts.Shards > 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "a multi-query job has a shard for each sub-query")
+	}
+	if opts.Namespaces == namespacesAll {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "a multi-query job can't be run in all namespaces")
+	}
+	if opts.Multi == multiMerge {
+		for _, o := range q.orders {
+			if o.Property != "__key__" || o.Descending {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("merged queries must be in key order, not by %s", o.Property))
+			}
+		}
+		return []ShardInput{&MergedQueries{Queries: queries}}, nil
+	}
+	inputs := []ShardInput{}
+	for i, filters := range queries {
+		inputs = append(inputs, &SubQuery{Filters: filters, Earlier: queries[:i]})
+	}
+	return inputs, nil
+}
+
+// Filter adds the filters of the sub-query
+func (s *SubQuery) Filter(q *Query) *Query {
+	return applyFilters(q, s.Filters)
+}
+
+// SplitRemaining never splits a sub-query
+func (s *SubQuery) SplitRemaining(c context.Context, last *datastore.Key) (ShardInput, ShardInput, error) {
+	return s, nil, nil
+}
+
+// duplicate returns whether an earlier sub-query matches the entity too,
+// the entity is loaded if it's nil because the query was keys only or a
+// projection. That's a Get for each result of every sub-query but the
+// first, they aren't batched as each is checked before it's processed.
+func (s *SubQuery) duplicate(c context.Context, key *datastore.Key, e interface{}) (bool, error) {
+	if len(s.Earlier) == 0 {
+		return false, nil
+	}
+	props, err := entityProperties(c, key, e)
+	if err != nil {
+		return false, err
+	}
+	for _, filters := range s.Earlier {
+		if matchesFilters(key, props, filters) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Filter leaves the query as it is, the filters of each query are added
+// when they're run
+func (m *MergedQueries) Filter(q *Query) *Query {
+	return q
+}
+
+// SplitRemaining never splits merged queries
+func (m *MergedQueries) SplitRemaining(c context.Context, last *datastore.Key) (ShardInput, ShardInput, error) {
+	return m, nil, nil
+}
+
+// run processes the merged results of the queries from the positions in
+// the cursor until they're all done or the deadline has passed. It returns
+// the cursor to continue from, which is empty once they're done. The query
+// was checked to be in key order when the job started.
+func (m *MergedQueries) run(c context.Context, fn entityFunc, q *Query, e interface{}, cursor string, deadline time.Time) (string, int64, *datastore.Key, error) {
+	if len(q.orders) == 0 {
+		q = q.Order("__key__")
+	}
+	// each query runs to the end, the iterator fetches it in batches
+	q = q.Limit(0)
+
+	positions := make([]*mergePosition, len(m.Queries))
+	if cursor == "" {
+		for i := range positions {
+			positions[i] = new(mergePosition)
+		}
+	} else if err := json.Unmarshal([]byte(cursor), &positions); err != nil || len(positions) != len(m.Queries) {
+		return "", 0, nil, fmt.Errorf("invalid merged queries cursor %q", cursor)
+	}
+
+	load := e != nil && !q.keysOnly
+	heads := make([]*mergeHead, len(m.Queries))
+	for i, filters := range m.Queries {
+		if positions[i].Done {
+			continue
+		}
+		sq := applyFilters(q, filters)
+		if positions[i].Cursor != "" {
+			sq = sq.Start(positions[i].Cursor)
+		}
+		heads[i] = &mergeHead{it: runResuming(c, sq), key: positions[i].Next}
+		if heads[i].key != nil {
+			continue
+		}
+		if err := heads[i].next(load); err != nil {
+			return "", 0, nil, err
+		}
+	}
+	if load {
+		if err := getHeads(c, heads, q.projection); err != nil {
+			return "", 0, nil, err
+		}
+	}
+
+	var total int64
+	var last *datastore.Key
+	for {
+		// the next key is the lowest of the heads of the queries
+		var next *mergeHead
+		for i, h := range heads {
+			if h == nil {
+				continue
+			}
+			if h.key == nil {
+				positions[i].Done = true
+				heads[i] = nil
+				continue
+			}
+			if next == nil || compareKeys(h.key, next.key) < 0 {
+				next = h
+			}
+		}
+		if next == nil {
+			return "", total, last, nil
+		}
+		if total > 0 && !time.Now().Before(deadline) {
+			break
+		}
+
+		key := next.key
+		if next.entity != nil {
+			resetEntity(e)
+			if err := loadEntity(e, *next.entity); err != nil {
+				return "", 0, nil, err
+			}
+		}
+		if err := fn(c, key); err != nil {
+			return "", 0, nil, err
+		}
+		total++
+		last = key
+
+		// every query that had the key moves past it
+		for _, h := range heads {
+			if h == nil || h.key == nil || !h.key.Equal(key) {
+				continue
+			}
+			if err := h.next(load); err != nil {
+				return "", 0, nil, err
+			}
+		}
+	}
+
+	// the cursors are only got when the slice ends, after the result each
+	// query has read ahead
+	for i, h := range heads {
+		if h == nil {
+			continue
+		}
+		var err error
+		if positions[i].Cursor, err = h.it.Cursor(); err != nil {
+			return "", 0, nil, err
+		}
+		positions[i].Next = h.key
+	}
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return string(data), total, last, nil
+}
+
+// getHeads loads the entities of the results the queries read ahead before
+// the last slice ended, with just the projected properties of a projection
+func getHeads(c context.Context, heads []*mergeHead, projection []string) error {
+	keys := []*datastore.Key{}
+	loading := []*mergeHead{}
+	for _, h := range heads {
+		if h != nil && h.key != nil && h.entity == nil {
+			keys = append(keys, h.key)
+			loading = append(loading, h)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	entities := make([]datastore.PropertyList, len(keys))
+	err := getDatastore(c).GetMulti(c, keys, entities)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return err
+	}
+	for i, h := range loading {
+		if merr != nil && merr[i] != nil {
+			if merr[i] != datastore.ErrNoSuchEntity {
+				return merr[i]
+			}
+			// it's been deleted since so the query moves past it
+			if err := h.next(true); err != nil {
+				return err
+			}
+			continue
+		}
+		props := entities[i]
+		if len(projection) > 0 {
+			props, _ = projectProperties(props, projection)
+		}
+		h.entity = &props
+	}
+	return nil
+}
+
+// next reads the next result of the query, the key is nil when there are
+// no more
+func (h *mergeHead) next(load bool) error {
+	var dst interface{}
+	h.entity = nil
+	if load {
+		h.entity = new(datastore.PropertyList)
+		dst = h.entity
+	}
+	key, err := h.it.Next(dst)
+	if err == datastore.Done {
+		h.key = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h.key = key
+	return nil
+}
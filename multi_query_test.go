@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// multiPhotos records the keys of the photos matching any of its
+// sub-queries, which overlap
+type multiPhotos struct {
+	KeysOnly bool
+	Order    string
+	Keys     []*datastore.Key
+}
+
+var multiPhotosKeys []*datastore.Key
+
+func init() {
+	gob.Register(new(multiPhotos))
+}
+
+func (x *multiPhotos) Start(c context.Context) (*Query, interface{}) {
+	q := NewQuery("photo").Limit(5)
+	if x.Order != "" {
+		q = q.Order(x.Order)
+	}
+	if x.KeysOnly {
+		return q.KeysOnly(), nil
+	}
+	return q, new(Photo)
+}
+
+func (x *multiPhotos) SubQueries() [][]filter {
+	return [][]filter{
+		{{"photographer.id", "=", int64(1)}},
+		{{"photographer.id", "=", int64(3)}},
+		{{"photographer.id", "=", int64(1)}, {"uploaded", "<", time.Date(2015, 1, 21, 0, 0, 0, 0, time.UTC)}},
+	}
+}
+
+func (x *multiPhotos) Process(c context.Context, key *datastore.Key) {
+	x.Keys = append(x.Keys, key)
+}
+
+func (x *multiPhotos) Complete(c context.Context) {}
+
+func (x *multiPhotos) Merge(other Processor) {
+	x.Keys = append(x.Keys, other.(*multiPhotos).Keys...)
+}
+
+func (x *multiPhotos) EndJob(c context.Context, stats *JobStats) error {
+	multiPhotosKeys = x.Keys
+	return nil
+}
+
+func TestMultiQuery(t *testing.T) {
+	for _, multi := range []string{multiShards, multiMerge} {
+		for _, keysOnly := range []bool{false, true} {
+			c, _, tasks := newTestContext(t)
+			putPhotos(t, c, 40)
+
+			multiPhotosKeys = nil
+			key, err := startJob(c, &multiPhotos{KeysOnly: keysOnly}, &jobOptions{Shards: 1, Split: splitEven, Multi: multi})
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTasks(t, c, tasks)
+
+			j := new(job)
+			if err := getDatastore(c).Get(c, key, j); err != nil {
+				t.Fatal(err)
+			}
+			shards := 3
+			if multi == multiMerge {
+				shards = 1
+			}
+			if j.Shards != shards || j.Status != jobCompleted {
+				t.Errorf("%s keys only %t expected %d shards completed got %d %s", multi, keysOnly, shards, j.Shards, j.Status)
+			}
+
+			// photographers 1 and 3 took every other photo
+			seen := map[int64]bool{}
+			for i, k := range multiPhotosKeys {
+				if seen[k.IntID()] {
+					t.Errorf("%s keys only %t processed %d more than once", multi, keysOnly, k.IntID())
+				}
+				seen[k.IntID()] = true
+				if k.IntID()%2 != 1 {
+					t.Errorf("%s keys only %t processed %d which no sub-query matches", multi, keysOnly, k.IntID())
+				}
+				if multi == multiMerge && i > 0 && compareKeys(multiPhotosKeys[i-1], k) >= 0 {
+					t.Errorf("keys only %t expected merged keys in order got %d after %d", keysOnly, k.IntID(), multiPhotosKeys[i-1].IntID())
+				}
+			}
+			if len(seen) != 20 || jobProcessed(t, c, key) != 20 {
+				t.Errorf("%s keys only %t expected 20 processed got %d", multi, keysOnly, len(seen))
+			}
+		}
+	}
+}
+
+func TestMergedQueriesSlices(t *testing.T) {
+	for _, keysOnly := range []bool{false, true} {
+		c, _, _ := newTestContext(t)
+		putPhotos(t, c, 40)
+
+		q := NewQuery("photo")
+		var e *Photo
+		if keysOnly {
+			q = q.KeysOnly()
+		} else {
+			e = new(Photo)
+		}
+		m := &MergedQueries{Queries: new(multiPhotos).SubQueries()}
+
+		// every slice ends after one photo so the queries start from the
+		// results they read ahead each time
+		processed := []int64{}
+		fn := func(c context.Context, key *datastore.Key) error {
+			processed = append(processed, key.IntID())
+			if e != nil && e.Photographer.ID != 1 && e.Photographer.ID != 3 {
+				t.Errorf("photo %d loaded with photographer %d", key.IntID(), e.Photographer.ID)
+			}
+			return nil
+		}
+		var dst interface{}
+		if e != nil {
+			dst = e
+		}
+		cursor := ""
+		for slices := 0; ; slices++ {
+			var err error
+			if cursor, _, _, err = m.run(c, fn, q, dst, cursor, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			if cursor == "" {
+				break
+			}
+			// a photo read ahead that's deleted before it's loaded is skipped
+			if slices == 0 && !keysOnly {
+				if err := getDatastore(c).DeleteMulti(c, []*datastore.Key{datastore.NewKey(c, "photo", "", 3, nil)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		expected := 20
+		if !keysOnly {
+			expected = 19
+		}
+		if len(processed) != expected {
+			t.Errorf("keys only %t expected %d processed got %v", keysOnly, expected, processed)
+		}
+		for i, id := range processed {
+			if id%2 != 1 || (i > 0 && id <= processed[i-1]) || (!keysOnly && id == 3) {
+				t.Errorf("keys only %t unexpected photos processed %v", keysOnly, processed)
+				break
+			}
+		}
+	}
+}
+
+func TestMultiQueryOptions(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	if _, err := startJob(c, new(multiPhotos), &jobOptions{Shards: 2, Split: splitEven}); err == nil {
+		t.Errorf("expected error for shards with sub-queries")
+	}
+	if _, err := newJobOptions(params{"multi": "union"}); err == nil {
+		t.Errorf("expected error for an unknown multi option")
+	}
+	if opts, err := newJobOptions(params{"multi": multiMerge}); err != nil || opts.Multi != multiMerge {
+		t.Errorf("expected merged sub-queries got %v %v", opts, err)
+	}
+
+	// merged queries can't be in any order but by key, which is a bad
+	// request when the job starts
+	_, err := startJob(c, &multiPhotos{Order: "taken"}, &jobOptions{Shards: 1, Split: splitEven, Multi: multiMerge})
+	if he, ok := err.(*echo.HTTPError); !ok || he.Code() != http.StatusBadRequest {
+		t.Errorf("expected bad request merging queries sorted by taken got %v", err)
+	}
+	if _, err := startJob(c, &multiPhotos{Order: "__key__"}, &jobOptions{Shards: 1, Split: splitEven, Multi: multiMerge}); err != nil {
+		t.Errorf("expected merged queries in key order got %v", err)
+	}
+}
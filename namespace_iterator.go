@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// NamespaceIterator walks the namespaces that actually exist in a range,
+	// fetching them a batch at a time. It can be encoded as json or gob
+	// between task continuations and will carry on after the last namespace
+	// that Next returned.
+	NamespaceIterator struct {
+		// Range is what is left to iterate, nil once iteration is done
+		Range *NamespaceRange `json:"range"`
+
+		// namespaces fetched but not yet returned
+		batch []string
+	}
+
+	// namespaceSpaceConfig is the encoded form of a NamespaceSpace, the
+	// lexDistance table is rebuilt when it is decoded
+	namespaceSpaceConfig struct {
+		Alphabet  string `json:"alphabet"`
+		MaxLength int    `json:"max_length"`
+		BatchSize int    `json:"batch_size"`
+	}
+
+	// namespaceRangeConfig is the encoded form of a NamespaceRange, the
+	// space is left out for the default one
+	namespaceRangeConfig struct {
+		Start string          `json:"start"`
+		End   string          `json:"end"`
+		Space *NamespaceSpace `json:"space,omitempty"`
+	}
+)
+
+// NewNamespaceIterator creates an iterator over the namespaces in a range
+func NewNamespaceIterator(r *NamespaceRange) *NamespaceIterator {
+	return &NamespaceIterator{
+		Range: r,
+	}
+}
+
+// Next returns the next namespace, datastore.Done when there are no more
+func (it *NamespaceIterator) Next(c context.Context) (string, error) {
+	if it.Range == nil {
+		return "", datastore.Done
+	}
+	if len(it.batch) == 0 {
+		q := it.Range.MakeDatastoreQuery(c, "").Limit(it.Range.Space().BatchSize())
+		keys, err := getAllKeys(c, q)
+		if err != nil {
+			return "", err
+		}
+		if len(keys) == 0 {
+			it.Range = nil
+			return "", datastore.Done
+		}
+		for _, key := range keys {
+			it.batch = append(it.batch, key.StringID())
+		}
+	}
+
+	namespace := it.batch[0]
+	it.batch = it.batch[1:]
+
+	if namespace >= it.Range.End {
+		it.Range = nil
+		it.batch = nil
+		return namespace, nil
+	}
+	r, err := it.Range.WithStartAfter(namespace)
+	if err != nil {
+		return "", err
+	}
+	it.Range = r
+	return namespace, nil
+}
+
+// MarshalJSON encodes the range along with its namespace space
+func (n *NamespaceRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(n.config())
+}
+
+// UnmarshalJSON decodes the range and its namespace space
+func (n *NamespaceRange) UnmarshalJSON(data []byte) error {
+	config := new(namespaceRangeConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return err
+	}
+	n.setConfig(config)
+	return nil
+}
+
+// GobEncode encodes the range along with its namespace space
+func (n *NamespaceRange) GobEncode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(n.config()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode decodes the range and its namespace space
+func (n *NamespaceRange) GobDecode(data []byte) error {
+	config := new(namespaceRangeConfig)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(config); err != nil {
+		return err
+	}
+	n.setConfig(config)
+	return nil
+}
+
+func (n *NamespaceRange) config() *namespaceRangeConfig {
+	config := &namespaceRangeConfig{Start: n.Start, End: n.End}
+	if n.space != nil && n.space != DefaultNamespaceSpace {
+		config.Space = n.space
+	}
+	return config
+}
+
+func (n *NamespaceRange) setConfig(config *namespaceRangeConfig) {
+	n.Start = config.Start
+	n.End = config.End
+	n.space = config.Space
+}
+
+// MarshalJSON encodes the settings of the namespace space
+func (s *NamespaceSpace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.config())
+}
+
+// UnmarshalJSON decodes and validates the settings of a namespace space
+func (s *NamespaceSpace) UnmarshalJSON(data []byte) error {
+	config := new(namespaceSpaceConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return err
+	}
+	return s.setConfig(config)
+}
+
+// GobEncode encodes the settings of the namespace space
+func (s *NamespaceSpace) GobEncode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(s.config()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode decodes and validates the settings of a namespace space
+func (s *NamespaceSpace) GobDecode(data []byte) error {
+	config := new(namespaceSpaceConfig)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(config); err != nil {
+		return err
+	}
+	return s.setConfig(config)
+}
+
+func (s *NamespaceSpace) config() *namespaceSpaceConfig {
+	return &namespaceSpaceConfig{
+		Alphabet:  s.alphabet,
+		MaxLength: s.maxLength,
+		BatchSize: s.batchSize,
+	}
+}
+
+func (s *NamespaceSpace) setConfig(config *namespaceSpaceConfig) error {
+	space, err := NewNamespaceSpace(config.Alphabet, config.MaxLength, config.BatchSize)
+	if err != nil {
+		return err
+	}
+	*s = *space
+	return nil
+}
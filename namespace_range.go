@@ -11,65 +11,149 @@ import (
 	"google.golang.org/appengine/datastore"
 )
 
-const namespaceKind = "__namespace__"
+const (
+	namespaceKind     = "__namespace__"
+	namespaceStatKind = "__Stat_Ns_Kind__"
+)
 
 type (
+	// NamespaceSpace is the set of namespaces that can be made from an
+	// alphabet up to a maximum length, it owns the table used to convert
+	// between namespaces and their ordinals
+	NamespaceSpace struct {
+		alphabet    string
+		maxLength   int
+		batchSize   int
+		lexDistance []*big.Int
+		max         string
+	}
+
 	// NamespaceRange represents a namespace range
 	NamespaceRange struct {
-		Start string `json:"start"`
-		End   string `json:"end"`
+		Start string
+		End   string
+
+		// space the range belongs to, nil for the DefaultNamespaceSpace
+		space *NamespaceSpace
 	}
 
 	byStart []*NamespaceRange
 )
 
-var (
-	lexDistance []*big.Int
-
-	namespaceCharacters string
-	maxNamespaceLength int
-	namespaceBatchSize int
-	minNamespace string
-	maxNamespace string
+const (
+	defaultNamespaceCharacters = "-.0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
+	defaultMaxNamespaceLength  = 100
+	defaultNamespaceBatchSize  = 50
 )
 
-func init() {
-	setupConstants("-.0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz", 100, 50)
-}
+// DefaultNamespaceSpace covers every namespace the datastore allows
+var DefaultNamespaceSpace = mustNamespaceSpace(defaultNamespaceCharacters, defaultMaxNamespaceLength, defaultNamespaceBatchSize)
 
-func setupConstants(alphabet string, maxLength, batchSize int) {
-	namespaceCharacters = alphabet
-	maxNamespaceLength = maxLength
-	minNamespace = ""
-	maxNamespace = strings.Repeat(alphabet[len(alphabet)-1:], maxLength)
-	namespaceBatchSize = batchSize
+// NewNamespaceSpace creates a namespace space, the alphabet must be in
+// ascending order so that namespaces and ordinals sort the same way
+func NewNamespaceSpace(alphabet string, maxLength, batchSize int) (*NamespaceSpace, error) {
+	if alphabet == "" {
+		return nil, fmt.Errorf("namespace alphabet is empty")
+	}
+	for i := 1; i < len(alphabet); i++ {
+		if alphabet[i-1] >= alphabet[i] {
+			return nil, fmt.Errorf("namespace alphabet %q is not in ascending order", alphabet)
+		}
+	}
+	if alphabet[len(alphabet)-1] >= 0x80 {
+		return nil, fmt.Errorf("namespace alphabet %q is not ascii", alphabet)
+	}
+	if maxLength < 1 {
+		return nil, fmt.Errorf("namespace max length must be >= 1")
+	}
+	if batchSize < 1 {
+		return nil, fmt.Errorf("namespace batch size must be >= 1")
+	}
 
-	lexDistance = make([]*big.Int, maxLength)
-	lexDistance[0] = big.NewInt(1)
+	s := &NamespaceSpace{
+		alphabet:  alphabet,
+		maxLength: maxLength,
+		batchSize: batchSize,
+		max:       strings.Repeat(alphabet[len(alphabet)-1:], maxLength),
+	}
+
+	s.lexDistance = make([]*big.Int, maxLength)
+	s.lexDistance[0] = big.NewInt(1)
 	length := big.NewInt(int64(len(alphabet)))
 
 	for i := 1; i < maxLength; i++ {
 		temp := new(big.Int)
-		temp.Mul(lexDistance[i-1], length)
+		temp.Mul(s.lexDistance[i-1], length)
 		temp.Add(temp, big.NewInt(1))
-		lexDistance[i] = temp
+		s.lexDistance[i] = temp
+	}
+	return s, nil
+}
+
+func mustNamespaceSpace(alphabet string, maxLength, batchSize int) *NamespaceSpace {
+	s, err := NewNamespaceSpace(alphabet, maxLength, batchSize)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Alphabet returns the characters namespaces are made from
+func (s *NamespaceSpace) Alphabet() string {
+	return s.alphabet
+}
+
+// MaxLength returns the longest namespace in the space
+func (s *NamespaceSpace) MaxLength() int {
+	return s.maxLength
+}
+
+// BatchSize returns the number of namespaces to fetch at a time
+func (s *NamespaceSpace) BatchSize() int {
+	return s.batchSize
+}
+
+// Min returns the first namespace in the space (the default namespace)
+func (s *NamespaceSpace) Min() string {
+	return ""
+}
+
+// Max returns the last namespace in the space
+func (s *NamespaceSpace) Max() string {
+	return s.max
+}
+
+// NewNamespaceRange creates a validated range in the default namespace space
+func NewNamespaceRange(start, end string) (*NamespaceRange, error) {
+	return DefaultNamespaceSpace.NewRange(start, end)
+}
+
+// Space returns the namespace space the range belongs to, it's encoded
+// with the range when it isn't the default space
+func (n *NamespaceRange) Space() *NamespaceSpace {
+	if n.space == nil {
+		return DefaultNamespaceSpace
 	}
+	return n.space
 }
 
-func newNamespaceRange(start, end string) *NamespaceRange {
-	if start == "" {
-		start = minNamespace
+// NewRange creates a validated range, note that "" is a valid end (the
+// default namespace) so use Max() for the whole range
+func (s *NamespaceSpace) NewRange(start, end string) (*NamespaceRange, error) {
+	if _, err := s.namespaceToOrd(start); err != nil {
+		return nil, err
 	}
-	if end == "" {
-		end = maxNamespace
+	if _, err := s.namespaceToOrd(end); err != nil {
+		return nil, err
 	}
 	if start > end {
-		// error
+		return nil, fmt.Errorf("namespace range start %q is after end %q", start, end)
 	}
 	return &NamespaceRange{
 		Start: start,
-		End: end,
-	}
+		End:   end,
+		space: s,
+	}, nil
 }
 
 func (s byStart) Len() int           { return len(s) }
@@ -86,39 +170,76 @@ func (n *NamespaceRange) IsSingleNamespace() bool {
 // this NamespaceRange is returned. Otherwise a two-element list containing
 // two NamespaceRanges whose total range is identical to this
 // NamespaceRange's is returned.
-func (n *NamespaceRange) Split() (*NamespaceRange, *NamespaceRange) {
+func (n *NamespaceRange) Split() (*NamespaceRange, *NamespaceRange, error) {
 	if n.IsSingleNamespace() {
-		return n, nil
+		return n, nil, nil
+	}
+	s := n.Space()
+	start, err := s.namespaceToOrd(n.Start)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := s.namespaceToOrd(n.End)
+	if err != nil {
+		return nil, nil, err
+	}
+	if start.Cmp(end) > 0 {
+		return nil, nil, fmt.Errorf("namespace range start %q is after end %q", n.Start, n.End)
 	}
 	midPoint := new(big.Int)
-	midPoint.Add(namespaceToOrd(n.Start), namespaceToOrd(n.End))
+	midPoint.Add(start, end)
 	midPoint.Div(midPoint, big.NewInt(2))
 
-	left := newNamespaceRange(n.Start, ordToNamespace(midPoint, 0))
-	right := newNamespaceRange(ordToNamespace(midPoint.Add(midPoint, big.NewInt(1)), 0), n.End)
+	left, err := s.NewRange(n.Start, s.ordToNamespace(midPoint, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	right, err := s.NewRange(s.ordToNamespace(midPoint.Add(midPoint, big.NewInt(1)), 0), n.End)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return left, right
+	return left, right, nil
 }
 
-// WithStartAfter returns a copy of this NamespaceRange with a new start
-func (n *NamespaceRange) WithStartAfter(afterNamespace string) *NamespaceRange {
-	temp := new(big.Int)
-	namespaceStart := ordToNamespace(temp.Add(namespaceToOrd(afterNamespace), big.NewInt(1)), 0)
-  return newNamespaceRange(namespaceStart, n.End)
+// WithStartAfter returns a copy of this NamespaceRange with a new start, it
+// is an error if there are no namespaces left in the range after it. A
+// namespace before the start of the range leaves the start where it is.
+func (n *NamespaceRange) WithStartAfter(afterNamespace string) (*NamespaceRange, error) {
+	s := n.Space()
+	after, err := s.namespaceToOrd(afterNamespace)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.namespaceToOrd(n.End); err != nil {
+		return nil, err
+	}
+	if afterNamespace >= n.End {
+		return nil, fmt.Errorf("no namespaces after %q in range ending %q", afterNamespace, n.End)
+	}
+	if afterNamespace < n.Start {
+		return s.NewRange(n.Start, n.End)
+	}
+	namespaceStart := s.ordToNamespace(after.Add(after, big.NewInt(1)), 0)
+	return s.NewRange(namespaceStart, n.End)
 }
 
-// MakeDatastoreQuery returns a datastore.Query that generates all namespaces in the range
-func (n *NamespaceRange) MakeDatastoreQuery(c context.Context, start string) *datastore.Query {
-	q := datastore.NewQuery(namespaceKind)
+// MakeDatastoreQuery returns a Query that generates all namespaces in the range
+func (n *NamespaceRange) MakeDatastoreQuery(c context.Context, start string) *Query {
+	q := NewQuery(namespaceKind)
 	if n.Start != "" {
 		q = q.Filter("__key__ >=", datastore.NewKey(c, namespaceKind, n.Start, 0, nil))
 	}
-	q = q.Filter("__key__ <=", datastore.NewKey(c, namespaceKind, n.End, 0, nil))
+	if n.End == "" {
+		// the default namespace is stored with the id 1 rather than a name
+		q = q.Filter("__key__ <=", datastore.NewKey(c, namespaceKind, "", 1, nil))
+	} else {
+		q = q.Filter("__key__ <=", datastore.NewKey(c, namespaceKind, n.End, 0, nil))
+	}
 	q = q.Order("__key__")
 	q = q.KeysOnly()
 	if start != "" {
-		cursor, _ := datastore.DecodeCursor(start)
-		q = q.Start(cursor)
+		q = q.Start(start)
 	}
 	return q
 }
@@ -128,27 +249,29 @@ func (n *NamespaceRange) MakeDatastoreQuery(c context.Context, start string) *da
 // the portion of the range that contains no actual namespaces in the
 // datastore. None is returned if the NamespaceRange contains no actual
 // namespaces in the datastore.
-func (n *NamespaceRange) NormalizedStart(c context.Context) *NamespaceRange {
+func (n *NamespaceRange) NormalizedStart(c context.Context) (*NamespaceRange, error) {
 	q := n.MakeDatastoreQuery(c, "")
-	namespaceAfterKey, _ := q.Limit(1).GetAll(c, nil)
-	// fmt.Printf("NormalizedStart %s %#v\n", n.Start, namespaceAfterKey)
+	namespaceAfterKey, err := getAllKeys(c, q.Limit(1))
+	if err != nil {
+		return nil, err
+	}
 	if len(namespaceAfterKey) == 0 {
-		return nil
+		return nil, nil
 	}
-	return newNamespaceRange(namespaceAfterKey[0].Namespace(), n.End)
+	return n.Space().NewRange(namespaceAfterKey[0].StringID(), n.End)
 }
 
 // Convert a namespace ordinal to a namespace string
-func ordToNamespace(n *big.Int, maxLength int) string {
-	if n.Int64() == 0 {
+func (s *NamespaceSpace) ordToNamespace(n *big.Int, maxLength int) string {
+	if n.Sign() == 0 {
 		return ""
 	}
 
 	if maxLength == 0 {
-		maxLength = maxNamespaceLength
+		maxLength = s.maxLength
 	}
 	maxLength--
-	length := lexDistance[maxLength]
+	length := s.lexDistance[maxLength]
 	tmp := new(big.Int)
 	tmp.Sub(n, big.NewInt(1))
 	index := new(big.Int)
@@ -156,26 +279,32 @@ func ordToNamespace(n *big.Int, maxLength int) string {
 	mod := new(big.Int)
 	mod.Mod(tmp, length)
 
-  return namespaceCharacters[index.Int64():index.Int64() + 1] + ordToNamespace(mod, maxLength)
+  return s.alphabet[index.Int64():index.Int64() + 1] + s.ordToNamespace(mod, maxLength)
 }
 
 // Converts a namespace string into an int representing its lexographic order
-func namespaceToOrd(namespace string) *big.Int {
+func (s *NamespaceSpace) namespaceToOrd(namespace string) (*big.Int, error) {
 	n := new(big.Int)
 	for i, c := range namespace {
-		pos := strings.IndexRune(namespaceCharacters, c)
+		pos := strings.IndexRune(s.alphabet, c)
+		if pos == -1 {
+			return nil, fmt.Errorf("namespace %q contains illegal character %q", namespace, c)
+		}
+		if i >= s.maxLength {
+			return nil, fmt.Errorf("namespace %q is longer than %d characters", namespace, s.maxLength)
+		}
 		tmp := new(big.Int)
-		ld := lexDistance[maxNamespaceLength - i - 1]
+		ld := s.lexDistance[s.maxLength - i - 1]
 		tmp.Mul(ld, big.NewInt(int64(pos)))
 		n.Add(n, tmp)
 		n.Add(n, big.NewInt(1))
 	}
-	return n
+	return n, nil
 }
 
 func getNamespaces(c context.Context, limit int) ([]string, error) {
-	q := datastore.NewQuery(namespaceKind).Limit(limit).KeysOnly()
-	keys, err := q.GetAll(c, nil)
+	q := NewQuery(namespaceKind).Limit(limit).KeysOnly()
+	keys, err := getAllKeys(c, q)
 	if err != nil {
 		return nil, err
 	}
@@ -186,8 +315,8 @@ func getNamespaces(c context.Context, limit int) ([]string, error) {
 	return names, nil
 }
 
-// Splits the complete NamespaceRange into n equally-sized NamespaceRanges.
-func namespaceSplit(c context.Context, n int, contiguous, canQuery bool) ([]*NamespaceRange, error) {
+// Splits the complete namespace space into n equally-sized NamespaceRanges.
+func (s *NamespaceSpace) split(c context.Context, n int, contiguous, canQuery bool) ([]*NamespaceRange, error) {
 	if n < 1 {
 		return nil, fmt.Errorf("n must be >= 1")
 	}
@@ -195,28 +324,53 @@ func namespaceSplit(c context.Context, n int, contiguous, canQuery bool) ([]*Nam
 	nsRanges := []*NamespaceRange{}
 	if canQuery {
 		if contiguous {
-			nsRange := newNamespaceRange("", "")
-			nsRange = nsRange.NormalizedStart(c)
-			nsRanges = append(nsRanges, nsRange)
+			nsRange, err := s.NewRange(s.Min(), s.Max())
+			if err != nil {
+				return nil, err
+			}
+			normalized, err := nsRange.NormalizedStart(c)
+			if err != nil {
+				return nil, err
+			}
+			if normalized == nil {
+				// no namespaces so the whole range is the only one
+				return []*NamespaceRange{nsRange}, nil
+			}
+			nsRanges = append(nsRanges, normalized)
 		} else {
 			namespaces, err := getNamespaces(c, n + 1)
 			// fmt.Println(namespaces)
-			if err != nil || len(namespaces) == 0 {
+			if err != nil {
+				return nil, err
+			}
+			if len(namespaces) == 0 {
 				return nsRanges, nil
 			}
-			if len(namespaces) < n {
+			if len(namespaces) <= n {
 				// If we have less actual namespaces than number of NamespaceRanges
 				// to return, then just return the list of those namespaces.
 				for _, ns := range namespaces {
-					nsRanges = append(nsRanges, newNamespaceRange(ns, ns))
+					nsRange, err := s.NewRange(ns, ns)
+					if err != nil {
+						return nil, err
+					}
+					nsRanges = append(nsRanges, nsRange)
 				}
 				sort.Sort(byStart(nsRanges))
 				return nsRanges, nil
 			}
-			nsRanges = append(nsRanges, newNamespaceRange(namespaces[0], ""))
+			nsRange, err := s.NewRange(namespaces[0], s.Max())
+			if err != nil {
+				return nil, err
+			}
+			nsRanges = append(nsRanges, nsRange)
 		}
 	} else {
-		nsRanges = append(nsRanges, newNamespaceRange("", ""))
+		nsRange, err := s.NewRange(s.Min(), s.Max())
+		if err != nil {
+			return nil, err
+		}
+		nsRanges = append(nsRanges, nsRange)
 	}
 
 	//for _, nsRange := range nsRanges {
@@ -237,11 +391,17 @@ func namespaceSplit(c context.Context, n int, contiguous, canQuery bool) ([]*Nam
 		if nsRange.IsSingleNamespace() {
 			singles = append(singles, nsRange)
 		} else {
-			left, right := nsRange.Split()
+			left, right, err := nsRange.Split()
+			if err != nil {
+				return nil, err
+			}
 			// fmt.Printf("\nleft %#v\nright %#v\n", left, right)
 			if right != nil {
 				if canQuery {
-					right = right.NormalizedStart(c)
+					right, err = right.NormalizedStart(c)
+					if err != nil {
+						return nil, err
+					}
 				}
 				if right != nil {
 					nsRanges = append(nsRanges, right)
@@ -262,8 +422,11 @@ func namespaceSplit(c context.Context, n int, contiguous, canQuery bool) ([]*Nam
 		if len(nsRanges) == 0 {
 			// This condition is possible if every namespace was deleted after the
 			// first call to ns_range.normalized_start().
-			nsRanges = []*NamespaceRange{newNamespaceRange("", "")}
-			return nsRanges, nil
+			nsRange, err := s.NewRange(s.Min(), s.Max())
+			if err != nil {
+				return nil, err
+			}
+			return []*NamespaceRange{nsRange}, nil
 		}
 
 		continuousRanges := []*NamespaceRange{}
@@ -274,24 +437,160 @@ func namespaceSplit(c context.Context, n int, contiguous, canQuery bool) ([]*Nam
 			// }
 			var start string
 			if i == 0 {
-				start = minNamespace
+				start = s.Min()
 			} else {
 				start = nsRanges[i].Start
 			}
 
 			var end string
 			if i == len(nsRanges) - 1 {
-				end = maxNamespace
+				end = s.Max()
 			} else {
-				tmp := new(big.Int)
-				tmp.Sub(namespaceToOrd(nsRanges[i+1].Start), big.NewInt(1))
-				end = ordToNamespace(tmp, 0)
+				tmp, err := s.namespaceToOrd(nsRanges[i+1].Start)
+				if err != nil {
+					return nil, err
+				}
+				tmp.Sub(tmp, big.NewInt(1))
+				end = s.ordToNamespace(tmp, 0)
 			}
 			// fmt.Printf("start %s end %s\n", start, end)
-			continuousRanges = append(continuousRanges, newNamespaceRange(start, end))
+			nsRange, err := s.NewRange(start, end)
+			if err != nil {
+				return nil, err
+			}
+			continuousRanges = append(continuousRanges, nsRange)
 		}
 		return continuousRanges, nil
 	}
 
 	return nsRanges, nil
 }
+
+// namespaceWeight returns how much work a namespace represents
+type namespaceWeight func(c context.Context, namespace string) (int64, error)
+
+// countNamespaces weights every namespace the same so splitting gives each
+// range roughly the same number of namespaces
+func countNamespaces(c context.Context, namespace string) (int64, error) {
+	return 1, nil
+}
+
+// entityWeight weights each namespace by the number of entities of a kind
+// it contains, from the datastore statistics if they have been generated
+// otherwise by counting the keys
+func entityWeight(kind string) namespaceWeight {
+	return func(c context.Context, namespace string) (int64, error) {
+		q := NewQuery(namespaceStatKind).Namespace(namespace).Filter("kind_name =", kind).Limit(1)
+		it := getDatastore(c).Run(c, q)
+		var stat datastore.PropertyList
+		_, err := it.Next(&stat)
+		if err == nil {
+			for _, p := range stat {
+				if count, ok := p.Value.(int64); ok && p.Name == "count" {
+					return count, nil
+				}
+			}
+		} else if err != datastore.Done {
+			return 0, err
+		}
+
+		keys, err := getAllKeys(c, NewQuery(kind).Namespace(namespace))
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(keys)), nil
+	}
+}
+
+// Splits the namespace space into at most n ranges that hold roughly equal
+// amounts of work according to the weight of the namespaces that actually
+// exist, rather than equal parts of the ordinal space which leaves most
+// ranges empty when the namespace names are clustered.
+func (s *NamespaceSpace) splitByDensity(c context.Context, n int, contiguous bool, weight namespaceWeight) ([]*NamespaceRange, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("n must be >= 1")
+	}
+
+	all, err := s.NewRange(s.Min(), s.Max())
+	if err != nil {
+		return nil, err
+	}
+	namespaces := []string{}
+	weights := []int64{}
+	var total int64
+	it := NewNamespaceIterator(all)
+	for {
+		ns, err := it.Next(c)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		w, err := weight(c, ns)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(namespaces, ns)
+		weights = append(weights, w)
+		total += w
+	}
+
+	if len(namespaces) == 0 {
+		if contiguous {
+			return []*NamespaceRange{all}, nil
+		}
+		return []*NamespaceRange{}, nil
+	}
+	if total == 0 {
+		// nothing to weigh them by so share the namespaces out instead
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = int64(len(weights))
+	}
+
+	// each namespace goes in the group the middle of its cumulative weight
+	// falls in, so groups only ever increase and a namespace is never split
+	firsts := []int{}
+	lasts := []int{}
+	var before int64
+	group := -1
+	for i, w := range weights {
+		g := int((2*before + w) * int64(n) / (2 * total))
+		if g > group {
+			group = g
+			firsts = append(firsts, i)
+			lasts = append(lasts, i)
+		}
+		lasts[len(lasts)-1] = i
+		before += w
+	}
+
+	nsRanges := []*NamespaceRange{}
+	for i := range firsts {
+		start := namespaces[firsts[i]]
+		end := namespaces[lasts[i]]
+		if contiguous {
+			if i == 0 {
+				start = s.Min()
+			}
+			if i == len(firsts)-1 {
+				end = s.Max()
+			} else {
+				tmp, err := s.namespaceToOrd(namespaces[firsts[i+1]])
+				if err != nil {
+					return nil, err
+				}
+				tmp.Sub(tmp, big.NewInt(1))
+				end = s.ordToNamespace(tmp, 0)
+			}
+		}
+		nsRange, err := s.NewRange(start, end)
+		if err != nil {
+			return nil, err
+		}
+		nsRanges = append(nsRanges, nsRange)
+	}
+	return nsRanges, nil
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"testing/quick"
 
 	"math/big"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 )
 
@@ -17,18 +24,115 @@ type (
 	pet struct {
 		Value int64 `datastore:"value"`
 	}
+
+	// randomNamespace generates namespaces from the default namespace
+	// space for the property based tests
+	randomNamespace string
 )
 
+func (randomNamespace) Generate(r *rand.Rand, size int) reflect.Value {
+	alphabet := DefaultNamespaceSpace.Alphabet()
+	length := r.Intn(DefaultNamespaceSpace.MaxLength() + 1)
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return reflect.ValueOf(randomNamespace(b))
+}
+
 func createInNamespace(c context.Context, namespace string) {
 	ns, _ := appengine.Namespace(c, namespace)
 	p := new(pet)
 	p.Value = 1
 	k := datastore.NewKey(ns, "pet", "", 1, nil)
-	datastore.Put(ns, k, p)
+	getDatastore(ns).Put(ns, k, p)
+}
+
+// testSpace returns a small namespace space to test with
+func testSpace(t *testing.T, alphabet string, maxLength, batchSize int) *NamespaceSpace {
+	s, err := NewNamespaceSpace(alphabet, maxLength, batchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// ordinal returns the ordinal of a namespace that is expected to be valid
+func ordinal(t *testing.T, s *NamespaceSpace, namespace string) *big.Int {
+	ord, err := s.namespaceToOrd(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ord
+}
+
+// namespaceRange returns a range that is expected to be valid
+func namespaceRange(t *testing.T, s *NamespaceSpace, start, end string) *NamespaceRange {
+	r, err := s.NewRange(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// allNamespaces returns every namespace for an alphabet and max length
+func allNamespaces(alphabet string, maxLength int) []string {
+	namespaces := []string{""}
+	if maxLength == 0 {
+		return namespaces
+	}
+	for _, c := range alphabet {
+		for _, ns := range allNamespaces(alphabet, maxLength-1) {
+			namespaces = append(namespaces, string(c)+ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// checkContiguous checks that the ranges are in order with no gaps or
+// overlaps between them
+func checkContiguous(t *testing.T, name string, ranges []*NamespaceRange) {
+	for i, r := range ranges {
+		if r.Start > r.End {
+			t.Errorf("%s range %d is inverted %s-%s", name, i, r.Start, r.End)
+		}
+		if i == 0 {
+			continue
+		}
+		expected := new(big.Int).Add(ordinal(t, r.Space(), ranges[i-1].End), big.NewInt(1))
+		if ordinal(t, r.Space(), r.Start).Cmp(expected) != 0 {
+			t.Errorf("%s range %d starts %q but previous ended %q", name, i, r.Start, ranges[i-1].End)
+		}
+	}
+}
+
+// sameRange checks that two ranges, either of which may be nil, match
+func sameRange(a, b *NamespaceRange) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Start == b.Start && a.End == b.End
+}
+
+// checkCovered checks that every namespace is in exactly one range
+func checkCovered(t *testing.T, name string, ranges []*NamespaceRange, namespaces []string) {
+	for _, ns := range namespaces {
+		found := 0
+		for _, r := range ranges {
+			if r.Start <= ns && ns <= r.End {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("%s namespace %q is in %d ranges", name, ns, found)
+		}
+	}
 }
 
 func TestOrdinalization(t *testing.T) {
-	setupConstants("ab", 2, 0)
+	t.Parallel()
+	s := testSpace(t, "ab", 2, 1)
 	tests := []struct {
 		ordinal   *big.Int
 		namespace string
@@ -42,29 +146,464 @@ func TestOrdinalization(t *testing.T) {
 		{big.NewInt(6), "bb"},
 	}
 	for i, test := range tests {
-		if ns := ordToNamespace(test.ordinal, 0); ns != test.namespace {
+		if ns := s.ordToNamespace(test.ordinal, 0); ns != test.namespace {
 			t.Errorf("%d ordToNamespace %s failed - expected %s got %s", i, test.ordinal, test.namespace, ns)
 		}
 
-		if ord := namespaceToOrd(test.namespace); ord.Cmp(test.ordinal) != 0 {
+		if ord := ordinal(t, s, test.namespace); ord.Cmp(test.ordinal) != 0 {
 			t.Errorf("%d namespaceToOrd %s failed - expected %s got %s", i, test.namespace, test.ordinal, ord)
 		}
 	}
 }
 
-func TestNamespaceRangeIteration(t *testing.T) {
-	setupConstants("abc", 3, 3)
+func TestOrdinalizationExhaustive(t *testing.T) {
+	t.Parallel()
+	// every namespace in lexicographic order should have consecutive ordinals
+	s := testSpace(t, "abc", 3, 3)
+	for i, ns := range allNamespaces("abc", 3) {
+		if ord := ordinal(t, s, ns); ord.Cmp(big.NewInt(int64(i))) != 0 {
+			t.Errorf("namespaceToOrd %q expected %d got %s", ns, i, ord)
+		}
+		if s := s.ordToNamespace(big.NewInt(int64(i)), 0); s != ns {
+			t.Errorf("ordToNamespace %d expected %q got %q", i, ns, s)
+		}
+	}
 }
 
-func TestNamespaceRangeSplit(t *testing.T) {
-	setupConstants("abc", 3, 3)
+func TestOrdinalizationProperties(t *testing.T) {
+	t.Parallel()
+	s := DefaultNamespaceSpace
+
+	roundTrip := func(ns randomNamespace) bool {
+		return s.ordToNamespace(ordinal(t, s, string(ns)), 0) == string(ns)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+
+	ordered := func(a, b randomNamespace) bool {
+		return strings.Compare(string(a), string(b)) == ordinal(t, s, string(a)).Cmp(ordinal(t, s, string(b)))
+	}
+	if err := quick.Check(ordered, nil); err != nil {
+		t.Error(err)
+	}
+
+	if ns := s.ordToNamespace(ordinal(t, s, s.Max()), 0); ns != s.Max() {
+		t.Errorf("expected max namespace to round trip got %q", ns)
+	}
 }
 
-func TestNamespaceSplit(t *testing.T) {
-	c, done, err := aetest.NewContext()
+func TestNewNamespaceSpace(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		alphabet             string
+		maxLength, batchSize int
+	} {
+		{"", 3, 3},
+		{"ba", 3, 3},
+		{"aab", 3, 3},
+		{"aé", 3, 3},
+		{"ab", 0, 3},
+		{"ab", 3, 0},
+	}
+	for _, test := range tests {
+		if _, err := NewNamespaceSpace(test.alphabet, test.maxLength, test.batchSize); err == nil {
+			t.Errorf("%q %d %d expected error", test.alphabet, test.maxLength, test.batchSize)
+		}
+	}
+
+	// different spaces can be used side by side
+	small := testSpace(t, "ab", 2, 1)
+	large := testSpace(t, "abc", 3, 3)
+	if small.Max() != "bb" || large.Max() != "ccc" {
+		t.Errorf("expected max bb and ccc got %s and %s", small.Max(), large.Max())
+	}
+	if ord := ordinal(t, small, "b"); ord.Cmp(big.NewInt(4)) != 0 {
+		t.Errorf("expected b to be 4 in the small space got %s", ord)
+	}
+	if ord := ordinal(t, large, "b"); ord.Cmp(big.NewInt(14)) != 0 {
+		t.Errorf("expected b to be 14 in the large space got %s", ord)
+	}
+	if _, err := small.NewRange("a", "c"); err == nil {
+		t.Errorf("expected c to be illegal in the small space")
+	}
+	left, right, err := namespaceRange(t, small, "", "bb").Split()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if left.Space() != small || right.Space() != small {
+		t.Errorf("expected split ranges to stay in the small space")
+	}
+
+	// ranges without a space use the default one
+	r := &NamespaceRange{Start: "a", End: "z"}
+	if r.Space() != DefaultNamespaceSpace {
+		t.Errorf("expected the default namespace space")
+	}
+
+	// the space is encoded with the range, and left out for the default one
+	for _, r := range []*NamespaceRange{namespaceRange(t, small, "a", "bb"), r} {
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := new(NamespaceRange)
+		if err := json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(r); err != nil {
+			t.Fatal(err)
+		}
+		gobbed := new(NamespaceRange)
+		if err := gob.NewDecoder(buf).Decode(gobbed); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range []*NamespaceRange{decoded, gobbed} {
+			if d.Start != r.Start || d.End != r.End || d.Space().Max() != r.Space().Max() {
+				t.Errorf("expected %q-%q max %q got %q-%q max %q", r.Start, r.End, r.Space().Max(), d.Start, d.End, d.Space().Max())
+			}
+		}
+		if r.space == nil && decoded.Space() != DefaultNamespaceSpace {
+			t.Errorf("expected a range without a space to decode to the default space")
+		}
+	}
+}
+
+func TestNamespaceToOrdErrors(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	for _, ns := range []string{"d", "abd", "a-", "aé", "aaaa", "cccc"} {
+		if ord, err := s.namespaceToOrd(ns); err == nil {
+			t.Errorf("namespaceToOrd %q expected error got %s", ns, ord)
+		}
+	}
+}
+
+func TestNewNamespaceRange(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	tests := []struct {
+		start, end string
+		valid      bool
+	} {
+		{"", "", true},
+		{"", "ccc", true},
+		{"a", "a", true},
+		{"ab", "b", true},
+		{"b", "a", false},
+		{"ccc", "", false},
+		{"", "aaaa", false},
+		{"aaaa", "b", false},
+		{"d", "d", false},
+		{"", "ABC", false},
+	}
+	for _, test := range tests {
+		r, err := s.NewRange(test.start, test.end)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%q-%q unexpected error %s", test.start, test.end, err)
+			} else if r.Start != test.start || r.End != test.end {
+				t.Errorf("%q-%q got %q-%q", test.start, test.end, r.Start, r.End)
+			}
+		} else if err == nil {
+			t.Errorf("%q-%q expected error", test.start, test.end)
+		}
+	}
+
+	// ranges that didn't come from the constructor are checked when used
+	for _, r := range []*NamespaceRange{{Start: "b", End: "a"}, {Start: "", End: "a b"}, {Start: "!", End: "~"}} {
+		if _, _, err := r.Split(); err == nil {
+			t.Errorf("%q-%q expected split error", r.Start, r.End)
+		}
+		if _, err := r.WithStartAfter(r.Start); err == nil {
+			t.Errorf("%q-%q expected start after error", r.Start, r.End)
+		}
+	}
+}
+
+func TestNamespaceRangeIteration(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	all := allNamespaces("abc", 3)
+	for _, ns := range all {
+		createInNamespace(c, ns)
+	}
+
+	tests := []struct {
+		start, end string
+	} {
+		{"", "ccc"},
+		{"a", "a"},
+		{"ab", "bca"},
+		{"b", "c"},
+		{"cca", "ccc"},
+	}
+	for _, test := range tests {
+		expected := []string{}
+		for _, ns := range all {
+			if test.start <= ns && ns <= test.end {
+				expected = append(expected, ns)
+			}
+		}
+
+		// page through the namespaces a batch at a time
+		nsRange := namespaceRange(t, s, test.start, test.end)
+		namespaces := []string{}
+		cursor := ""
+		for {
+			it := getDatastore(c).Run(c, nsRange.MakeDatastoreQuery(c, cursor).Limit(s.BatchSize()))
+			count := 0
+			for {
+				key, err := it.Next(nil)
+				if err == datastore.Done {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				namespaces = append(namespaces, key.StringID())
+				count++
+			}
+			if count == 0 {
+				break
+			}
+			cursor, _ = it.Cursor()
+		}
+
+		if !reflect.DeepEqual(namespaces, expected) {
+			t.Errorf("%s-%s expected %q got %q", test.start, test.end, expected, namespaces)
+		}
+	}
+}
+
+func TestNamespaceIterator(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	namespaces := []string{""}
+	for i, ns := range allNamespaces("abc", 3) {
+		if ns != "" && i%3 == 0 {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	for _, ns := range namespaces {
+		createInNamespace(c, ns)
+	}
+
+	tests := []struct {
+		start, end string
+	} {
+		{"", "ccc"},
+		{"", ""},
+		{"ab", "bca"},
+		{"aca", "aca"},
+		{"b", "b"},
+		{"cc", "ccc"},
+	}
+	for _, test := range tests {
+		expected := []string{}
+		for _, ns := range namespaces {
+			if test.start <= ns && ns <= test.end {
+				expected = append(expected, ns)
+			}
+		}
+
+		// encode and decode the iterator after every namespace as if it was
+		// being continued in a new task
+		it := NewNamespaceIterator(namespaceRange(t, s, test.start, test.end))
+		got := []string{}
+		for i := 0; ; i++ {
+			resumed := new(NamespaceIterator)
+			if i%2 == 0 {
+				data, err := json.Marshal(it)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(data, resumed); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				buf := new(bytes.Buffer)
+				if err := gob.NewEncoder(buf).Encode(it); err != nil {
+					t.Fatal(err)
+				}
+				if err := gob.NewDecoder(buf).Decode(resumed); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if resumed.Range != nil && resumed.Range.Space().Max() != s.Max() {
+				t.Fatalf("expected space to be resumed got max %q", resumed.Range.Space().Max())
+			}
+			it = resumed
+
+			ns, err := it.Next(c)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ns)
+		}
+
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s-%s expected %q got %q", test.start, test.end, expected, got)
+		}
+	}
+
+	// without encoding the iterator uses its batches
+	it := NewNamespaceIterator(namespaceRange(t, s, s.Min(), s.Max()))
+	count := 0
+	for {
+		_, err := it.Next(c)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != len(namespaces) {
+		t.Errorf("expected %d namespaces got %d", len(namespaces), count)
+	}
+	if _, err := it.Next(c); err != datastore.Done {
+		t.Errorf("expected iteration to stay done got %v", err)
+	}
+
+	// invalid spaces and cursors are reported
+	resumed := new(NamespaceIterator)
+	if err := json.Unmarshal([]byte(`{"range":{"start":"","end":"c","space":{"alphabet":"ba","max_length":3,"batch_size":3}}}`), resumed); err == nil {
+		t.Errorf("expected error decoding an invalid namespace space")
+	}
+	q := namespaceRange(t, s, s.Min(), s.Max()).MakeDatastoreQuery(c, "not a cursor")
+	if _, err := getDatastore(c).Run(c, q).Next(nil); err == nil {
+		t.Errorf("expected error running a query with an invalid cursor")
+	}
+}
+
+func TestNamespaceRangeSplit(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	tests := []struct {
+		start, end  string
+		left, right *NamespaceRange
+	} {
+		{"a", "a", &NamespaceRange{Start: "a", End: "a"}, nil},
+		{"a", "aa", &NamespaceRange{Start: "a", End: "a"}, &NamespaceRange{Start: "aa", End: "aa"}},
+		{"", "ccc", &NamespaceRange{Start: "", End: "bb"}, &NamespaceRange{Start: "bba", End: "ccc"}},
+		{"b", "c", &NamespaceRange{Start: "b", End: "bba"}, &NamespaceRange{Start: "bbb", End: "c"}},
+		{"", "a", &NamespaceRange{Start: "", End: ""}, &NamespaceRange{Start: "a", End: "a"}},
+	}
+	for _, test := range tests {
+		left, right, err := namespaceRange(t, s, test.start, test.end).Split()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameRange(left, test.left) || !sameRange(right, test.right) {
+			t.Errorf("%s-%s expected %v %v got %v %v", test.start, test.end, test.left, test.right, left, right)
+		}
+	}
+
+	// any split should cover the original range without gaps or overlap
+	s = DefaultNamespaceSpace
+	covered := func(a, b randomNamespace) bool {
+		start, end := string(a), string(b)
+		if start > end {
+			start, end = end, start
+		}
+		left, right, err := namespaceRange(t, s, start, end).Split()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if right == nil {
+			return start == end && left.Start == start && left.End == end
+		}
+		checkContiguous(t, "split", []*NamespaceRange{left, right})
+		return left.Start == start && right.End == end && left.End < right.Start
+	}
+	if err := quick.Check(covered, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNamespaceRangeWithStartAfter(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	all := allNamespaces("abc", 3)
+	for i, ns := range all[:len(all)-1] {
+		r, err := namespaceRange(t, s, "", "ccc").WithStartAfter(ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Start != all[i+1] || r.End != "ccc" {
+			t.Errorf("start after %q expected %q-ccc got %q-%q", ns, all[i+1], r.Start, r.End)
+		}
+	}
+
+	// a namespace before the range doesn't move the start back
+	for _, ns := range []string{"", "a", "ab"} {
+		r, err := namespaceRange(t, s, "b", "c").WithStartAfter(ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Start != "b" || r.End != "c" {
+			t.Errorf("start after %q expected b-c got %q-%q", ns, r.Start, r.End)
+		}
+	}
+
+	// nothing is left after the end of the range
+	for _, ns := range []string{"b", "ba", "c", "ccc"} {
+		if r, err := namespaceRange(t, s, "a", "b").WithStartAfter(ns); err == nil {
+			t.Errorf("start after %q expected error got %q-%q", ns, r.Start, r.End)
+		}
+	}
+	if _, err := namespaceRange(t, s, "", "ccc").WithStartAfter("abd"); err == nil {
+		t.Errorf("expected error starting after an illegal namespace")
+	}
+}
+
+func TestNamespaceRangeNormalizedStart(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	for _, ns := range []string{"ab", "bca", "cc"} {
+		createInNamespace(c, ns)
+	}
+
+	tests := []struct {
+		start, end string
+		normalized *NamespaceRange
+	} {
+		{"a", "ccc", &NamespaceRange{Start: "ab", End: "ccc"}},
+		{"ab", "ccc", &NamespaceRange{Start: "ab", End: "ccc"}},
+		{"aba", "c", &NamespaceRange{Start: "bca", End: "c"}},
+		{"ca", "cb", nil},
+		{"cca", "ccc", nil},
+	}
+	for _, test := range tests {
+		r, err := namespaceRange(t, s, test.start, test.end).NormalizedStart(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameRange(r, test.normalized) {
+			t.Errorf("%s-%s expected %v got %v", test.start, test.end, test.normalized, r)
+		}
+	}
+}
+
+func TestNamespaceSplit(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	c, done := newDatastoreContext(t)
 	defer done()
 
 	for _, x := range "cba" {
@@ -97,9 +636,27 @@ func TestNamespaceSplit(t *testing.T) {
 				{Start:"cab", End:"ccc"},
 			},
 		},
+		{"testSplitWithQueries", 4, false, true, []NamespaceRange{
+				{Start:"aaa", End:"acb"},
+				{Start:"acc", End:"bbb"},
+				{Start:"bbc", End:"cab"},
+				{Start:"cac", End:"ccc"},
+			},
+		},
+		{"testSplitWithQueriesWithContiguous", 4, true, true, []NamespaceRange{
+				{Start:"", End:"acb"},
+				{Start:"acc", End:"bbb"},
+				{Start:"bbc", End:"cab"},
+				{Start:"cac", End:"ccc"},
+			},
+		},
+		{"testSplitIntoOne", 1, false, true, []NamespaceRange{
+				{Start:"aaa", End:"ccc"},
+			},
+		},
 	}
 	for _, test := range tests {
-		results, _ := namespaceSplit(c, test.count, test.contiguous, test.canQuery)
+		results, _ := s.split(c, test.count, test.contiguous, test.canQuery)
 		if len(results) != len(test.ranges) {
 			t.Fatalf("%s expected %d ranges got %d", test.name, len(test.ranges), len(results))
 		}
@@ -109,13 +666,197 @@ func TestNamespaceSplit(t *testing.T) {
 			}
 		}
 	}
+
+	if _, err := s.split(c, 0, false, false); err == nil {
+		t.Errorf("expected error splitting into 0 ranges")
+	}
 }
 
-func TestNone(t *testing.T) {
-	c, done, err := aetest.NewContext()
+func TestNamespaceSplitProperties(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	all := allNamespaces("abc", 3)
+
+	// without queries the ranges always tile the whole namespace space
+	for n := 1; n <= len(all)+1; n++ {
+		for _, contiguous := range []bool{false, true} {
+			name := fmt.Sprintf("n=%d contiguous=%t", n, contiguous)
+			ranges, err := s.split(context.Background(), n, contiguous, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ranges) > n {
+				t.Errorf("%s got %d ranges", name, len(ranges))
+			}
+			if ranges[0].Start != s.Min() || ranges[len(ranges)-1].End != s.Max() {
+				t.Errorf("%s doesn't cover min to max", name)
+			}
+			checkContiguous(t, name, ranges)
+		}
+	}
+
+	// with queries every actual namespace ends up in exactly one range
+	r := rand.New(rand.NewSource(1))
+	iterations := 20
+	if *useAetest {
+		iterations = 3
+	}
+	for i := 0; i < iterations; i++ {
+		c, done := newDatastoreContext(t)
+		namespaces := []string{}
+		for _, ns := range all {
+			if r.Intn(4) == 0 {
+				namespaces = append(namespaces, ns)
+				createInNamespace(c, ns)
+			}
+		}
+		n := 1 + r.Intn(8)
+
+		name := fmt.Sprintf("%d namespaces n=%d", len(namespaces), n)
+		ranges, err := s.split(c, n, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranges) > n {
+			t.Errorf("%s got %d ranges", name, len(ranges))
+		}
+		checkCovered(t, name, ranges, namespaces)
+
+		ranges, err = s.split(c, n, true, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ranges[0].Start != s.Min() || ranges[len(ranges)-1].End != s.Max() {
+			t.Errorf("%s contiguous doesn't cover min to max", name)
+		}
+		checkContiguous(t, name+" contiguous", ranges)
+		checkCovered(t, name+" contiguous", ranges, namespaces)
+		done()
+	}
+}
+
+func TestNamespaceSplitByDensity(t *testing.T) {
+	t.Parallel()
+	s := DefaultNamespaceSpace
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	// tenant names are clustered in a tiny part of the ordinal space
+	namespaces := []string{}
+	for i := 1; i <= 40; i++ {
+		ns := fmt.Sprintf("cust-%04d", i)
+		namespaces = append(namespaces, ns)
+		createInNamespace(c, ns)
+	}
+
+	count := func(r *NamespaceRange) int {
+		count := 0
+		for _, ns := range namespaces {
+			if r.Start <= ns && ns <= r.End {
+				count++
+			}
+		}
+		return count
+	}
+
+	// halving the ordinal space gives uneven ranges
+	ranges, err := s.split(c, 4, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 4 || count(ranges[0]) != 19 || count(ranges[3]) != 1 {
+		t.Errorf("expected the ordinal split to be uneven got %v", ranges)
+	}
+
+	for _, contiguous := range []bool{false, true} {
+		name := fmt.Sprintf("contiguous=%t", contiguous)
+		ranges, err := s.splitByDensity(c, 4, contiguous, countNamespaces)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ranges) != 4 {
+			t.Fatalf("%s expected 4 ranges got %d", name, len(ranges))
+		}
+		for i, r := range ranges {
+			if n := count(r); n != 10 {
+				t.Errorf("%s range %d %q-%q has %d namespaces", name, i, r.Start, r.End, n)
+			}
+		}
+		checkCovered(t, name, ranges, namespaces)
+		if contiguous {
+			checkContiguous(t, name, ranges)
+			if ranges[0].Start != s.Min() || ranges[3].End != s.Max() {
+				t.Errorf("%s doesn't cover min to max", name)
+			}
+		}
+	}
+
+	if _, err := s.splitByDensity(c, 0, false, countNamespaces); err == nil {
+		t.Errorf("expected error splitting into 0 ranges")
+	}
+}
+
+func TestNamespaceSplitByEntities(t *testing.T) {
+	t.Parallel()
+	s := DefaultNamespaceSpace
+	c, done := newDatastoreContext(t)
+	defer done()
+
+	// one big tenant and lots of small ones
+	put := func(namespace string, count int) {
+		ns, _ := appengine.Namespace(c, namespace)
+		for i := 1; i <= count; i++ {
+			k := datastore.NewKey(ns, "pet", "", int64(i), nil)
+			if _, err := getDatastore(ns).Put(ns, k, &pet{Value: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put("a", 30)
+	for _, ns := range []string{"b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		put(ns, 1)
+	}
+
+	ranges, err := s.splitByDensity(c, 2, false, entityWeight("pet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || !sameRange(ranges[0], &NamespaceRange{Start: "a", End: "a"}) || !sameRange(ranges[1], &NamespaceRange{Start: "b", End: "j"}) {
+		t.Errorf("expected a-a and b-j got %v", ranges)
+	}
+
+	// statistics are used when they exist
+	ns, _ := appengine.Namespace(c, "j")
+	stat := datastore.PropertyList{
+		{Name: "kind_name", Value: "pet"},
+		{Name: "count", Value: int64(100)},
+	}
+	if _, err := getDatastore(ns).Put(ns, datastore.NewKey(ns, namespaceStatKind, "pet", 0, nil), &stat); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err = s.splitByDensity(c, 2, true, entityWeight("pet"))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(ranges) != 2 || ranges[0].Start != s.Min() || ranges[1].Start != "j" || ranges[1].End != s.Max() {
+		t.Errorf("expected the split at j got %v", ranges)
+	}
+	checkContiguous(t, "stats", ranges)
+
+	// a kind that doesn't exist falls back to counting namespaces
+	ranges, err = s.splitByDensity(c, 2, false, entityWeight("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[0].Start != "a" || ranges[0].End != "e" || ranges[1].Start != "f" {
+		t.Errorf("expected a-e and f-j got %v", ranges)
+	}
+}
+
+func TestNone(t *testing.T) {
+	t.Parallel()
+	s := testSpace(t, "abc", 3, 3)
+	c, done := newDatastoreContext(t)
 	defer done()
 
 	tests := []struct {
@@ -126,9 +867,13 @@ func TestNone(t *testing.T) {
 		ranges     []NamespaceRange
 	} {
 		{"testSplitWithNoNamespacesInDatastore", 10, false, true, []NamespaceRange{},},
+		{"testSplitWithNoNamespacesInDatastoreWithContiguous", 10, true, true, []NamespaceRange{
+				{Start:"", End:"ccc"},
+			},
+		},
 	}
 	for _, test := range tests {
-		results, _ := namespaceSplit(c, test.count, test.contiguous, test.canQuery)
+		results, _ := s.split(c, test.count, test.contiguous, test.canQuery)
 		if len(results) != len(test.ranges) {
 			t.Fatalf("%s expected %d ranges got %d", test.name, len(test.ranges), len(results))
 		}
@@ -137,6 +882,9 @@ func TestNone(t *testing.T) {
 				t.Fatalf("%s expected range %d %s-%s got %s-%s", test.name, i, test.ranges[i].Start, test.ranges[i].End, r.Start, r.End)
 			}
 		}
+		results, _ = s.splitByDensity(c, test.count, test.contiguous, countNamespaces)
+		if len(results) != len(test.ranges) {
+			t.Fatalf("%s by density expected %d ranges got %d", test.name, len(test.ranges), len(results))
+		}
 	}
 }
-
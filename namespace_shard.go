@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// NamespaceShard is the input of a shard that runs the processor's
+	// query in each namespace of a range in turn
+	NamespaceShard struct {
+		Range *NamespaceRange
+	}
+
+	// namespacePosition is how far a namespace shard has got, it's kept as
+	// json in the shard's cursor. The iterator holds the namespaces after
+	// the one being run.
+	namespacePosition struct {
+		Namespaces *NamespaceIterator `json:"namespaces"`
+		Namespace  string             `json:"namespace"`
+		Cursor     string             `json:"cursor,omitempty"`
+	}
+)
+
+const (
+	// a job is run in the namespace of its query, or in every namespace
+	namespacesAll = "all"
+)
+
+func init() {
+	gob.Register(&NamespaceShard{})
+}
+
+// splitNamespaces returns the inputs for a job run in every namespace. The
+// namespace space is split in half until there are enough ranges or, with
+// split=density, into ranges with about the same number of entities of the
+// kind (or of namespaces when there are no entities). The ranges cover all
+// of the space so namespaces created once the job has started are run too.
+func splitNamespaces(c context.Context, q *Query, opts *jobOptions) ([]ShardInput, error) {
+	if q.namespace != "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("a query in namespace %s can't be run in all namespaces", q.namespace))
+	}
+
+	s := DefaultNamespaceSpace
+	var ranges []*NamespaceRange
+	var err error
+	if opts.Split == splitDensity {
+		ranges, err = s.splitByDensity(c, opts.Shards, true, entityWeight(q.kind))
+	} else {
+		ranges, err = s.split(c, opts.Shards, true, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := []ShardInput{}
+	for _, r := range ranges {
+		inputs = append(inputs, &NamespaceShard{Range: r})
+	}
+	return inputs, nil
+}
+
+// Filter leaves the query as it is, the namespace is set when it's run
+func (n *NamespaceShard) Filter(q *Query) *Query {
+	return q
+}
+
+// SplitRemaining never splits a namespace shard
+func (n *NamespaceShard) SplitRemaining(c context.Context, last *datastore.Key) (ShardInput, ShardInput, error) {
+	return n, nil, nil
+}
+
+// run processes the results of the query in each namespace of the range
+// from the position in the cursor until they're all done or the deadline
+// has passed. It returns the cursor to continue from, which is empty once
+// every namespace is done.
+func (n *NamespaceShard) run(c context.Context, fn entityFunc, q *Query, e interface{}, cursor string, deadline time.Time) (string, int64, *datastore.Key, error) {
+	pos := new(namespacePosition)
+	if cursor == "" {
+		pos.Namespaces = NewNamespaceIterator(n.Range)
+		ns, err := pos.Namespaces.Next(c)
+		if err == datastore.Done {
+			return "", 0, nil, nil
+		}
+		if err != nil {
+			return "", 0, nil, err
+		}
+		pos.Namespace = ns
+	} else if err := json.Unmarshal([]byte(cursor), pos); err != nil || pos.Namespaces == nil {
+		return "", 0, nil, fmt.Errorf("invalid namespace shard cursor %q", cursor)
+	}
+
+	var total int64
+	var last *datastore.Key
+	for {
+		next, processed, l, err := runQuery(c, fn, q.Namespace(pos.Namespace), e, nil, pos.Cursor, deadline)
+		if err != nil {
+			return "", 0, nil, err
+		}
+		total += processed
+		if l != nil {
+			last = l
+		}
+		pos.Cursor = next
+
+		// the next namespace is started in this slice if there's time
+		if next == "" {
+			ns, err := pos.Namespaces.Next(c)
+			if err == datastore.Done {
+				return "", total, last, nil
+			}
+			if err != nil {
+				return "", 0, nil, err
+			}
+			pos.Namespace = ns
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+	}
+
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return string(data), total, last, nil
+}
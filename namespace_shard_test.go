@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// namespacePhotos records the keys of the photos it processes
+type namespacePhotos struct {
+	Keys []*datastore.Key
+}
+
+var namespacePhotosKeys []*datastore.Key
+
+func init() {
+	gob.Register(new(namespacePhotos))
+}
+
+func (x *namespacePhotos) Start(c context.Context) (*Query, interface{}) {
+	return NewQuery("photo").Limit(2).KeysOnly(), nil
+}
+
+func (x *namespacePhotos) Process(c context.Context, key *datastore.Key) {
+	x.Keys = append(x.Keys, key)
+}
+
+func (x *namespacePhotos) Complete(c context.Context) {}
+
+func (x *namespacePhotos) Merge(other Processor) {
+	x.Keys = append(x.Keys, other.(*namespacePhotos).Keys...)
+}
+
+func (x *namespacePhotos) EndJob(c context.Context, stats *JobStats) error {
+	namespacePhotosKeys = x.Keys
+	return nil
+}
+
+func TestNamespaceShardedJob(t *testing.T) {
+	for _, split := range []string{splitEven, splitDensity} {
+		for _, shards := range []int{1, 3} {
+			name := fmt.Sprintf("%s %d shards", split, shards)
+			c, _, tasks := newTestContext(t)
+
+			// one big tenant and a few small ones, as well as the default
+			expected := map[string]int{"": 3, "cust-0001": 12, "cust-0002": 1, "cust-0003": 2, "cust-0004": 1}
+			for namespace, n := range expected {
+				nc, _ := appengine.Namespace(c, namespace)
+				putPhotos(t, nc, n)
+			}
+
+			namespacePhotosKeys = nil
+			opts, err := newJobOptions(params{"shards": fmt.Sprint(shards), "split": split, "namespaces": namespacesAll})
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := startJob(c, new(namespacePhotos), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTasks(t, c, tasks)
+
+			j := new(job)
+			if err := getDatastore(c).Get(c, key, j); err != nil {
+				t.Fatal(err)
+			}
+			if j.Status != jobCompleted || j.Shards != shards {
+				t.Errorf("%s expected a completed job with %d shards got %s with %d", name, shards, j.Status, j.Shards)
+			}
+
+			got := map[string]int{}
+			seen := map[string]bool{}
+			for _, k := range namespacePhotosKeys {
+				if seen[k.String()+"/"+k.Namespace()] {
+					t.Errorf("%s processed %s in %q twice", name, k.String(), k.Namespace())
+				}
+				seen[k.String()+"/"+k.Namespace()] = true
+				got[k.Namespace()]++
+			}
+			for namespace, n := range expected {
+				if got[namespace] != n {
+					t.Errorf("%s expected %d photos in %q got %d", name, n, namespace, got[namespace])
+				}
+			}
+		}
+	}
+}
+
+func TestNamespaceShardedJobOptions(t *testing.T) {
+	for _, p := range []params{
+		{"namespaces": "some"},
+		{"namespaces": namespacesAll, "split": splitSample},
+		{"split": splitDensity},
+	} {
+		if _, err := newJobOptions(p); err == nil {
+			t.Errorf("%v expected error", p)
+		}
+	}
+
+	// a query in a namespace can't be run in all of them
+	c, _, _ := newTestContext(t)
+	processor, err := newCountEntities(params{"kind": "photo", "namespace": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startJob(c, processor, &jobOptions{Shards: 1, Split: splitEven, Namespaces: namespacesAll}); err == nil {
+		t.Errorf("expected error running a query in a namespace in all namespaces")
+	}
+}
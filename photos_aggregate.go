@@ -1,21 +1,25 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
-	"github.com/qedus/nds"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 type (
 	aggregatePhotos struct {
-		From    time.Time
-		To      time.Time
+		From     time.Time
+		To       time.Time
+		Property string
 
-		// note non-exported member - we don't need it serialized between tasks
-		counts map[int64]int64
+		// note exported member - the counts are serialized between tasks so
+		// they add up over every slice and are merged from every shard
+		Counts map[int64]int64
+
+		// only the photographer is loaded, by a projection query
+		photo *Photo
 	}
 )
 
@@ -24,7 +28,7 @@ func init() {
 }
 
 func newAggregatePhotos(params ParamAdapter) (Processor, error) {
-	p := new(aggregatePhotos)
+	p := &aggregatePhotos{Property: "taken"}
 	if params == nil {
 		return p, nil
 	}
@@ -56,45 +60,70 @@ func newAggregatePhotos(params ParamAdapter) (Processor, error) {
 	return p, nil
 }
 
-func (x *aggregatePhotos) Start(c context.Context) (*datastore.Query, interface{}) {
-	x.counts = make(map[int64]int64)
+func (x *aggregatePhotos) Start(c context.Context) (*Query, interface{}) {
+	if x.Counts == nil {
+		x.Counts = make(map[int64]int64)
+	}
 
-	q := datastore.NewQuery("photo")
-	q = q.Filter("taken >=", x.From)
-	q = q.Filter("taken <", x.To)
-	q = q.Order("taken")
+	q := NewQuery("photo")
+	q = q.Filter(x.Property+" >=", x.From)
+	q = q.Filter(x.Property+" <", x.To)
+	q = q.Order(x.Property)
 	q = q.Limit(500)
-	q = q.KeysOnly()
 
-	// NOTE: we're going a keys_only query so we won't actually load the entity here ...
-	return q, nil
+	// a projection is as cheap as a keys only query but we get the one
+	// property we need too, it needs a composite index of the window
+	// property and photographer.id
+	q = q.Project("photographer.id")
+	x.photo = new(Photo)
+	return q, x.photo
 }
 
-func (x *aggregatePhotos) Process(c context.Context, key *datastore.Key) {
-	// ... instead we have to load it ourselves (but now we can use memcache to reduce costs)
-	photo := new(Photo)
-	err := nds.Get(c, key, photo)
-	if err != nil {
-		log.Errorf(c, "get photo error %s", err.Error())
-		return
+// PropertyRange lets the time window be split into shards
+func (x *aggregatePhotos) PropertyRange() *PropertyRange {
+	return &PropertyRange{Property: x.Property, Start: x.From, IncludeStart: true, End: x.To}
+}
+
+// SetWindow lets the photos be processed incrementally by when they were
+// taken or uploaded
+func (x *aggregatePhotos) SetWindow(property string, from, to time.Time) error {
+	if property != "taken" && property != "uploaded" {
+		return fmt.Errorf("photos can't be windowed by %s", property)
 	}
-	photo.ID = key.IntID()
+	x.Property = property
+	x.From = from
+	x.To = to
+	return nil
+}
 
+func (x *aggregatePhotos) Process(c context.Context, key *datastore.Key) {
 	// we could do other datastore lookups here (e.g. if processing orders and
 	// looking up photo for line items to aggregate sales by photographer) in
 	// which case we should look at creating more of a pipeline with go routines
 	// so mutliple operations can overlap
-	_, ok := x.counts[photo.Photographer.ID]
-	if ok {
-		x.counts[photo.Photographer.ID]++
-	} else {
-		x.counts[photo.Photographer.ID] = 1
-	}
+	x.Counts[x.photo.Photographer.ID]++
 }
 
 func (x *aggregatePhotos) Complete(c context.Context) {
+	// the counts so far are only partial, they're carried over to the next
+	// slice and written when the job ends
+}
+
+// Merge adds the counts from another shard
+func (x *aggregatePhotos) Merge(other Processor) {
+	if x.Counts == nil {
+		x.Counts = make(map[int64]int64)
+	}
+	for id, count := range other.(*aggregatePhotos).Counts {
+		x.Counts[id] += count
+	}
+}
+
+// EndJob is called once with the counts for every photo in the range
+func (x *aggregatePhotos) EndJob(c context.Context, stats *JobStats) error {
 	// schedule task to update aggregates etc ...
-	for id, count := range x.counts {
-		log.Debugf(c, "photographer %d took %d", id, count)
+	for id, count := range x.Counts {
+		log.Infof(c, "photographer %d took %d", id, count)
 	}
+	return nil
 }
@@ -1,17 +1,18 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 )
 
 type (
 	logPhotos struct {
-		From    time.Time
-		To      time.Time
+		From     time.Time
+		To       time.Time
+		Property string
 
 		// note non-exported member - we don't need it serialized between tasks
 		photo  *Photo
@@ -23,7 +24,7 @@ func init() {
 }
 
 func newLogPhotos(params ParamAdapter) (Processor, error) {
-	p := new(logPhotos)
+	p := &logPhotos{Property: "taken"}
 	if params == nil {
 		return p, nil
 	}
@@ -55,20 +56,37 @@ func newLogPhotos(params ParamAdapter) (Processor, error) {
 	return p, nil
 }
 
-func (x *logPhotos) Start(c context.Context) (*datastore.Query, interface{}) {
+func (x *logPhotos) Start(c context.Context) (*Query, interface{}) {
 	// entity instance to be loaded
 	x.photo = new(Photo)
 
-	q := datastore.NewQuery("photo")
-	q = q.Filter("taken >=", x.From)
-	q = q.Filter("taken <", x.To)
-	q = q.Order("taken")
+	q := NewQuery("photo")
+	q = q.Filter(x.Property+" >=", x.From)
+	q = q.Filter(x.Property+" <", x.To)
+	q = q.Order(x.Property)
 	q = q.Limit(100)
 
 	// NOTE: we're doing a full entity query - we need to pass the pointer to our struct to load
 	return q, x.photo
 }
 
+// PropertyRange lets the time window be split into shards
+func (x *logPhotos) PropertyRange() *PropertyRange {
+	return &PropertyRange{Property: x.Property, Start: x.From, IncludeStart: true, End: x.To}
+}
+
+// SetWindow lets the photos be processed incrementally by when they were
+// taken or uploaded
+func (x *logPhotos) SetWindow(property string, from, to time.Time) error {
+	if property != "taken" && property != "uploaded" {
+		return fmt.Errorf("photos can't be windowed by %s", property)
+	}
+	x.Property = property
+	x.From = from
+	x.To = to
+	return nil
+}
+
 func (x *logPhotos) Process(c context.Context, key *datastore.Key) {
 	// just log it
 	log.Debugf(c, "photo %d taken %s by %d %s", key.IntID(), x.photo.Taken.String(), x.photo.Photographer.ID, x.photo.Photographer.Name)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// photosPerMonth counts the photos each photographer took each month,
+	// the counts are emitted and added up by the reducer so they don't all
+	// have to fit in memory
+	photosPerMonth struct {
+		// how many values the shard has emitted
+		Emitted int64
+
+		// note non-exported member - we don't need it serialized between tasks
+		photo *Photo
+	}
+
+	// sumPhotos adds up the counts for each photographer and month and
+	// stores them as a photographerMonth entity of the kind
+	sumPhotos struct {
+		Kind string
+	}
+
+	// photographerMonth is the number of photos a photographer took in a
+	// month, the key name is the photographer ID and month
+	photographerMonth struct {
+		Photographer int64     `json:"photographer" datastore:"photographer"`
+		Month        time.Time `json:"month"        datastore:"month"`
+		Count        int64     `json:"count"        datastore:"count,noindex"`
+	}
+)
+
+const photographerMonthKind = "photographer_month"
+
+func init() {
+	registerProcessor(newPhotosPerMonth)
+	registerReducer(new(sumPhotos))
+	registerKind(photographerMonthKind, photographerMonth{})
+}
+
+func newPhotosPerMonth(params ParamAdapter) (Processor, error) {
+	return new(photosPerMonth), nil
+}
+
+func (x *photosPerMonth) Start(c context.Context) (*Query, interface{}) {
+	x.photo = new(Photo)
+
+	q := NewQuery("photo")
+	q = q.Limit(100)
+
+	return q, x.photo
+}
+
+func (x *photosPerMonth) Process(c context.Context, key *datastore.Key) {
+	month := x.photo.Taken.UTC().Format("2006-01")
+	if err := Emit(c, fmt.Sprintf("%d/%s", x.photo.Photographer.ID, month), int64(1)); err != nil {
+		log.Errorf(c, "emit photo %d error %s", key.IntID(), err.Error())
+		return
+	}
+	x.Emitted++
+}
+
+func (x *photosPerMonth) Complete(c context.Context) {
+	// nothing to do, the emitted values are stored at the end of the slice
+}
+
+// EndShard logs how much the shard emitted
+func (x *photosPerMonth) EndShard(c context.Context) error {
+	log.Debugf(c, "emitted %d photo counts", x.Emitted)
+	return nil
+}
+
+func (x *photosPerMonth) Reducer() Reducer {
+	return &sumPhotos{Kind: photographerMonthKind}
+}
+
+func (r *sumPhotos) Reduce(c context.Context, key string, values []interface{}) error {
+	m := new(photographerMonth)
+	var month string
+	if _, err := fmt.Sscanf(key, "%d/%s", &m.Photographer, &month); err != nil {
+		return err
+	}
+	var err error
+	if m.Month, err = time.Parse("2006-01", month); err != nil {
+		return err
+	}
+	for _, value := range values {
+		m.Count += value.(int64)
+	}
+
+	_, err = getDatastore(c).Put(c, datastore.NewKey(c, r.Kind, key, 0, nil), m)
+	return err
+}
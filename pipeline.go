@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// pipelineDefinition lists the processors to run, each stage is started
+	// once all of the stages it runs after have completed
+	pipelineDefinition struct {
+		Stages []*pipelineStage `json:"stages"`
+	}
+
+	// pipelineStage is one processor in a pipeline, the params are the same
+	// as for the process endpoint (including shards and split)
+	pipelineStage struct {
+		Name      string            `json:"name"`
+		Processor string            `json:"processor"`
+		Params    map[string]string `json:"params,omitempty"`
+		After     []string          `json:"after,omitempty"`
+	}
+
+	// pipeline tracks a run of a pipeline definition
+	pipeline struct {
+		Definition string    `datastore:"definition,noindex"`
+		Status     string    `datastore:"status"`
+		Error      string    `datastore:"error,noindex"`
+		Created    time.Time `datastore:"created"`
+		Updated    time.Time `datastore:"updated"`
+	}
+
+	// stage tracks a stage of a pipeline, it's a child of the pipeline keyed
+	// by the name of the stage so they can be updated together. Claimed is
+	// when the stage was set running, its job is recorded once it's started.
+	stage struct {
+		Status  string         `datastore:"status"`
+		Job     *datastore.Key `datastore:"job"`
+		Error   string         `datastore:"error,noindex"`
+		Claimed time.Time      `datastore:"claimed,noindex"`
+		Updated time.Time      `datastore:"updated"`
+	}
+
+	// pipelineStatus is the status of a pipeline and its stages as json
+	pipelineStatus struct {
+		ID      int64          `json:"id"`
+		Status  string         `json:"status"`
+		Error   string         `json:"error,omitempty"`
+		Stages  []*stageStatus `json:"stages"`
+		Created time.Time      `json:"created"`
+		Updated time.Time      `json:"updated"`
+	}
+
+	stageStatus struct {
+		Name      string `json:"name"`
+		Processor string `json:"processor"`
+		Status    string `json:"status"`
+		Job       int64  `json:"job,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	// mapParamAdapter gets processor params from a map
+	mapParamAdapter map[string]string
+)
+
+const (
+	pipelineKind = "pipeline"
+	stageKind    = "stage"
+
+	pipelineRunning   = "running"
+	pipelineCompleted = "completed"
+	pipelineFailed    = "failed"
+
+	stagePending   = "pending"
+	stageRunning   = "running"
+	stageCompleted = "completed"
+	stageFailed    = "failed"
+)
+
+var (
+	// a stage (or backfill unit) that was claimed this long ago and still
+	// has no job never got one, it's longer than the request that claimed
+	// it can run for so it can't still be starting the job
+	claimTimeout = time.Duration(15) * time.Minute
+)
+
+func init() {
+	cron.Post("/pipeline", pipelineHandler)
+	cron.Get("/pipeline/:id", pipelineStatusHandler)
+	cron.Post("/pipeline/:id/retry", pipelineRetryHandler)
+}
+
+func (p mapParamAdapter) Get(name string) string {
+	return p[name]
+}
+
+// validate checks the stages have unique names, registered processors
+// with valid params and that their dependencies exist without any cycles
+func (d *pipelineDefinition) validate() error {
+	if len(d.Stages) == 0 {
+		return fmt.Errorf("pipeline has no stages")
+	}
+	stages := make(map[string]*pipelineStage)
+	for _, s := range d.Stages {
+		if s.Name == "" {
+			return fmt.Errorf("pipeline stage has no name")
+		}
+		if _, found := stages[s.Name]; found {
+			return fmt.Errorf("pipeline stage %s is defined more than once", s.Name)
+		}
+		stages[s.Name] = s
+
+		fn, found := processors[s.Processor]
+		if !found {
+			return fmt.Errorf("pipeline stage %s processor %s not found", s.Name, s.Processor)
+		}
+		processor, err := fn(mapParamAdapter(s.Params))
+		if err != nil {
+			return fmt.Errorf("pipeline stage %s %s", s.Name, err.Error())
+		}
+		opts, err := newJobOptions(mapParamAdapter(s.Params))
+		if err != nil {
+			return fmt.Errorf("pipeline stage %s %s", s.Name, err.Error())
+		}
+		if err := applyQuery(processor, opts); err != nil {
+			return fmt.Errorf("pipeline stage %s %s", s.Name, err.Error())
+		}
+	}
+
+	// depth first search for cycles, 1 is visiting and 2 is done
+	state := make(map[string]int)
+	var visit func(s *pipelineStage) error
+	visit = func(s *pipelineStage) error {
+		switch state[s.Name] {
+		case 1:
+			return fmt.Errorf("pipeline stage %s depends on itself", s.Name)
+		case 2:
+			return nil
+		}
+		state[s.Name] = 1
+		for _, name := range s.After {
+			after, found := stages[name]
+			if !found {
+				return fmt.Errorf("pipeline stage %s runs after unknown stage %s", s.Name, name)
+			}
+			if err := visit(after); err != nil {
+				return err
+			}
+		}
+		state[s.Name] = 2
+		return nil
+	}
+	for _, s := range d.Stages {
+		if err := visit(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startPipeline stores a pipeline and its stages and starts the stages that
+// don't run after any others, the definition must have been validated
+func startPipeline(c context.Context, d *pipelineDefinition) (*datastore.Key, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := getDatastore(c)
+	now := time.Now().UTC()
+	p := &pipeline{
+		Definition: string(data),
+		Status:     pipelineRunning,
+		Created:    now,
+		Updated:    now,
+	}
+	key, err := ds.Put(c, datastore.NewIncompleteKey(c, pipelineKind, nil), p)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*datastore.Key, len(d.Stages))
+	stages := make([]*stage, len(d.Stages))
+	for i, s := range d.Stages {
+		keys[i] = datastore.NewKey(c, stageKind, s.Name, 0, key)
+		stages[i] = &stage{Status: stagePending, Updated: now}
+	}
+	if _, err := ds.PutMulti(c, keys, stages); err != nil {
+		return nil, err
+	}
+
+	log.Infof(c, "started pipeline %d with %d stages", key.IntID(), len(d.Stages))
+	return key, advancePipeline(c, key, "")
+}
+
+// advancePipeline marks a stage as completed, if there is one, then starts
+// any stages that are ready to run. It's safe to call again if it fails.
+func advancePipeline(c context.Context, key *datastore.Key, completed string) error {
+	var d *pipelineDefinition
+	ready := []*pipelineStage{}
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ready = ready[:0]
+		ds := getDatastore(tc)
+		p, stages, err := loadPipeline(tc, key)
+		if err != nil {
+			return err
+		}
+		if d, err = p.definition(); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		updated := map[string]bool{}
+		if s, found := stages[completed]; found && s.Status != stageCompleted {
+			s.Status = stageCompleted
+			s.Updated = now
+			updated[completed] = true
+		}
+
+		// nothing new is started once the pipeline has failed
+		done := 0
+		for _, ps := range d.Stages {
+			s := stages[ps.Name]
+			if s.Status == stageCompleted {
+				done++
+			}
+			if p.Status != pipelineRunning || s.Status != stagePending {
+				continue
+			}
+			waiting := false
+			for _, name := range ps.After {
+				if stages[name].Status != stageCompleted {
+					waiting = true
+				}
+			}
+			if !waiting {
+				s.Status = stageRunning
+				s.Claimed = now
+				s.Updated = now
+				updated[ps.Name] = true
+				ready = append(ready, ps)
+			}
+		}
+		if done == len(d.Stages) && p.Status == pipelineRunning {
+			p.Status = pipelineCompleted
+			log.Infof(tc, "completed pipeline %d", key.IntID())
+		}
+
+		for name := range updated {
+			if _, err := ds.Put(tc, datastore.NewKey(tc, stageKind, name, 0, key), stages[name]); err != nil {
+				return err
+			}
+		}
+		p.Updated = now
+		_, err = ds.Put(tc, key, p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the jobs aren't in the pipeline's entity group so they're started
+	// once the stages have been claimed
+	for _, ps := range ready {
+		if err := startStage(c, key, ps); err != nil {
+			log.Errorf(c, "start pipeline %d stage %s error %s", key.IntID(), ps.Name, err.Error())
+			if err := failStage(c, key, ps.Name, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startStage starts the job for a stage and records it against the stage
+func startStage(c context.Context, key *datastore.Key, ps *pipelineStage) error {
+	params := mapParamAdapter(ps.Params)
+	processor, err := processors[ps.Processor](params)
+	if err != nil {
+		return err
+	}
+	opts, err := newJobOptions(params)
+	if err != nil {
+		return err
+	}
+	opts.Pipeline = key
+	opts.Stage = ps.Name
+	jobKey, err := startJob(c, processor, opts)
+	if err != nil {
+		return err
+	}
+
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		stageKey := datastore.NewKey(tc, stageKind, ps.Name, 0, key)
+		s := new(stage)
+		if err := ds.Get(tc, stageKey, s); err != nil {
+			return err
+		}
+		s.Job = jobKey
+		s.Updated = time.Now().UTC()
+		_, err := ds.Put(tc, stageKey, s)
+		return err
+	})
+}
+
+// failStage marks a stage and the pipeline as failed so that no more of
+// its stages are started until it's retried
+func failStage(c context.Context, key *datastore.Key, name, reason string) error {
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		p := new(pipeline)
+		if err := ds.Get(tc, key, p); err != nil {
+			return err
+		}
+		stageKey := datastore.NewKey(tc, stageKind, name, 0, key)
+		s := new(stage)
+		if err := ds.Get(tc, stageKey, s); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		s.Status = stageFailed
+		s.Error = reason
+		s.Updated = now
+		if _, err := ds.Put(tc, stageKey, s); err != nil {
+			return err
+		}
+		p.Status = pipelineFailed
+		p.Error = fmt.Sprintf("stage %s failed: %s", name, reason)
+		p.Updated = now
+		_, err := ds.Put(tc, key, p)
+		return err
+	})
+}
+
+// retryPipeline sets the failed stages of a pipeline back to pending, along
+// with any that were claimed long enough ago that they never will get a job,
+// and carries on from them
+func retryPipeline(c context.Context, key *datastore.Key) error {
+	err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		p, stages, err := loadPipeline(tc, key)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for name, s := range stages {
+			if s.Status == stageFailed || (s.Status == stageRunning && s.Job == nil && now.Sub(s.Claimed) > claimTimeout) {
+				s.Status = stagePending
+				s.Job = nil
+				s.Error = ""
+				s.Updated = now
+				if _, err := ds.Put(tc, datastore.NewKey(tc, stageKind, name, 0, key), s); err != nil {
+					return err
+				}
+			}
+		}
+		if p.Status != pipelineCompleted {
+			p.Status = pipelineRunning
+			p.Error = ""
+		}
+		p.Updated = now
+		_, err = ds.Put(tc, key, p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof(c, "retrying pipeline %d", key.IntID())
+	return advancePipeline(c, key, "")
+}
+
+// loadPipeline gets a pipeline and its stages by name
+func loadPipeline(c context.Context, key *datastore.Key) (*pipeline, map[string]*stage, error) {
+	ds := getDatastore(c)
+	p := new(pipeline)
+	if err := ds.Get(c, key, p); err != nil {
+		return nil, nil, err
+	}
+	stages := make(map[string]*stage)
+	it := ds.Run(c, NewQuery(stageKind).Ancestor(key))
+	for {
+		s := new(stage)
+		k, err := it.Next(s)
+		if err == datastore.Done {
+			return p, stages, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		stages[k.StringID()] = s
+	}
+}
+
+func (p *pipeline) definition() (*pipelineDefinition, error) {
+	d := new(pipelineDefinition)
+	if err := json.Unmarshal([]byte(p.Definition), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// getPipelineStatus returns the status of a pipeline and its stages in the
+// order they were defined
+func getPipelineStatus(c context.Context, key *datastore.Key) (*pipelineStatus, error) {
+	p, stages, err := loadPipeline(c, key)
+	if err != nil {
+		return nil, err
+	}
+	d, err := p.definition()
+	if err != nil {
+		return nil, err
+	}
+	status := &pipelineStatus{
+		ID:      key.IntID(),
+		Status:  p.Status,
+		Error:   p.Error,
+		Stages:  []*stageStatus{},
+		Created: p.Created,
+		Updated: p.Updated,
+	}
+	for _, ps := range d.Stages {
+		s := stages[ps.Name]
+		ss := &stageStatus{
+			Name:      ps.Name,
+			Processor: ps.Processor,
+			Status:    s.Status,
+			Error:     s.Error,
+		}
+		if s.Job != nil {
+			ss.Job = s.Job.IntID()
+		}
+		status.Stages = append(status.Stages, ss)
+	}
+	return status, nil
+}
+
+// pipelineHandler starts a pipeline from the json definition posted to it
+func pipelineHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	d := new(pipelineDefinition)
+	if err := json.NewDecoder(c.Request().Body).Decode(d); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := d.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	key, err := startPipeline(ctx, d)
+	if err != nil {
+		log.Errorf(ctx, "start pipeline error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	status, err := getPipelineStatus(ctx, key)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func pipelineStatusHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	key, err := pipelineKey(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	status, err := getPipelineStatus(ctx, key)
+	if err == datastore.ErrNoSuchEntity {
+		return echo.NewHTTPError(http.StatusNotFound, "pipeline not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+func pipelineRetryHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	key, err := pipelineKey(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if err := retryPipeline(ctx, key); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return echo.NewHTTPError(http.StatusNotFound, "pipeline not found")
+		}
+		log.Errorf(ctx, "retry pipeline error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func pipelineKey(c context.Context, id string) (*datastore.Key, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 1 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid pipeline id")
+	}
+	return datastore.NewKey(c, pipelineKind, "", n, nil), nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// stageStatuses returns the status of each stage of a pipeline by name
+func stageStatuses(t *testing.T, c context.Context, key *datastore.Key) (*pipelineStatus, map[string]*stageStatus) {
+	status, err := getPipelineStatus(c, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages := make(map[string]*stageStatus)
+	for _, s := range status.Stages {
+		stages[s.Name] = s
+	}
+	return status, stages
+}
+
+func TestPipelineValidate(t *testing.T) {
+	stage := func(name, processor string, params map[string]string, after ...string) *pipelineStage {
+		return &pipelineStage{Name: name, Processor: processor, Params: params, After: after}
+	}
+	tests := []struct {
+		name   string
+		stages []*pipelineStage
+		valid  bool
+	}{
+		{"dag", []*pipelineStage{stage("a", "logPhotos", nil), stage("b", "logPhotos", nil, "a"), stage("c", "logPhotos", nil, "a"), stage("d", "photosPerMonth", nil, "b", "c")}, true},
+		{"empty", []*pipelineStage{}, false},
+		{"no name", []*pipelineStage{stage("", "logPhotos", nil)}, false},
+		{"duplicate", []*pipelineStage{stage("a", "logPhotos", nil), stage("a", "logPhotos", nil)}, false},
+		{"unknown processor", []*pipelineStage{stage("a", "missing", nil)}, false},
+		{"invalid params", []*pipelineStage{stage("a", "logPhotos", map[string]string{"from": "yesterday"})}, false},
+		{"invalid shards", []*pipelineStage{stage("a", "logPhotos", map[string]string{"shards": "none"})}, false},
+		{"unknown stage", []*pipelineStage{stage("a", "logPhotos", nil, "b")}, false},
+		{"cycle", []*pipelineStage{stage("a", "logPhotos", nil, "c"), stage("b", "logPhotos", nil, "a"), stage("c", "logPhotos", nil, "b")}, false},
+		{"self", []*pipelineStage{stage("a", "logPhotos", nil, "a")}, false},
+	}
+	for _, test := range tests {
+		d := &pipelineDefinition{Stages: test.stages}
+		if err := d.validate(); (err == nil) != test.valid {
+			t.Errorf("%s expected valid %t got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 100)
+	dir, err := os.MkdirTemp("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the counts are only exported once they've all been reduced
+	d := &pipelineDefinition{Stages: []*pipelineStage{
+		{Name: "log", Processor: "logPhotos", Params: map[string]string{"from": "2015-01-01", "to": "2015-02-01", "shards": "2"}},
+		{Name: "count", Processor: "photosPerMonth", Params: map[string]string{"shards": "2"}},
+		{Name: "export", Processor: "exportEntities", Params: map[string]string{"kind": photographerMonthKind, "format": "ndjson", "dest": dir}, After: []string{"log", "count"}},
+	}}
+	key, err := startPipeline(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, stages := stageStatuses(t, c, key)
+	if status.Status != pipelineRunning || stages["log"].Status != stageRunning || stages["count"].Status != stageRunning || stages["export"].Status != stagePending {
+		t.Errorf("expected the first two stages to be running got %#v", stages)
+	}
+	if stages["log"].Job == 0 || stages["count"].Job == 0 || stages["export"].Job != 0 {
+		t.Errorf("expected jobs for the first two stages got %#v", stages)
+	}
+
+	runTasks(t, c, tasks)
+	status, stages = stageStatuses(t, c, key)
+	if status.Status != pipelineCompleted {
+		t.Errorf("expected completed pipeline got %#v", status)
+	}
+	for name, s := range stages {
+		if s.Status != stageCompleted || s.Job == 0 {
+			t.Errorf("expected %s to be completed got %#v", name, s)
+		}
+		j := new(job)
+		if err := getDatastore(c).Get(c, datastore.NewKey(c, jobKind, "", s.Job, nil), j); err != nil {
+			t.Fatal(err)
+		}
+		if j.Status != jobCompleted || j.Stage != name || !j.Pipeline.Equal(key) {
+			t.Errorf("expected completed job for %s got %#v", name, j)
+		}
+	}
+	if n := countKind(t, c, photographerMonthKind); n != 16 {
+		t.Errorf("expected 16 photographer months got %d", n)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", "manifest.json"))
+	if len(matches) != 1 {
+		t.Errorf("expected an export manifest got %v", matches)
+	}
+}
+
+func TestPipelineFailure(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	// an inequality filter can't be split into key ranges so the job for
+	// the second stage can't start
+	d := &pipelineDefinition{Stages: []*pipelineStage{
+		{Name: "log", Processor: "logPhotos", Params: map[string]string{"from": "2015-01-01", "to": "2015-02-01"}},
+		{Name: "delete", Processor: "deleteEntities", Params: map[string]string{"kind": "photo", "filters": "taken<2015-01-05", "shards": "2"}, After: []string{"log"}},
+		{Name: "count", Processor: "photosPerMonth", After: []string{"delete"}},
+		{Name: "other", Processor: "photosPerMonth", After: []string{"log"}},
+	}}
+	key, err := startPipeline(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+
+	status, stages := stageStatuses(t, c, key)
+	if status.Status != pipelineFailed || status.Error == "" {
+		t.Errorf("expected failed pipeline got %#v", status)
+	}
+	if stages["log"].Status != stageCompleted || stages["delete"].Status != stageFailed || stages["delete"].Error == "" {
+		t.Errorf("expected the delete stage to fail got %#v %#v", stages["log"], stages["delete"])
+	}
+	// stages that were ready at the same time still run, but nothing after
+	// the failure is started
+	if stages["count"].Status != stagePending || stages["other"].Status != stageCompleted {
+		t.Errorf("expected count to not be started got %#v %#v", stages["count"], stages["other"])
+	}
+	logJob := stages["log"].Job
+
+	// retrying only starts the failed stage again
+	if err := retryPipeline(c, key); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	status, stages = stageStatuses(t, c, key)
+	if status.Status != pipelineFailed || stages["delete"].Status != stageFailed || stages["log"].Job != logJob {
+		t.Errorf("expected only the delete stage to be retried got %#v", status)
+	}
+}
+
+func TestPipelineRetry(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	d := &pipelineDefinition{Stages: []*pipelineStage{
+		{Name: "log", Processor: "logPhotos", Params: map[string]string{"from": "2015-01-01", "to": "2015-02-01"}},
+		{Name: "count", Processor: "photosPerMonth", After: []string{"log"}},
+	}}
+	key, err := startPipeline(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	_, stages := stageStatuses(t, c, key)
+	logJob := stages["log"].Job
+
+	// as if the job for the last stage had failed
+	if err := failStage(c, key, "count", "job failed"); err != nil {
+		t.Fatal(err)
+	}
+	status, stages := stageStatuses(t, c, key)
+	if status.Status != pipelineFailed || stages["count"].Status != stageFailed {
+		t.Fatalf("expected failed pipeline got %#v", status)
+	}
+
+	if err := retryPipeline(c, key); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	status, stages = stageStatuses(t, c, key)
+	if status.Status != pipelineCompleted || status.Error != "" || stages["count"].Status != stageCompleted || stages["count"].Error != "" {
+		t.Errorf("expected retried pipeline to complete got %#v", status)
+	}
+	if stages["log"].Job != logJob {
+		t.Errorf("expected completed stages to not be run again")
+	}
+}
+
+func TestPipelineRetryClaimed(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	d := &pipelineDefinition{Stages: []*pipelineStage{
+		{Name: "log", Processor: "logPhotos", Params: map[string]string{"from": "2015-01-01", "to": "2015-02-01"}},
+	}}
+	key, err := startPipeline(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+
+	// as if the stage had just been claimed and its job was still starting
+	stageKey := datastore.NewKey(c, stageKind, "log", 0, key)
+	claim := func(claimed time.Time) {
+		ds := getDatastore(c)
+		p := new(pipeline)
+		if err := ds.Get(c, key, p); err != nil {
+			t.Fatal(err)
+		}
+		p.Status = pipelineRunning
+		if _, err := ds.Put(c, key, p); err != nil {
+			t.Fatal(err)
+		}
+		s := &stage{Status: stageRunning, Claimed: claimed, Updated: claimed}
+		if _, err := ds.Put(c, stageKey, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	claim(time.Now().UTC())
+	if err := retryPipeline(c, key); err != nil {
+		t.Fatal(err)
+	}
+	_, stages := stageStatuses(t, c, key)
+	if stages["log"].Status != stageRunning || stages["log"].Job != 0 || tasks.Len() != 0 {
+		t.Errorf("expected a stage that's starting to be left alone got %#v", stages["log"])
+	}
+
+	// one claimed long enough ago is started again
+	claim(time.Now().UTC().Add(-2 * claimTimeout))
+	if err := retryPipeline(c, key); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	status, stages := stageStatuses(t, c, key)
+	if status.Status != pipelineCompleted || stages["log"].Status != stageCompleted || stages["log"].Job == 0 {
+		t.Errorf("expected a stale claim to be started again got %#v %#v", status, stages["log"])
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	d := &pipelineDefinition{Stages: []*pipelineStage{
+		{Name: "log", Processor: "logPhotos", Params: map[string]string{"from": "2015-01-01", "to": "2015-02-01"}},
+		{Name: "count", Processor: "photosPerMonth", After: []string{"log"}},
+	}}
+	key, err := startPipeline(c, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, stages := stageStatuses(t, c, key)
+	jobKey := datastore.NewKey(c, jobKind, "", stages["log"].Job, nil)
+
+	// the job is cancelled just before it would complete, only the cancel
+	// moves the pipeline on
+	if err := closeJob(c, jobKey, jobCancelled, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeJob(c, jobKey, jobCompleted, ""); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	status, stages := stageStatuses(t, c, key)
+	if status.Status != pipelineFailed || stages["log"].Status != stageFailed || stages["count"].Status != stagePending {
+		t.Errorf("expected the log stage to fail got %#v %#v", stages["log"], stages["count"])
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"time"
 
@@ -13,8 +14,6 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/delay"
-	"google.golang.org/appengine/log"
 )
 
 // TODO: use named tasks instead of delay for proper fan-out / fan-in
@@ -26,17 +25,64 @@ type (
 		// query to use and how long the processing should be allowed to run
 		// before being scheduled to continue. It can also initialize any
 		// aggregation collections that it wants to use
-		Start(c context.Context) (*datastore.Query, interface{})
+		Start(c context.Context) (*Query, interface{})
 
 		// Process is called once for each item
 		Process(c context.Context, key *datastore.Key)
 
-		// Complete is called at the end of the processing so that the processor
-		// can write any aggregated values it wants to before the processing is
-		// scheduled to continue (if necessary) or the complete task is done
+		// Complete is called at the end of every slice (each task), not just
+		// at the end of the processing, so that the processor can write any
+		// aggregated values it wants to before the processing is scheduled to
+		// continue (if necessary) or the shard is finished. Anything that
+		// should only happen once belongs in EndShard or EndJob.
 		Complete(c context.Context)
 	}
 
+	// The lifecycle hooks are optional interfaces, returning an error from
+	// any of them fails the task so it's retried
+
+	// JobBeginner is called once when a job starts, before it's split into
+	// shards. Any exported state it sets is copied to every shard.
+	JobBeginner interface {
+		BeginJob(c context.Context) error
+	}
+
+	// ShardBeginner is called at the start of the first slice of each shard,
+	// including shards split off stragglers, for instance so the processor
+	// knows which shard it is to name the files it writes
+	ShardBeginner interface {
+		BeginShard(c context.Context, shard int) error
+	}
+
+	// SliceEnder is called at the end of every slice, after Complete, as a
+	// checkpoint before the shard continues in a new task or finishes
+	SliceEnder interface {
+		EndSlice(c context.Context) error
+	}
+
+	// ShardEnder is called once a shard has processed all of its input,
+	// before its state is saved for merging
+	ShardEnder interface {
+		EndShard(c context.Context) error
+	}
+
+	// JobEnder is called once all the shards of a job have finished, on the
+	// processor of the last shard to finish after the results of the other
+	// shards have been merged into it, and for a Mapper once the values it
+	// emitted have been reduced. It's only called again if it fails, or in
+	// the rare case that recording it was called does.
+	JobEnder interface {
+		EndJob(c context.Context, stats *JobStats) error
+	}
+
+	// Merger is an optional interface for processors that need the results
+	// of every shard when the job finishes. Merge is called on the processor
+	// of the last shard to complete with each of the other shards' final
+	// processors before EndJob is called.
+	Merger interface {
+		Merge(other Processor)
+	}
+
 	// ParamAdapter is a simple interface to avoid coupling the processor structs
 	// to the web framework being used, we can instead provide an adapter to get
 	// any querystring parameters that we need (or pass in URL?)
@@ -49,18 +95,35 @@ type (
 	}
 
 	processorFn func(params ParamAdapter) (Processor, error)
+
+	// entityFunc processes one entity of a slice, which has been loaded
+	// into the slot from Start unless the query is keys only
+	entityFunc func(c context.Context, key *datastore.Key) error
+
+	// sliceStats are the counts from a slice that are added to its shard,
+	// contended entities were skipped as their transactions kept failing
+	sliceStats struct {
+		Processed int64
+		Contended int64
+	}
 )
 
 var (
-	processFunc *delay.Function
+	// how long each task processes for before continuing in a new one
+	sliceTimeout = time.Duration(5) * time.Minute
+
+	processFunc *taskFunc
 	processors = make(map[string]processorFn)
 )
 
 func init() {
 	// created in init because it's called inside the function itself
-	processFunc = delay.Func("process", process)
+	processFunc = newTaskFunc("process", process)
 
 	// complete endpoint will be something like "/_ah/cron/process/logPhotos"
+	// with an optional "shards=8" to split the input into key ranges, or
+	// property ranges for a PropertyRanger ("split=sample" splits those by
+	// a sample of the values instead of into equal intervals)
 	cron.Get("/process/:name", processHandler)
 }
 
@@ -71,12 +134,16 @@ func init() {
 // processor, not the processor itself
 func registerProcessor(fn processorFn) {
 	processor, _ := fn(nil)
-	name := fmt.Sprintf("%T", processor)
-	name = name[strings.LastIndex(name, ".")+1:len(name)]
-	processors[name] = fn
+	processors[processorName(processor)] = fn
 	gob.Register(processor)
 }
 
+// processorName is the name a processor is registered as
+func processorName(processor Processor) string {
+	name := fmt.Sprintf("%T", processor)
+	return name[strings.LastIndex(name, ".")+1:len(name)]
+}
+
 // Adapter for echo to get params
 func newEchoParamAdapter(c *echo.Context) ParamAdapter {
 	return &echoParamAdapter{c}
@@ -103,63 +170,239 @@ func processHandler(c *echo.Context) error {
 		log.Errorf(ctx, "error %s", err.Error())
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	processFunc.Call(ctx, processor, "")
+
+	opts, err := newJobOptions(paramAdapter)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// a backfill runs a job for each day, week or month of the window
+	if paramAdapter.Get("backfill") != "" {
+		return backfillHandler(c, processor, opts)
+	}
+	if _, err := startJob(ctx, processor, opts); err != nil {
+		log.Errorf(ctx, "start job error %s", err.Error())
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
 
 	return c.NoContent(http.StatusOK)
 }
 
-func process(c context.Context, processor Processor, start string) error {
+func process(c context.Context, processor Processor, task *shardTask) (err error) {
+	// a task that keeps failing fails the job instead of retrying forever
+	defer func(c context.Context) { err = failTask(c, task.Job, err) }(c)
+
 	// use the full 10 minutes allowed (assuming front-end instance type)
 	c, _ = context.WithTimeout(c, time.Duration(10) * time.Minute)
 
+	// the job may have been cancelled or failed since the task was queued
+	j := new(job)
+	if err := getDatastore(c).Get(c, task.Job, j); err != nil {
+		log.Errorf(c, "get job error %s", err.Error())
+		return err
+	}
+	if j.closed() {
+		log.Infof(c, "job %d is %s, stopping shard %d", task.Job.IntID(), j.Status, task.Shard)
+		return nil
+	}
+
+	// a shard begins with its first slice, the range it keeps when it's
+	// split starts again without a cursor
+	if b, ok := processor.(ShardBeginner); ok && task.Slice == 0 {
+		if err := b.BeginShard(c, task.Shard); err != nil {
+			log.Errorf(c, "begin shard error %s", err.Error())
+			return err
+		}
+	}
+
+	// a mapper's Process can emit values through the context
+	var em *emitter
+	if _, ok := processor.(Mapper); ok {
+		em = new(emitter)
+		c = withEmitter(c, em)
+	}
+
 	// get the query to iterate and the entity slot to load (could be nill for keys_only)
 	q, e := processor.Start(c)
+	if task.Range != nil {
+		q = task.Range.Filter(q)
+	}
+	// time out after 5 minutes, checked against the clock rather than a
+	// timer so a slice always ends once the time is up
+	deadline := time.Now().Add(sliceTimeout)
+
+	// merged sub-queries are read together rather than as a single query,
+	// and a namespace shard runs the query in each namespace, either way a
+	// panic processing an entity doesn't crash the task
+	stats := new(sliceStats)
+	fn := isolatePanics(entityProcessor(processor, e, stats), task, j.OnPanic)
+	var cursor string
+	var last *datastore.Key
+	if m, ok := task.Range.(*MergedQueries); ok {
+		cursor, stats.Processed, last, err = m.run(c, fn, q, e, task.Cursor, deadline)
+	} else if n, ok := task.Range.(*NamespaceShard); ok {
+		cursor, stats.Processed, last, err = n.run(c, fn, q, e, task.Cursor, deadline)
+	} else {
+		cursor, stats.Processed, last, err = runQuery(c, fn, q, e, task.Range, task.Cursor, deadline)
+	}
+	if err == nil {
+		// let the processor write any aggregation entries / tasks etc...
+		err = completeSlice(c, processor, task)
+	}
+	if err == errJobAborted {
+		log.Infof(c, "job %d failed because of panics, stopping shard %d", task.Job.IntID(), task.Shard)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	var cursor *datastore.Cursor
-	if start != "" {
-		newCursor, err := datastore.DecodeCursor(start)
+	if s, ok := processor.(SliceEnder); ok {
+		if err := s.EndSlice(c); err != nil {
+			log.Errorf(c, "end slice error %s", err.Error())
+			return err
+		}
+	}
+	if em != nil {
+		if err := em.flush(c, task); err != nil {
+			log.Errorf(c, "store emitted values error %s", err.Error())
+			return err
+		}
+	}
+
+	// if we didn't complete everything then continue from the cursor
+	if cursor != "" {
+		next := *task
+		next.Slice++
+		next.Cursor = cursor
+		rebalance, err := updateShard(c, &next, stats)
 		if err != nil {
-			log.Errorf(c, "get start cursor error %s", err.Error())
+			log.Errorf(c, "update shard error %s", err.Error())
+			return err
+		}
+		if rebalance {
+			// the shard carries on with what it keeps whether or not it
+			// could be split, from the start of it if it was
+			if next.Range, err = splitShard(c, task, last); err != nil {
+				log.Warningf(c, "split shard error %s", err.Error())
+				next.Range = task.Range
+			}
+			if next.Range != task.Range {
+				next.Cursor = ""
+			}
+		}
+		if err := rebalanceJob(c, task.Job); err != nil {
+			log.Warningf(c, "rebalance job error %s", err.Error())
+		}
+		// the task is retried if the shard can't continue as it would be
+		// left waiting for a slice that never runs
+		if err := processFunc.Call(c, processor, &next); err != nil {
+			log.Errorf(c, "continue shard error %s", err.Error())
 			return err
 		}
-		cursor = &newCursor
+		return nil
 	}
 
-	// signal a timeout after 5 minutes
-	timeout := make(chan bool, 1)
-	timer := time.AfterFunc(time.Duration(5)*time.Minute, func(){
-		timeout <- true
-	})
-	defer timer.Stop()
+	if s, ok := processor.(ShardEnder); ok {
+		if err := s.EndShard(c); err != nil {
+			log.Errorf(c, "end shard error %s", err.Error())
+			return err
+		}
+	}
+	return finishShard(c, processor, task, stats)
+}
 
-	// TODO: error handling to retry
-Loop:
-	for {
-		// check if we've timed out or whether to keep going
-		select {
-			case <- timeout:
-				break Loop
-			default:
+// entityProcessor returns the function that processes each entity of a
+// slice, in a transaction for a Transactional processor
+func entityProcessor(processor Processor, e interface{}, stats *sliceStats) entityFunc {
+	if t, ok := processor.(Transactional); ok && t.Transactional() {
+		return func(c context.Context, key *datastore.Key) error {
+			contended, err := processInTransaction(c, t, key, e)
+			if contended {
+				stats.Contended++
+			}
+			return err
 		}
+	}
+	return func(c context.Context, key *datastore.Key) error {
+		processor.Process(c, key)
+		return nil
+	}
+}
+
+// runQuery processes the results of the query from the cursor in batches
+// until there are no more or the deadline has passed. It returns the cursor
+// to continue from, which is empty once the query is finished, with the
+// number processed and the last key.
+func runQuery(c context.Context, fn entityFunc, q *Query, e interface{}, input ShardInput, cursor string, deadline time.Time) (string, int64, *datastore.Key, error) {
+	sub, _ := input.(*SubQuery)
+	// a property range kept by a split shard starts with the entities it
+	// already processed that have the same value as the last one
+	after, _ := input.(*PropertyRange)
+	if after != nil && (after.After == nil || cursor != "") {
+		after = nil
+	}
+	// a projected entity only has some of its properties so sub-queries
+	// load the whole entity to check it against the others
+	loaded := e
+	if q.keysOnly || len(q.projection) > 0 {
+		loaded = nil
+	}
+	var total int64
+	var last *datastore.Key
 
+	for {
 		processed := 0
 
-		if cursor != nil {
-			q = q.Start(*cursor)
+		if cursor != "" {
+			q = q.Start(cursor)
 		}
-		it := q.Run(c)
+		// errors reading the results resume from the last one
+		it := runResuming(c, q)
 		for {
+			resetEntity(e)
 			key, err := it.Next(e)
 			if err == datastore.Done {
 				break
 			}
 			if err != nil {
 				log.Errorf(c, "get key error %s", err.Error())
-				return err
+				return "", 0, nil, err
 			}
-
-			processor.Process(c, key)
 			processed++
+			last = key
+
+			if after != nil {
+				done, err := after.processed(c, key, loaded)
+				if err != nil {
+					log.Errorf(c, "check property range error %s", err.Error())
+					return "", 0, nil, err
+				}
+				if done {
+					continue
+				}
+				after = nil
+			}
+
+			// entities an earlier sub-query matches are processed by its shard
+			if sub != nil {
+				dup, err := sub.duplicate(c, key, loaded)
+				if err != nil {
+					log.Errorf(c, "check sub-query error %s", err.Error())
+					return "", 0, nil, err
+				}
+				if dup {
+					continue
+				}
+			}
+
+			if err := fn(c, key); err != nil {
+				log.Errorf(c, "process %s error %s", key.String(), err.Error())
+				return "", 0, nil, err
+			}
+			total++
 		}
 
 		// did we process any?
@@ -167,23 +410,42 @@ Loop:
 			newCursor, err := it.Cursor()
 			if err != nil {
 				log.Errorf(c, "get next cursor error %s", err.Error())
-				return err
+				return "", 0, nil, err
 			}
-			cursor = &newCursor
+			cursor = newCursor
 		} else {
 			// otherwise we're finished
-			cursor = nil
-			break
+			return "", total, last, nil
 		}
-	}
 
-	// let the processor write any aggregation entries / tasks etc...
-	processor.Complete(c)
+		// check if we've timed out or whether to keep going
+		if !time.Now().Before(deadline) {
+			return cursor, total, last, nil
+		}
+	}
+}
 
-	// if we didn't complete everything then continue from the cursor
-	if cursor != nil {
-		processFunc.Call(c, processor, cursor.String())
+// resetEntity clears the entity slot before the next result is loaded into
+// it, so nothing is left from the last one when a projection only sets some
+// of the properties or a property list would be appended to
+func resetEntity(e interface{}) {
+	if pl, ok := e.(*datastore.PropertyList); ok {
+		*pl = (*pl)[:0]
+		return
+	}
+	if v := reflect.ValueOf(e); v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Kind() == reflect.Struct {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
 	}
+}
 
-	return nil
+// entityProperties returns the properties of an entity that was loaded,
+// or gets it if the entity is nil because the query was keys only or a
+// projection
+func entityProperties(c context.Context, key *datastore.Key, e interface{}) (datastore.PropertyList, error) {
+	if e == nil {
+		var props datastore.PropertyList
+		err := getDatastore(c).Get(c, key, &props)
+		return props, err
+	}
+	return saveEntity(e)
 }
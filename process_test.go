@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func countKind(t *testing.T, c context.Context, kind string) int {
+	keys, err := getAllKeys(c, NewQuery(kind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(keys)
+}
+
+func TestDeleteEntities(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	if _, err := newDeleteEntities(params{"kind": "photo"}); err == nil {
+		t.Errorf("expected error deleting without filters")
+	}
+
+	// without confirmation it's a dry-run, which logs the total of every
+	// shard when the job ends
+	logged := []string{}
+	lc := withLog(c, func(level, message string) {
+		logged = append(logged, message)
+	})
+	p, err := newDeleteEntities(params{"kind": "photo", "filters": "photographer.id=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runShards(t, lc, tasks, p, 2)
+	if n := countKind(t, c, "photo"); n != 10 {
+		t.Errorf("dry-run expected 10 photos got %d", n)
+	}
+	found := false
+	for _, message := range logged {
+		found = found || message == "dry-run: would delete 3 photo entities"
+	}
+	if !found {
+		t.Errorf("expected the dry-run total logged got %v", logged)
+	}
+
+	p, _ = newDeleteEntities(params{"kind": "photo", "filters": "taken<2015-01-05", "confirm": "photo"})
+	runProcessor(t, c, tasks, p)
+	if n := countKind(t, c, "photo"); n != 6 {
+		t.Errorf("expected 6 photos left got %d", n)
+	}
+
+	tombstones := []*tombstone{}
+	it := getDatastore(c).Run(c, NewQuery("tombstone").Order("key"))
+	for {
+		ts := new(tombstone)
+		if _, err := it.Next(ts); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		tombstones = append(tombstones, ts)
+	}
+	if len(tombstones) != 4 || tombstones[0].Key.IntID() != 1 || tombstones[3].Key.IntID() != 4 {
+		t.Errorf("expected tombstones for photos 1-4 got %d", len(tombstones))
+	}
+}
+
+// failingDeleteStore fails deleting entities of the kind
+type failingDeleteStore struct {
+	*memoryStore
+	kind string
+}
+
+func (s *failingDeleteStore) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	if len(keys) > 0 && keys[0].Kind() == s.kind {
+		return errors.New("delete failed")
+	}
+	return s.memoryStore.DeleteMulti(c, keys)
+}
+
+func TestDeleteEntitiesError(t *testing.T) {
+	c, store, _ := newTestContext(t)
+	putPhotos(t, c, 10)
+	fc := withDatastore(c, &failingDeleteStore{memoryStore: store, kind: "photo"})
+
+	// the slice fails without leaving tombstones for what wasn't deleted
+	p, _ := newDeleteEntities(params{"kind": "photo", "filters": "taken<2015-01-05", "confirm": "photo"})
+	key, err := startJob(fc, p, &jobOptions{Shards: 1, Split: splitEven})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process(fc, p, &shardTask{Job: key}); err == nil {
+		t.Errorf("expected delete error")
+	}
+	if n := countKind(t, c, "tombstone"); n != 0 {
+		t.Errorf("expected no tombstones got %d", n)
+	}
+
+	// retried it deletes them
+	p, _ = newDeleteEntities(params{"kind": "photo", "filters": "taken<2015-01-05", "confirm": "photo"})
+	if err := process(c, p, &shardTask{Job: key}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKind(t, c, "photo"); n != 6 {
+		t.Errorf("expected 6 photos left got %d", n)
+	}
+	if n := countKind(t, c, "tombstone"); n != 4 {
+		t.Errorf("expected 4 tombstones got %d", n)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []string{"ndjson", "csv"} {
+		c, _, tasks := newTestContext(t)
+		putPhotos(t, c, 25)
+		dir, err := os.MkdirTemp("", "export")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// a quoted csv field can have newlines in it
+		eight := datastore.NewKey(c, "photo", "", 8, nil)
+		photo := new(Photo)
+		if err := getDatastore(c).Get(c, eight, photo); err != nil {
+			t.Fatal(err)
+		}
+		photo.Photographer.Name = "Ms \"Sony\",\nof Tokyo"
+		if _, err := getDatastore(c).Put(c, eight, photo); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := newExportEntities(params{"kind": "photo", "format": format, "dest": dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runProcessor(t, c, tasks, p)
+		name := p.(*exportEntities).Name
+
+		f, err := os.Open(filepath.Join(dir, name, "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest := new(exportManifest)
+		err = json.NewDecoder(f).Decode(manifest)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Files) != 1 || manifest.Files[0].Rows != 25 {
+			t.Fatalf("%s expected 1 file with 25 rows got %#v", format, manifest.Files)
+		}
+
+		lines := 0
+		f, _ = os.Open(filepath.Join(dir, manifest.Files[0].Name))
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			lines++
+		}
+		f.Close()
+		if format == "csv" {
+			// the header and the newline in photo 8
+			lines -= 2
+		}
+		if lines != 25 {
+			t.Errorf("%s expected 25 rows got %d", format, lines)
+		}
+
+		// import into an empty datastore using several shards per file
+		ic, store, itasks := newTestContext(t)
+		sink, _ := newBlobSink(ic, dir)
+		blobs, _ := sink.List(ic, name+"/")
+		for _, r := range splitBlobs(blobs, "", 4) {
+			importFunc.Call(ic, &importJob{Kind: "photo", Source: dir}, r)
+		}
+		runTasks(t, ic, itasks)
+		// importing again mustn't create duplicates
+		for _, r := range splitBlobs(blobs, "", 3) {
+			importFunc.Call(ic, &importJob{Kind: "photo", Source: dir}, r)
+		}
+		runTasks(t, ic, itasks)
+
+		if n := countKind(t, ic, "photo"); n != 25 {
+			t.Errorf("%s expected 25 imported photos got %d", format, n)
+		}
+		photo = new(Photo)
+		if err := store.Get(ic, datastore.NewKey(ic, "photo", "", 7, nil), photo); err != nil {
+			t.Fatal(err)
+		}
+		if photo.Photographer.Name != "Mrs Pentax" || !photo.Taken.Equal(time.Date(2015, 1, 7, 12, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s photo 7 not imported correctly %#v", format, photo)
+		}
+		if err := store.Get(ic, datastore.NewKey(ic, "photo", "", 8, nil), photo); err != nil {
+			t.Fatal(err)
+		}
+		if photo.Photographer.Name != "Ms \"Sony\",\nof Tokyo" {
+			t.Errorf("%s photo 8 not imported correctly %q", format, photo.Photographer.Name)
+		}
+	}
+}
+
+func TestImportBadRows(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	dir, err := os.MkdirTemp("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the import stops once there are too many bad rows to be a mistake
+	rows := []string{`{"id": 1, "taken": "2015-01-01T00:00:00Z"}`}
+	for i := 0; i <= maxBadRows; i++ {
+		rows = append(rows, "not json")
+	}
+	rows = append(rows, `{"id": 2, "taken": "2015-01-02T00:00:00Z"}`)
+	data := []byte(strings.Join(rows, "\n") + "\n")
+	if err := os.WriteFile(filepath.Join(dir, "photos.ndjson"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &byteRange{File: "photos.ndjson", Format: "ndjson", End: int64(len(data))}
+	if err := importFunc.Call(c, &importJob{Kind: "photo", Source: dir}, r); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	if n := countKind(t, c, "photo"); n != 1 {
+		t.Errorf("expected only the photo before the bad rows imported got %d", n)
+	}
+}
+
+func TestExportUnregisteredCSV(t *testing.T) {
+	// the columns of a kind without a type could differ between shards
+	if _, err := newExportEntities(params{"kind": "note", "format": "csv"}); err == nil {
+		t.Errorf("expected error exporting an unregistered kind as csv")
+	}
+	if _, err := newExportEntities(params{"kind": "note"}); err != nil {
+		t.Errorf("expected an unregistered kind exported as ndjson got %v", err)
+	}
+}
+
+func TestExportError(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	putPhotos(t, c, 5)
+
+	// the destination is a file so nothing can be created in it
+	f, err := os.CreateTemp("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	p, err := newExportEntities(params{"kind": "photo", "dest": f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := startJob(c, p, &jobOptions{Shards: 1, Split: splitEven})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process(c, p, &shardTask{Job: key}); err == nil {
+		t.Errorf("expected export error")
+	}
+
+	// exports started together are written to different folders
+	other, _ := newExportEntities(params{"kind": "photo", "dest": f.Name()})
+	if p.(*exportEntities).Name == other.(*exportEntities).Name {
+		t.Errorf("expected different export names got %s", p.(*exportEntities).Name)
+	}
+}
+func TestShardedJob(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 100)
+	dir, err := os.MkdirTemp("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, _ := newExportEntities(params{"kind": "photo", "format": "csv", "dest": dir})
+	key := runShards(t, c, tasks, p, 4)
+
+	j := new(job)
+	if err := getDatastore(c).Get(c, key, j); err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != jobCompleted || j.Shards != 4 || j.Active != 0 || j.Processor != "exportEntities" {
+		t.Errorf("expected completed job with 4 shards got %#v", j)
+	}
+	it := getDatastore(c).Run(c, NewQuery(shardKind).Ancestor(key))
+	var processed int64
+	for {
+		s := new(shard)
+		if _, err := it.Next(s); err == datastore.Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if s.Status != shardComplete || s.Processed != 25 {
+			t.Errorf("expected completed shard with 25 processed got %s %d", s.Status, s.Processed)
+		}
+		processed += s.Processed
+	}
+	if processed != 100 {
+		t.Errorf("expected 100 processed got %d", processed)
+	}
+
+	// the manifest is written once with every shard's file
+	name := p.(*exportEntities).Name
+	f, err := os.Open(filepath.Join(dir, name, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := new(exportManifest)
+	err = json.NewDecoder(f).Decode(manifest)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 4 {
+		t.Fatalf("expected 4 files got %#v", manifest.Files)
+	}
+	if columns, _ := columns("photo"); !reflect.DeepEqual(manifest.Columns, columns) {
+		t.Errorf("expected the photo columns got %v", manifest.Columns)
+	}
+	for i, file := range manifest.Files {
+		if file.Name != fmt.Sprintf("%s/shard-%04d.csv", name, i) || file.Rows != 25 {
+			t.Errorf("expected shard %d with 25 rows got %#v", i, file)
+		}
+	}
+
+	ic, _, itasks := newTestContext(t)
+	sink, _ := newBlobSink(ic, dir)
+	blobs, _ := sink.List(ic, name+"/")
+	for _, r := range splitBlobs(blobs, "", 2) {
+		importFunc.Call(ic, &importJob{Kind: "photo", Source: dir}, r)
+	}
+	runTasks(t, ic, itasks)
+	if n := countKind(t, ic, "photo"); n != 100 {
+		t.Errorf("expected 100 imported photos got %d", n)
+	}
+
+	// deleting in shards
+	p, _ = newDeleteEntities(params{"kind": "photo", "all": "true", "confirm": "photo"})
+	runShards(t, c, tasks, p, 3)
+	if n := countKind(t, c, "photo"); n != 0 {
+		t.Errorf("expected all photos deleted got %d", n)
+	}
+
+	// inequality filters can't be combined with key ranges
+	p, _ = newDeleteEntities(params{"kind": "photo", "filters": "taken<2015-01-05"})
+	if _, err := startJob(c, p, &jobOptions{Shards: 2, Split: splitEven}); err == nil {
+		t.Errorf("expected error sharding a query with an inequality filter")
+	}
+	if _, err := startJob(c, p, &jobOptions{Shards: 0, Split: splitEven}); err == nil {
+		t.Errorf("expected error starting a job with no shards")
+	}
+	if _, err := newJobOptions(params{"shards": "2", "split": "random"}); err == nil {
+		t.Errorf("expected error for an unknown split")
+	}
+}
+
+func TestPropertyRangeShardedJob(t *testing.T) {
+	for _, split := range []string{splitEven, splitSample} {
+		c, _, tasks := newTestContext(t)
+		putPhotos(t, c, 100)
+
+		// photos are one per day so there are 59 in January and February
+		p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2015-03-01"})
+		key, err := startJob(c, p, &jobOptions{Shards: 4, Split: split})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, c, tasks)
+
+		j := new(job)
+		if err := getDatastore(c).Get(c, key, j); err != nil {
+			t.Fatal(err)
+		}
+		if j.Status != jobCompleted || j.Shards != 4 {
+			t.Errorf("%s expected completed job with 4 shards got %#v", split, j)
+		}
+		it := getDatastore(c).Run(c, NewQuery(shardKind).Ancestor(key))
+		var processed int64
+		for {
+			s := new(shard)
+			if _, err := it.Next(s); err == datastore.Done {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			r := new(PropertyRange)
+			if err := json.Unmarshal([]byte(s.Range), r); err != nil {
+				t.Errorf("%s shard range %s %s", split, s.Range, err)
+			}
+			if s.Processed == 0 || s.Processed > 20 {
+				t.Errorf("%s expected about 15 processed by a shard got %d", split, s.Processed)
+			}
+			processed += s.Processed
+		}
+		if processed != 59 {
+			t.Errorf("%s expected 59 processed got %d", split, processed)
+		}
+	}
+}
+
+func TestProjectionJob(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	logged := []string{}
+	c = withLog(c, func(level, message string) {
+		logged = append(logged, message)
+	})
+	putPhotos(t, c, 40)
+
+	// the photographer is all that's loaded from the projection
+	p, _ := newAggregatePhotos(params{"from": "2015-01-01", "to": "2015-02-01"})
+	key := runShards(t, c, tasks, p, 2)
+	if n := jobProcessed(t, c, key); n != 31 {
+		t.Errorf("expected 31 processed got %d", n)
+	}
+	expected := map[string]bool{
+		"photographer 1 took 8": true,
+		"photographer 2 took 8": true,
+		"photographer 3 took 8": true,
+		"photographer 4 took 7": true,
+	}
+	for _, message := range logged {
+		delete(expected, message)
+	}
+	if len(expected) != 0 {
+		t.Errorf("expected counts weren't logged %v", expected)
+	}
+}
+
+// projectedList records how many properties were loaded into its property
+// list for each photo of a projection of the property
+type projectedList struct {
+	Property string
+	entity   datastore.PropertyList
+}
+
+var projectedSizes []int
+
+func init() {
+	gob.Register(new(projectedList))
+}
+
+func (x *projectedList) Start(c context.Context) (*Query, interface{}) {
+	return NewQuery("photo").Project(x.Property).Limit(5), &x.entity
+}
+
+func (x *projectedList) Process(c context.Context, key *datastore.Key) {
+	projectedSizes = append(projectedSizes, len(x.entity))
+}
+
+func (x *projectedList) Complete(c context.Context) {}
+
+func TestProjectionPropertyList(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 12)
+
+	// the list is reset for each photo rather than appended to
+	projectedSizes = nil
+	runShards(t, c, tasks, &projectedList{Property: "taken"}, 1)
+	if len(projectedSizes) != 12 {
+		t.Fatalf("expected 12 processed got %d", len(projectedSizes))
+	}
+	for i, n := range projectedSizes {
+		if n != 1 {
+			t.Errorf("expected photo %d to have only the projected property got %d", i, n)
+		}
+	}
+}
+
+func TestFindStragglers(t *testing.T) {
+	now := time.Now().UTC()
+	started := now.Add(-10 * time.Minute)
+	done := func(d time.Duration, processed int64) *shard {
+		return &shard{Status: shardComplete, Processed: processed, Slices: 2, Started: started, Updated: started.Add(d)}
+	}
+	running := func(processed int64, slices int) *shard {
+		return &shard{Status: shardRunning, Processed: processed, Slices: slices, Started: started, Updated: now}
+	}
+
+	tests := []struct {
+		name       string
+		shards     []*shard
+		stragglers []int
+	}{
+		{"none complete", []*shard{running(10, 1), running(1, 1)}, []int{}},
+		{"too few complete", []*shard{done(2*time.Minute, 100), running(10, 1), running(10, 1)}, []int{}},
+		{"slow", []*shard{done(4*time.Minute, 100), done(6*time.Minute, 100), running(10, 1), running(90, 9)}, []int{2}},
+		{"bigger than the rest", []*shard{done(4*time.Minute, 100), done(6*time.Minute, 100), running(400, 2)}, []int{2}},
+		{"nothing processed", []*shard{done(4*time.Minute, 100), done(6*time.Minute, 100), running(0, 0)}, []int{2}},
+		{"within the median", []*shard{done(20*time.Minute, 100), done(30*time.Minute, 100), running(10, 1)}, []int{}},
+		{"already flagged", []*shard{done(4*time.Minute, 100), done(6*time.Minute, 100), {Status: shardRunning, Rebalance: true, Started: started}}, []int{}},
+		{"recently split", []*shard{done(4*time.Minute, 100), done(6*time.Minute, 100), {Status: shardRunning, Processed: 10, Slices: 1, Started: started, Rebalanced: now.Add(-30 * time.Second)}}, []int{}},
+	}
+	for _, test := range tests {
+		got := findStragglers(test.shards, now)
+		if len(got) != len(test.stragglers) || (len(got) > 0 && !reflect.DeepEqual(got, test.stragglers)) {
+			t.Errorf("%s expected stragglers %v got %v", test.name, test.stragglers, got)
+		}
+	}
+}
+
+func TestRebalanceShard(t *testing.T) {
+	dir, err := os.MkdirTemp("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		processor func() Processor
+		processed int64
+	}{
+		{"key range", func() Processor {
+			p, _ := newExportEntities(params{"kind": "photo", "format": "ndjson", "dest": dir})
+			return p
+		}, 1000},
+		{"property range", func() Processor {
+			p, _ := newLogPhotos(params{"from": "2015-01-01", "to": "2017-01-01"})
+			return p
+		}, 731},
+	}
+	for _, test := range tests {
+		c, _, tasks := newTestContext(t)
+		putPhotos(t, c, 1000)
+
+		key, err := startJob(c, test.processor(), &jobOptions{Shards: 2, Split: splitEven})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// flag the first shard as a straggler before it starts
+		ds := getDatastore(c)
+		s := new(shard)
+		if err := ds.Get(c, shardKey(c, key, 0), s); err != nil {
+			t.Fatal(err)
+		}
+		s.Rebalance = true
+		if _, err := ds.Put(c, shardKey(c, key, 0), s); err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, c, tasks)
+
+		j := new(job)
+		if err := ds.Get(c, key, j); err != nil {
+			t.Fatal(err)
+		}
+		if j.Status != jobCompleted || j.Shards != 3 || j.Active != 0 {
+			t.Errorf("%s expected completed job with 3 shards got %#v", test.name, j)
+		}
+		it := ds.Run(c, NewQuery(shardKind).Ancestor(key))
+		var processed int64
+		for {
+			s := new(shard)
+			if _, err := it.Next(s); err == datastore.Done {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if s.Status != shardComplete || s.Processed == 0 || s.Rebalance {
+				t.Errorf("%s expected completed shard got %#v", test.name, s)
+			}
+			processed += s.Processed
+		}
+		if processed != test.processed {
+			t.Errorf("%s expected %d processed got %d", test.name, test.processed, processed)
+		}
+	}
+}
+
+// hookPhotos counts the lifecycle hooks it sees, the counts are exported
+// so they're carried between slices and merged from every shard
+type hookPhotos struct {
+	Jobs      int
+	Shards    int
+	Slices    int
+	ShardEnds int
+	Processed int64
+}
+
+// the processors and stats that EndJob was called with
+var (
+	endedJobs  []*hookPhotos
+	endedStats []*JobStats
+)
+
+func init() {
+	registerProcessor(func(params ParamAdapter) (Processor, error) {
+		return new(hookPhotos), nil
+	})
+}
+
+func (x *hookPhotos) Start(c context.Context) (*Query, interface{}) {
+	return NewQuery("photo").Limit(10).KeysOnly(), nil
+}
+
+func (x *hookPhotos) Process(c context.Context, key *datastore.Key) {
+	x.Processed++
+}
+
+func (x *hookPhotos) Complete(c context.Context) {}
+
+func (x *hookPhotos) BeginJob(c context.Context) error {
+	x.Jobs++
+	return nil
+}
+
+func (x *hookPhotos) BeginShard(c context.Context, shard int) error {
+	x.Shards++
+	return nil
+}
+
+func (x *hookPhotos) EndSlice(c context.Context) error {
+	x.Slices++
+	return nil
+}
+
+func (x *hookPhotos) EndShard(c context.Context) error {
+	x.ShardEnds++
+	return nil
+}
+
+func (x *hookPhotos) Merge(other Processor) {
+	o := other.(*hookPhotos)
+	x.Shards += o.Shards
+	x.Slices += o.Slices
+	x.ShardEnds += o.ShardEnds
+	x.Processed += o.Processed
+}
+
+func (x *hookPhotos) EndJob(c context.Context, stats *JobStats) error {
+	endedJobs = append(endedJobs, x)
+	endedStats = append(endedStats, stats)
+	return nil
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 100)
+	endedJobs, endedStats = nil, nil
+
+	key := runShards(t, c, tasks, new(hookPhotos), 4)
+	if len(endedJobs) != 1 {
+		t.Fatalf("expected EndJob to be called once got %d", len(endedJobs))
+	}
+	x, stats := endedJobs[0], endedStats[0]
+	if x.Jobs != 1 || x.Shards != 4 || x.ShardEnds != 4 || x.Processed != 100 {
+		t.Errorf("expected 1 job, 4 shards and 100 processed got %#v", x)
+	}
+	if stats.Job != key.IntID() || stats.Processor != "hookPhotos" || stats.Shards != 4 || stats.Processed != 100 {
+		t.Errorf("expected stats for 4 shards and 100 processed got %#v", stats)
+	}
+	// every slice is a checkpoint, each shard of 25 takes 3 slices of 10
+	// and one that finds nothing left
+	if x.Slices != stats.Slices || stats.Slices != 16 {
+		t.Errorf("expected 16 slices got %d ended and %d in the stats", x.Slices, stats.Slices)
+	}
+	if stats.Finished.Before(stats.Started) {
+		t.Errorf("expected the job to finish after it started got %#v", stats)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// PropertyRange represents a range of values of an int64, float64 or
+	// time.Time property, such as the time window a processor works on.
+	// Start and End must be set and be the same type. It can be encoded as
+	// json or gob so it can be used as the input for a shard. A range kept
+	// by a shard that was split starts at the value of the last entity it
+	// processed, those with that value up to the After key were processed.
+	PropertyRange struct {
+		Property     string
+		Start        interface{}
+		IncludeStart bool
+		End          interface{}
+		IncludeEnd   bool
+		After        *datastore.Key
+	}
+
+	// PropertyRanger is an optional interface for processors whose query is
+	// restricted to a range of a property (and ordered by it) so that the
+	// range can be split into shards instead of the keys
+	PropertyRanger interface {
+		PropertyRange() *PropertyRange
+	}
+
+	// propertyRangeJSON is the json form of a PropertyRange, the type is
+	// needed to decode the values
+	propertyRangeJSON struct {
+		Property     string          `json:"property"`
+		Type         string          `json:"type"`
+		Start        json.RawMessage `json:"start"`
+		IncludeStart bool            `json:"include_start"`
+		End          json.RawMessage `json:"end"`
+		IncludeEnd   bool            `json:"include_end"`
+		After        *datastore.Key  `json:"after,omitempty"`
+	}
+
+	byValue []interface{}
+)
+
+func init() {
+	// so time values can be sent in tasks
+	gob.Register(time.Time{})
+}
+
+func (s byValue) Len() int           { return len(s) }
+func (s byValue) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byValue) Less(i, j int) bool { return compareValues(s[i], s[j]) < 0 }
+
+// NewPropertyRange creates a range from start up to but not including end
+func NewPropertyRange(property string, start, end interface{}) (*PropertyRange, error) {
+	r := &PropertyRange{
+		Property:     property,
+		Start:        start,
+		IncludeStart: true,
+		End:          end,
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *PropertyRange) validate() error {
+	if r.Property == "" {
+		return fmt.Errorf("property range needs a property")
+	}
+	if rangeType(r.Start) == "" || rangeType(r.Start) != rangeType(r.End) {
+		return fmt.Errorf("property range for %s must be int64, float64 or time.Time values of the same type", r.Property)
+	}
+	if compareValues(r.Start, r.End) > 0 {
+		return fmt.Errorf("property range start %v is after end %v", r.Start, r.End)
+	}
+	return nil
+}
+
+// rangeType returns the name of the type of a value if it can be used in a
+// property range
+func rangeType(v interface{}) string {
+	switch v.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case time.Time:
+		return "time"
+	}
+	return ""
+}
+
+// Filter restricts a query to the values in the range
+func (r *PropertyRange) Filter(q *Query) *Query {
+	if r.IncludeStart {
+		q = q.Filter(r.Property+" >=", r.Start)
+	} else {
+		q = q.Filter(r.Property+" >", r.Start)
+	}
+	if r.IncludeEnd {
+		q = q.Filter(r.Property+" <=", r.End)
+	} else {
+		q = q.Filter(r.Property+" <", r.End)
+	}
+	return q
+}
+
+// Contains returns whether a value is in the range
+func (r *PropertyRange) Contains(v interface{}) bool {
+	if rangeType(v) != rangeType(r.Start) {
+		return false
+	}
+	start, end := compareValues(v, r.Start), compareValues(v, r.End)
+	return (start > 0 || (start == 0 && r.IncludeStart)) && (end < 0 || (end == 0 && r.IncludeEnd))
+}
+
+// Split splits the range into at most n sub-ranges of equal size, fewer
+// are returned if the values are too close together to split
+func (r *PropertyRange) Split(n int) ([]*PropertyRange, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("n must be >= 1")
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+
+	points := []interface{}{}
+	switch start := r.Start.(type) {
+	case int64:
+		end := r.End.(int64)
+		for i := 1; i < n; i++ {
+			// the distance is worked out as a float so it can't overflow
+			points = append(points, start+int64((float64(end)-float64(start))*float64(i)/float64(n)))
+		}
+	case float64:
+		end := r.End.(float64)
+		for i := 1; i < n; i++ {
+			points = append(points, start+(end-start)*float64(i)/float64(n))
+		}
+	case time.Time:
+		// the datastore only stores times to the microsecond
+		end := r.End.(time.Time)
+		step := end.Sub(start) / time.Duration(n)
+		for i := 1; i < n; i++ {
+			points = append(points, start.Add(step*time.Duration(i)).Truncate(time.Microsecond))
+		}
+	}
+	return r.splitAt(points), nil
+}
+
+// SplitBySample splits the range into at most n sub-ranges with about the
+// same number of entities, using the property values of a sample of the
+// entities of the kind picked with the __scatter__ property. If there are
+// too few samples the range is split evenly instead.
+func (r *PropertyRange) SplitBySample(c context.Context, kind, namespace string, n, oversampling int) ([]*PropertyRange, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("n must be >= 1")
+	}
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	if n == 1 {
+		return []*PropertyRange{r}, nil
+	}
+
+	q := NewQuery(kind).Order("__scatter__").Limit(n * oversampling)
+	if namespace != "" {
+		q = q.Namespace(namespace)
+	}
+	keys, err := getAllKeys(c, q)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]datastore.PropertyList, len(keys))
+	if err := getDatastore(c).GetMulti(c, keys, entities); err != nil {
+		if me, ok := err.(appengine.MultiError); ok {
+			for _, err := range me {
+				// entities deleted since they were sampled are just skipped
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return nil, err
+				}
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	values := []interface{}{}
+	for _, props := range entities {
+		for _, p := range props {
+			if p.Name == r.Property && r.Contains(p.Value) {
+				values = append(values, p.Value)
+			}
+		}
+	}
+	if len(values) < n-1 {
+		log.Debugf(c, "only %d samples of %s.%s so splitting evenly", len(values), kind, r.Property)
+		return r.Split(n)
+	}
+	sort.Sort(byValue(values))
+
+	points := []interface{}{}
+	for i := 1; i < n; i++ {
+		points = append(points, values[len(values)*i/n])
+	}
+	return r.splitAt(points), nil
+}
+
+// SplitRemaining splits what is left of the range after the last key that
+// was processed in two, the tail is nil if it can't be split. The rest of
+// the range starts at the value of the last entity, as the query is in
+// property order, and is split evenly. The range kept starts at the value
+// after the last key, there can't be a filter on both the value and key.
+func (r *PropertyRange) SplitRemaining(c context.Context, last *datastore.Key) (ShardInput, ShardInput, error) {
+	var props datastore.PropertyList
+	if err := getDatastore(c).Get(c, last, &props); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return r, nil, nil
+		}
+		return nil, nil, err
+	}
+	var value interface{}
+	for _, p := range props {
+		if p.Name == r.Property && r.Contains(p.Value) && (value == nil || compareValues(p.Value, value) < 0) {
+			value = p.Value
+		}
+	}
+	if value == nil {
+		return r, nil, nil
+	}
+
+	rest := *r
+	rest.Start = value
+	rest.IncludeStart = true
+	rest.After = nil
+	ranges, err := rest.Split(2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(ranges) < 2 {
+		return r, nil, nil
+	}
+
+	keep := *ranges[0]
+	keep.After = last
+	return &keep, ranges[1], nil
+}
+
+// processed returns whether an entity at the start of the range was
+// processed before the range was split, its value is the start and its key
+// is up to the After key. The entity is loaded if it's nil because the
+// query was keys only or a projection. The results are in property then
+// key order so once one hasn't been processed none of the rest have.
+func (r *PropertyRange) processed(c context.Context, key *datastore.Key, e interface{}) (bool, error) {
+	if r.After == nil || compareKeys(key, r.After) > 0 {
+		return false, nil
+	}
+	props, err := entityProperties(c, key, e)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range props {
+		if p.Name == r.Property && rangeType(p.Value) == rangeType(r.Start) && compareValues(p.Value, r.Start) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// splitAt splits the range at each of the points in order, each point is
+// the start of a sub-range. Points outside the range or the same as the
+// previous one are skipped.
+func (r *PropertyRange) splitAt(points []interface{}) []*PropertyRange {
+	ranges := []*PropertyRange{}
+	current := *r
+	for _, point := range points {
+		if !current.Contains(point) || compareValues(point, current.Start) == 0 {
+			continue
+		}
+		left := current
+		left.End = point
+		left.IncludeEnd = false
+		ranges = append(ranges, &left)
+		current.Start = point
+		current.IncludeStart = true
+	}
+	return append(ranges, &current)
+}
+
+// MarshalJSON encodes the range with the type of the values
+func (r *PropertyRange) MarshalJSON() ([]byte, error) {
+	start, err := json.Marshal(r.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := json.Marshal(r.End)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&propertyRangeJSON{
+		Property:     r.Property,
+		Type:         rangeType(r.Start),
+		Start:        start,
+		IncludeStart: r.IncludeStart,
+		End:          end,
+		IncludeEnd:   r.IncludeEnd,
+		After:        r.After,
+	})
+}
+
+// UnmarshalJSON decodes the range using the type of the values
+func (r *PropertyRange) UnmarshalJSON(data []byte) error {
+	x := new(propertyRangeJSON)
+	if err := json.Unmarshal(data, x); err != nil {
+		return err
+	}
+	decode := func(data json.RawMessage) (interface{}, error) {
+		switch x.Type {
+		case "int":
+			var v int64
+			err := json.Unmarshal(data, &v)
+			return v, err
+		case "float":
+			var v float64
+			err := json.Unmarshal(data, &v)
+			return v, err
+		case "time":
+			var v time.Time
+			err := json.Unmarshal(data, &v)
+			return v, err
+		}
+		return nil, fmt.Errorf("unknown property range type %q", x.Type)
+	}
+
+	var err error
+	r.Property = x.Property
+	r.IncludeStart = x.IncludeStart
+	r.IncludeEnd = x.IncludeEnd
+	r.After = x.After
+	if r.Start, err = decode(x.Start); err != nil {
+		return err
+	}
+	if r.End, err = decode(x.End); err != nil {
+		return err
+	}
+	return r.validate()
+}
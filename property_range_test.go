@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// checkTiled checks that ranges cover r exactly with no gaps or overlaps
+func checkTiled(t *testing.T, r *PropertyRange, ranges []*PropertyRange) {
+	if len(ranges) == 0 {
+		t.Fatalf("no ranges for %#v", r)
+	}
+	first, last := ranges[0], ranges[len(ranges)-1]
+	if compareValues(first.Start, r.Start) != 0 || first.IncludeStart != r.IncludeStart {
+		t.Errorf("expected first range to start at %v got %#v", r.Start, first)
+	}
+	if compareValues(last.End, r.End) != 0 || last.IncludeEnd != r.IncludeEnd {
+		t.Errorf("expected last range to end at %v got %#v", r.End, last)
+	}
+	for i := 1; i < len(ranges); i++ {
+		prev, next := ranges[i-1], ranges[i]
+		if compareValues(prev.End, next.Start) != 0 || prev.IncludeEnd || !next.IncludeStart {
+			t.Errorf("ranges %d and %d don't meet %#v %#v", i-1, i, prev, next)
+		}
+		if compareValues(next.Start, next.End) >= 0 && i < len(ranges)-1 {
+			t.Errorf("range %d is empty %#v", i, next)
+		}
+	}
+}
+
+func TestNewPropertyRange(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		property   string
+		start, end interface{}
+		valid      bool
+	}{
+		{"n", int64(1), int64(2), true},
+		{"n", int64(2), int64(2), true},
+		{"f", 1.5, 2.5, true},
+		{"t", now, now.Add(time.Hour), true},
+		{"", int64(1), int64(2), false},
+		{"n", int64(2), int64(1), false},
+		{"n", int64(1), 2.0, false},
+		{"n", 1, 2, false},
+		{"s", "a", "b", false},
+		{"n", nil, int64(1), false},
+	}
+	for _, test := range tests {
+		r, err := NewPropertyRange(test.property, test.start, test.end)
+		if (err == nil) != test.valid {
+			t.Errorf("%q %v %v expected valid %t got %v", test.property, test.start, test.end, test.valid, err)
+		}
+		if err == nil && (!r.IncludeStart || r.IncludeEnd) {
+			t.Errorf("expected range to include start and exclude end %#v", r)
+		}
+	}
+}
+
+func TestPropertyRangeSplit(t *testing.T) {
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		start, end interface{}
+		n          int
+		points     []interface{}
+	}{
+		{int64(0), int64(100), 4, []interface{}{int64(25), int64(50), int64(75)}},
+		{int64(-10), int64(10), 2, []interface{}{int64(0)}},
+		{int64(0), int64(2), 4, []interface{}{int64(1)}},
+		{int64(5), int64(5), 3, []interface{}{}},
+		{int64(-1 << 63), int64(1<<63 - 1), 2, []interface{}{int64(0)}},
+		{0.0, 1.0, 4, []interface{}{0.25, 0.5, 0.75}},
+		{from, from.AddDate(0, 0, 4), 4, []interface{}{from.AddDate(0, 0, 1), from.AddDate(0, 0, 2), from.AddDate(0, 0, 3)}},
+		{from, from.Add(time.Microsecond), 4, []interface{}{}},
+		{int64(0), int64(100), 1, []interface{}{}},
+	}
+	for _, test := range tests {
+		r, err := NewPropertyRange("p", test.start, test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ranges, err := r.Split(test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkTiled(t, r, ranges)
+		points := []interface{}{}
+		for _, x := range ranges[1:] {
+			points = append(points, x.Start)
+		}
+		if len(points) != len(test.points) {
+			t.Errorf("%v-%v/%d expected points %v got %v", test.start, test.end, test.n, test.points, points)
+			continue
+		}
+		for i := range points {
+			if compareValues(points[i], test.points[i]) != 0 {
+				t.Errorf("%v-%v/%d expected points %v got %v", test.start, test.end, test.n, test.points, points)
+				break
+			}
+		}
+	}
+
+	r, _ := NewPropertyRange("p", int64(0), int64(10))
+	if _, err := r.Split(0); err == nil {
+		t.Errorf("expected error splitting into 0")
+	}
+}
+
+func TestPropertyRangeSplitBySample(t *testing.T) {
+	c, done := newDatastoreContext(t)
+	defer done()
+	ds := getDatastore(c)
+
+	// most of the values are bunched up at the start of the range
+	for i := 0; i < 100; i++ {
+		n := int64(i)
+		if i >= 80 {
+			n = int64(i) * 100
+		}
+		key := datastore.NewKey(c, "sample", "", int64(i+1), nil)
+		if _, err := ds.Put(c, key, &datastore.PropertyList{{Name: "n", Value: n}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, _ := NewPropertyRange("n", int64(0), int64(10000))
+	ranges, err := r.SplitBySample(c, "sample", "", 4, scatterOversampling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 4 {
+		t.Fatalf("expected 4 ranges got %d", len(ranges))
+	}
+	checkTiled(t, r, ranges)
+
+	// every value is sampled so the ranges have the same number of entities
+	for i, x := range ranges {
+		keys, err := getAllKeys(c, x.Filter(NewQuery("sample")).KeysOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 25 {
+			t.Errorf("expected 25 entities in range %d %v-%v got %d", i, x.Start, x.End, len(keys))
+		}
+	}
+
+	// values outside the range aren't used
+	r, _ = NewPropertyRange("n", int64(8000), int64(10000))
+	ranges, err = r.SplitBySample(c, "sample", "", 2, scatterOversampling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTiled(t, r, ranges)
+	if len(ranges) != 2 || ranges[1].Start != int64(9000) {
+		t.Errorf("expected split at 9000 got %#v", ranges)
+	}
+
+	// too few samples falls back to an even split
+	ranges, err = r.SplitBySample(c, "missing", "", 2, scatterOversampling)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 2 || ranges[1].Start != int64(9000) {
+		t.Errorf("expected even split at 9000 got %#v", ranges)
+	}
+}
+
+func TestPropertyRangeSplitRemaining(t *testing.T) {
+	c, done := newDatastoreContext(t)
+	defer done()
+	putPhotos(t, c, 10)
+
+	// another photo taken at the same time as the 3rd comes after it
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	third := from.AddDate(0, 0, 2).Add(12 * time.Hour)
+	if _, err := getDatastore(c).Put(c, datastore.NewKey(c, "photo", "", 11, nil), &Photo{Taken: third}); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := NewPropertyRange("taken", from, from.AddDate(0, 0, 10))
+	q := r.Filter(NewQuery("photo")).Order("taken").KeysOnly()
+	keys, err := getAllKeys(c, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest from the 3rd photo, taken at midday on the 3rd, is split
+	// halfway to the end of the 10th
+	keep, tail, err := r.SplitRemaining(c, keys[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tail == nil {
+		t.Fatalf("expected the rest of %v to be split", r)
+	}
+	mid := time.Date(2015, 1, 7, 6, 0, 0, 0, time.UTC)
+	k, x := keep.(*PropertyRange), tail.(*PropertyRange)
+	if !k.Start.(time.Time).Equal(third) || !k.IncludeStart || !k.End.(time.Time).Equal(mid) || k.IncludeEnd || !k.After.Equal(keys[2]) {
+		t.Errorf("expected to keep from the 3rd photo up to %v got %#v", mid, k)
+	}
+	if !x.Start.(time.Time).Equal(mid) || !x.IncludeStart || !x.End.(time.Time).Equal(r.End.(time.Time)) {
+		t.Errorf("expected the tail from %v got %#v", mid, x)
+	}
+
+	// the range kept is run from its start, skipping the 3rd photo but not
+	// the other one taken at the same time
+	got := []*datastore.Key{}
+	fn := func(c context.Context, key *datastore.Key) error {
+		got = append(got, key)
+		return nil
+	}
+	if _, _, _, err := runQuery(c, fn, k.Filter(NewQuery("photo")).Order("taken").KeysOnly(), nil, k, "", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := getAllKeys(c, x.Filter(NewQuery("photo")).Order("taken").KeysOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(append(got, rest...), keys[3:]) {
+		t.Errorf("expected the rest split in two got %v and %v", got, rest)
+	}
+
+	// entities outside the range or missing can't be split from
+	if keep, tail, err := r.SplitRemaining(c, datastore.NewKey(c, "photo", "", 99, nil)); err != nil || tail != nil || keep != r {
+		t.Errorf("expected no split after a missing photo got %v %v %v", keep, tail, err)
+	}
+	short, _ := NewPropertyRange("taken", from, from.AddDate(0, 0, 1))
+	if _, tail, err := short.SplitRemaining(c, keys[5]); err != nil || tail != nil {
+		t.Errorf("expected no split outside the range got %v %v", tail, err)
+	}
+}
+
+func TestPropertyRangeEncoding(t *testing.T) {
+	from := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	ranges := []*PropertyRange{
+		{Property: "n", Start: int64(1), IncludeStart: true, End: int64(1 << 62)},
+		{Property: "f", Start: 0.5, End: 1.5, IncludeEnd: true},
+		{Property: "taken", Start: from, IncludeStart: true, End: from.AddDate(1, 0, 0)},
+	}
+	for _, r := range ranges {
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromJSON := new(PropertyRange)
+		if err := json.Unmarshal(data, fromJSON); err != nil {
+			t.Fatal(err)
+		}
+
+		// as it's sent in a task, in an interface
+		buf := new(bytes.Buffer)
+		var input ShardInput = r
+		if err := gob.NewEncoder(buf).Encode(&input); err != nil {
+			t.Fatal(err)
+		}
+		var decoded ShardInput
+		if err := gob.NewDecoder(buf).Decode(&decoded); err != nil {
+			t.Fatal(err)
+		}
+		fromGob, ok := decoded.(*PropertyRange)
+		if !ok {
+			t.Fatalf("expected a property range got %#v", decoded)
+		}
+
+		for name, x := range map[string]*PropertyRange{"json": fromJSON, "gob": fromGob} {
+			if reflect.TypeOf(x.Start) != reflect.TypeOf(r.Start) || compareValues(x.Start, r.Start) != 0 || compareValues(x.End, r.End) != 0 ||
+				x.Property != r.Property || x.IncludeStart != r.IncludeStart || x.IncludeEnd != r.IncludeEnd {
+				t.Errorf("%s expected %#v got %#v", name, r, x)
+			}
+		}
+	}
+
+	bad := []string{
+		`{"property":"n","type":"string","start":"a","end":"b"}`,
+		`{"property":"n","type":"int","start":2,"end":1}`,
+		`{"property":"n","type":"int","start":"a","end":1}`,
+	}
+	for _, data := range bad {
+		if err := json.Unmarshal([]byte(data), new(PropertyRange)); err == nil {
+			t.Errorf("expected error decoding %s", data)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// Query mirrors datastore.Query but keeps its settings visible so it can
+	// be run against any Datastore implementation, including the in-memory
+	// one used for testing. Like datastore.Query each method returns a
+	// modified copy and any error is reported when the query is run.
+	Query struct {
+		kind       string
+		namespace  string
+		ancestor   *datastore.Key
+		filters    []filter
+		orders     []order
+		projection []string
+		keysOnly   bool
+		limit      int
+		start      string
+		end        string
+		err        error
+	}
+
+	order struct {
+		Property   string
+		Descending bool
+	}
+)
+
+// NewQuery creates a new query for entities of the kind
+func NewQuery(kind string) *Query {
+	return &Query{kind: kind}
+}
+
+func (q *Query) clone() *Query {
+	x := *q
+	x.filters = append([]filter(nil), q.filters...)
+	x.orders = append([]order(nil), q.orders...)
+	x.projection = append([]string(nil), q.projection...)
+	return &x
+}
+
+// Namespace sets the namespace to query, otherwise the namespace of the
+// context the query is run with is used
+func (q *Query) Namespace(namespace string) *Query {
+	q = q.clone()
+	q.namespace = namespace
+	return q
+}
+
+// Ancestor restricts the query to entities with the ancestor
+func (q *Query) Ancestor(ancestor *datastore.Key) *Query {
+	q = q.clone()
+	if ancestor == nil {
+		q.err = fmt.Errorf("nil query ancestor")
+	}
+	q.ancestor = ancestor
+	return q
+}
+
+// Filter adds a field-based filter such as "taken >=" in the same format as
+// datastore.Query
+func (q *Query) Filter(filterStr string, value interface{}) *Query {
+	q = q.clone()
+	filterStr = strings.TrimSpace(filterStr)
+	property := strings.TrimRight(filterStr, " <=>")
+	operator := strings.TrimSpace(filterStr[len(property):])
+	if operator == "" {
+		operator = "="
+	}
+	valid := false
+	for _, op := range filterOperators {
+		valid = valid || op == operator
+	}
+	switch {
+	case property == "":
+		q.err = fmt.Errorf("invalid filter %q", filterStr)
+	case !valid:
+		q.err = fmt.Errorf("invalid operator %q in filter %q", operator, filterStr)
+	}
+	q.filters = append(q.filters, filter{property, operator, value})
+	return q
+}
+
+// Order adds a sort order, a "-" prefix means descending
+func (q *Query) Order(fieldName string) *Query {
+	q = q.clone()
+	fieldName = strings.TrimSpace(fieldName)
+	o := order{Property: fieldName}
+	if strings.HasPrefix(fieldName, "-") {
+		o = order{strings.TrimSpace(fieldName[1:]), true}
+	}
+	if o.Property == "" {
+		q.err = fmt.Errorf("empty order")
+	}
+	q.orders = append(q.orders, o)
+	return q
+}
+
+// Project returns only the named properties
+func (q *Query) Project(fieldNames ...string) *Query {
+	q = q.clone()
+	q.projection = append([]string(nil), fieldNames...)
+	return q
+}
+
+// KeysOnly returns only keys
+func (q *Query) KeysOnly() *Query {
+	q = q.clone()
+	q.keysOnly = true
+	return q
+}
+
+// Limit sets the maximum number of results, zero means unlimited
+func (q *Query) Limit(limit int) *Query {
+	q = q.clone()
+	if limit < 0 {
+		q.err = fmt.Errorf("negative query limit")
+	}
+	q.limit = limit
+	return q
+}
+
+// Start sets the encoded cursor to start from
+func (q *Query) Start(cursor string) *Query {
+	q = q.clone()
+	q.start = cursor
+	return q
+}
+
+// End sets the encoded cursor to end at
+func (q *Query) End(cursor string) *Query {
+	q = q.clone()
+	q.end = cursor
+	return q
+}
+
+// Kind returns the kind the query is for
+func (q *Query) Kind() string {
+	return q.kind
+}
+
+// IsKeysOnly returns whether the query only returns keys
+func (q *Query) IsKeysOnly() bool {
+	return q.keysOnly
+}
+
+// keyShardable returns an error if the query can't be split into key
+// ranges, the datastore only allows a __key__ inequality filter if there
+// are no other inequality filters and the results are in key order
+func (q *Query) keyShardable() error {
+	for _, f := range q.filters {
+		if f.Operator != "=" {
+			return fmt.Errorf("query for %s can't be sharded by key as it has an inequality filter on %s", q.kind, f.Property)
+		}
+	}
+	for _, o := range q.orders {
+		if o.Property != "__key__" || o.Descending {
+			return fmt.Errorf("query for %s can't be sharded by key as it is sorted by %s", q.kind, o.Property)
+		}
+	}
+	return nil
+}
+
+// toDatastore converts the query to a datastore.Query along with the
+// context to run it in for the namespace
+func (q *Query) toDatastore(c context.Context) (*datastore.Query, context.Context, error) {
+	if q.err != nil {
+		return nil, c, q.err
+	}
+	if q.namespace != "" {
+		var err error
+		if c, err = appengine.Namespace(c, q.namespace); err != nil {
+			return nil, c, err
+		}
+	}
+
+	dq := datastore.NewQuery(q.kind)
+	if q.ancestor != nil {
+		dq = dq.Ancestor(q.ancestor)
+	}
+	for _, f := range q.filters {
+		dq = dq.Filter(f.Property+" "+f.Operator, f.Value)
+	}
+	for _, o := range q.orders {
+		if o.Descending {
+			dq = dq.Order("-" + o.Property)
+		} else {
+			dq = dq.Order(o.Property)
+		}
+	}
+	if len(q.projection) > 0 {
+		dq = dq.Project(q.projection...)
+	}
+	if q.keysOnly {
+		dq = dq.KeysOnly()
+	}
+	if q.limit > 0 {
+		dq = dq.Limit(q.limit)
+	}
+	if q.start != "" {
+		cursor, err := datastore.DecodeCursor(q.start)
+		if err != nil {
+			return nil, c, err
+		}
+		dq = dq.Start(cursor)
+	}
+	if q.end != "" {
+		cursor, err := datastore.DecodeCursor(q.end)
+		if err != nil {
+			return nil, c, err
+		}
+		dq = dq.End(cursor)
+	}
+	return dq, c, nil
+}
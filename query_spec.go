@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// Queryable is a processor that can be run over a query given as json
+	// in the query param of the job instead of its own, such as the generic
+	// processors that can be run over any kind
+	Queryable interface {
+		// SetQuery sets the processor to run the query, which has already
+		// been validated, it returns an error if the processor can't run it
+		SetQuery(spec *QuerySpec) error
+	}
+
+	// QuerySpec is a query given as json so that the generic processors can
+	// be run over any kind, e.g.
+	// {"kind": "photo", "filters": [{"property": "taken", "op": ">=", "value": "2015-01-01", "type": "time"}], "orders": ["taken"]}
+	QuerySpec struct {
+		Kind       string        `json:"kind"`
+		Namespace  string        `json:"namespace,omitempty"`
+		Ancestor   string        `json:"ancestor,omitempty"`
+		Filters    []*FilterSpec `json:"filters,omitempty"`
+		Orders     []string      `json:"orders,omitempty"`
+		Projection []string      `json:"projection,omitempty"`
+		KeysOnly   bool          `json:"keys_only,omitempty"`
+	}
+
+	// FilterSpec is a filter of a QuerySpec. The type of the value is one of
+	// int, float, string, bool, time (RFC 3339 or yyyy-mm-dd) or key (an
+	// encoded key), without one it's the type of the json value. The "in"
+	// operator takes an array of values and makes a sub-query for each.
+	FilterSpec struct {
+		Property string          `json:"property"`
+		Operator string          `json:"op"`
+		Value    json.RawMessage `json:"value"`
+		Type     string          `json:"type,omitempty"`
+	}
+)
+
+// queryParam parses the json query spec in the query param, it returns nil
+// if there isn't one
+func queryParam(params ParamAdapter) (*QuerySpec, error) {
+	s := params.Get("query")
+	if s == "" {
+		return nil, nil
+	}
+	spec := new(QuerySpec)
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("invalid query %s", err.Error())
+	}
+	return spec, spec.validate()
+}
+
+// applyQuery sets the query of the job on the processor if there is one
+func applyQuery(processor Processor, opts *jobOptions) error {
+	if opts.Query == nil {
+		return nil
+	}
+	q, ok := processor.(Queryable)
+	if !ok {
+		return fmt.Errorf("processor %s can't be run over a query", processorName(processor))
+	}
+	return q.SetQuery(opts.Query)
+}
+
+// the datastore has no IN filter so they're split into sub-queries
+const (
+	inOperator    = "in"
+	maxSubQueries = 30
+)
+
+// validate checks the query is one the datastore can run: filters use its
+// operators with values of the types it stores, there's only one property
+// with inequality filters and it's the first sort order, and projected
+// properties aren't filtered by equality
+func (spec *QuerySpec) validate() error {
+	if spec.Kind == "" {
+		return fmt.Errorf("query kind is required")
+	}
+	if spec.Ancestor != "" {
+		ancestor, err := datastore.DecodeKey(spec.Ancestor)
+		if err != nil {
+			return fmt.Errorf("invalid query ancestor %s", err.Error())
+		}
+		if spec.Namespace != "" && ancestor.Namespace() != spec.Namespace {
+			return fmt.Errorf("query ancestor isn't in namespace %s", spec.Namespace)
+		}
+	}
+
+	inequality := ""
+	equality := map[string]bool{}
+	subQueries := 1
+	for _, f := range spec.Filters {
+		if f.Property == "" {
+			return fmt.Errorf("query filter has no property")
+		}
+		valid := f.Operator == inOperator
+		for _, op := range filterOperators {
+			valid = valid || op == f.Operator
+		}
+		if !valid {
+			return fmt.Errorf("invalid operator %q for %s, must be one of %s %s", f.Operator, f.Property, strings.Join(filterOperators, " "), inOperator)
+		}
+		values, err := f.values()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if _, ok := value.(*datastore.Key); !ok && f.Property == "__key__" {
+				return fmt.Errorf("__key__ can only be filtered by a key")
+			}
+		}
+		if subQueries *= len(values); subQueries > maxSubQueries {
+			return fmt.Errorf("query can't have more than %d sub-queries", maxSubQueries)
+		}
+		if f.Operator == "=" || f.Operator == inOperator {
+			equality[f.Property] = true
+			continue
+		}
+		if inequality != "" && inequality != f.Property {
+			return fmt.Errorf("query can only have inequality filters on one property, not %s and %s", inequality, f.Property)
+		}
+		inequality = f.Property
+	}
+
+	for i, o := range spec.Orders {
+		property := strings.TrimPrefix(strings.TrimSpace(o), "-")
+		if property == "" {
+			return fmt.Errorf("query order is empty")
+		}
+		if i == 0 && inequality != "" && property != inequality {
+			return fmt.Errorf("query must be sorted by %s first as it has an inequality filter on it", inequality)
+		}
+	}
+
+	if len(spec.Projection) > 0 && spec.KeysOnly {
+		return fmt.Errorf("query can't be keys only and a projection")
+	}
+	projected := map[string]bool{}
+	for _, p := range spec.Projection {
+		switch {
+		case p == "" || p == "__key__":
+			return fmt.Errorf("query can't project %q", p)
+		case projected[p]:
+			return fmt.Errorf("query projects %s more than once", p)
+		case equality[p]:
+			return fmt.Errorf("query can't project %s as it has an equality filter", p)
+		}
+		projected[p] = true
+	}
+	return nil
+}
+
+// values converts the json value of the filter to its type, or each of the
+// values in the array for the in operator
+func (f *FilterSpec) values() ([]interface{}, error) {
+	if f.Operator != inOperator {
+		value, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	}
+
+	var raw []json.RawMessage
+	if err := json.Unmarshal(f.Value, &raw); err != nil || len(raw) == 0 {
+		return nil, fmt.Errorf("value for %s must be an array of values", f.Property)
+	}
+	values := make([]interface{}, len(raw))
+	for i, r := range raw {
+		var err error
+		item := &FilterSpec{Property: f.Property, Operator: "=", Value: r, Type: f.Type}
+		if values[i], err = item.value(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// value converts the json value of the filter to its type
+func (f *FilterSpec) value() (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(f.Value))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid value for %s", f.Property)
+	}
+
+	invalid := fmt.Errorf("invalid %s value for %s", f.Type, f.Property)
+	switch f.Type {
+	case "":
+		switch v := v.(type) {
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				return i, nil
+			}
+			return v.Float64()
+		case string, bool:
+			return v, nil
+		}
+		return nil, fmt.Errorf("value for %s must be a number, string or bool", f.Property)
+	case "int":
+		if n, ok := v.(json.Number); ok {
+			if i, err := n.Int64(); err == nil {
+				return i, nil
+			}
+		}
+	case "float":
+		if n, ok := v.(json.Number); ok {
+			return n.Float64()
+		}
+	case "string":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "time":
+		if s, ok := v.(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return t.UTC(), nil
+			}
+			if t, err := time.Parse(dateFormat, s); err == nil {
+				return t, nil
+			}
+		}
+	case "key":
+		if s, ok := v.(string); ok {
+			if key, err := datastore.DecodeKey(s); err == nil {
+				return key, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s for %s", f.Type, f.Property)
+	}
+	return nil, invalid
+}
+
+// query returns the query for the spec without any in filters, it must
+// have been validated
+func (spec *QuerySpec) query() *Query {
+	q := NewQuery(spec.Kind)
+	q = q.Namespace(spec.Namespace)
+	if spec.Ancestor != "" {
+		ancestor, _ := datastore.DecodeKey(spec.Ancestor)
+		q = q.Ancestor(ancestor)
+	}
+	for _, f := range spec.Filters {
+		if f.Operator == inOperator {
+			continue
+		}
+		value, _ := f.value()
+		q = q.Filter(f.Property+" "+f.Operator, value)
+	}
+	for _, o := range spec.Orders {
+		q = q.Order(o)
+	}
+	if len(spec.Projection) > 0 {
+		q = q.Project(spec.Projection...)
+	}
+	if spec.KeysOnly {
+		q = q.KeysOnly()
+	}
+	return q
+}
+
+// subQueries returns the filters to add to the query for each combination
+// of the values of the in filters, or nil if there aren't any
+func (spec *QuerySpec) subQueries() [][]filter {
+	var subQueries [][]filter
+	for _, f := range spec.Filters {
+		if f.Operator != inOperator {
+			continue
+		}
+		if subQueries == nil {
+			subQueries = [][]filter{{}}
+		}
+		values, _ := f.values()
+		next := make([][]filter, 0, len(subQueries)*len(values))
+		for _, filters := range subQueries {
+			for _, value := range values {
+				sub := append(append([]filter{}, filters...), filter{f.Property, "=", value})
+				next = append(next, sub)
+			}
+		}
+		subQueries = next
+	}
+	return subQueries
+}
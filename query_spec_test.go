@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestQuerySpecValidate(t *testing.T) {
+	c, _, _ := newTestContext(t)
+	key := datastore.NewKey(c, "photo", "", 1, nil).Encode()
+
+	tests := []struct {
+		query string
+		valid bool
+	}{
+		{`{"kind": "photo"}`, true},
+		{`{"kind": "photo", "keys_only": true, "orders": ["-taken"]}`, true},
+		{`{"kind": "photo", "filters": [{"property": "photographer.id", "op": "=", "value": 3}, {"property": "taken", "op": ">=", "value": "2015-01-01", "type": "time"}, {"property": "taken", "op": "<", "value": "2015-02-01T12:00:00Z", "type": "time"}], "orders": ["taken"]}`, true},
+		{`{"kind": "photo", "filters": [{"property": "__key__", "op": ">", "value": "` + key + `", "type": "key"}]}`, true},
+		{`{"kind": "photo", "ancestor": "` + key + `"}`, true},
+		{`{"kind": "photo", "projection": ["photographer.id", "taken"]}`, true},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "=", "value": 8000.5}]}`, true},
+		{`{"kind": "photo", "filters": [{"property": "photographer.id", "op": "in", "value": [1, 3]}, {"property": "width", "op": "in", "value": [8000, 6000, 4000]}]}`, true},
+		{`{}`, false},
+		{`{"kind": "photo", "limit": 10}`, false},
+		{`{"kind": "photo", "filters": [{"property": "taken", "op": "!=", "value": 1}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "taken", "op": "IN", "value": 1}]}`, false},
+		{`{"kind": "photo", "filters": [{"op": "=", "value": 1}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "in", "value": 1}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "in", "value": []}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "in", "value": [1, "wide"], "type": "int"}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "in", "value": [1, 2, 3, 4, 5, 6]}, {"property": "height", "op": "in", "value": [1, 2, 3, 4, 5, 6]}]}`, false},
+		{`{"kind": "photo", "projection": ["width"], "filters": [{"property": "width", "op": "in", "value": [1, 2]}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "taken", "op": "=", "value": "yesterday", "type": "time"}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "=", "value": "wide", "type": "int"}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "=", "value": 1, "type": "complex"}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "width", "op": "=", "value": null}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "__key__", "op": ">", "value": 1}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "taken", "op": ">", "value": 1}, {"property": "width", "op": "<", "value": 1}]}`, false},
+		{`{"kind": "photo", "filters": [{"property": "taken", "op": ">", "value": 1}], "orders": ["width"]}`, false},
+		{`{"kind": "photo", "orders": ["-"]}`, false},
+		{`{"kind": "photo", "ancestor": "nonsense"}`, false},
+		{`{"kind": "photo", "namespace": "other", "ancestor": "` + key + `"}`, false},
+		{`{"kind": "photo", "projection": ["taken"], "keys_only": true}`, false},
+		{`{"kind": "photo", "projection": ["taken", "taken"]}`, false},
+		{`{"kind": "photo", "projection": ["taken"], "filters": [{"property": "taken", "op": "=", "value": 1}]}`, false},
+	}
+	for _, test := range tests {
+		_, err := queryParam(params{"query": test.query})
+		if (err == nil) != test.valid {
+			t.Errorf("%s expected valid %t got %v", test.query, test.valid, err)
+		}
+	}
+
+	if spec, err := queryParam(params{}); spec != nil || err != nil {
+		t.Errorf("expected no query without the param got %v %v", spec, err)
+	}
+}
+
+func TestQuerySpecQuery(t *testing.T) {
+	spec, err := queryParam(params{"query": `{"kind": "photo", "namespace": "test",
+		"filters": [{"property": "photographer.id", "op": "=", "value": 3}, {"property": "taken", "op": ">=", "value": "2015-01-01", "type": "time"}, {"property": "width", "op": "=", "value": 8000.5, "type": "float"}],
+		"orders": ["-taken"], "keys_only": true}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := spec.query()
+	if q.kind != "photo" || q.namespace != "test" || !q.keysOnly {
+		t.Errorf("unexpected query %+v", q)
+	}
+	expected := []filter{
+		{"photographer.id", "=", int64(3)},
+		{"taken", ">=", time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"width", "=", 8000.5},
+	}
+	if !reflect.DeepEqual(q.filters, expected) {
+		t.Errorf("expected filters %v got %v", expected, q.filters)
+	}
+	if !reflect.DeepEqual(q.orders, []order{{"taken", true}}) {
+		t.Errorf("expected order by taken descending got %v", q.orders)
+	}
+	if spec.subQueries() != nil {
+		t.Errorf("expected no sub-queries without in filters")
+	}
+
+	// the in filters are left out of the query and multiplied out into
+	// sub-queries
+	spec, err = queryParam(params{"query": `{"kind": "photo", "filters": [{"property": "photographer.id", "op": "in", "value": [1, 3]}, {"property": "width", "op": "=", "value": 8000}, {"property": "height", "op": "in", "value": [6000, 4000]}]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := spec.query(); !reflect.DeepEqual(q.filters, []filter{{"width", "=", int64(8000)}}) {
+		t.Errorf("expected only the width filter got %v", q.filters)
+	}
+	expectedSubQueries := [][]filter{
+		{{"photographer.id", "=", int64(1)}, {"height", "=", int64(6000)}},
+		{{"photographer.id", "=", int64(1)}, {"height", "=", int64(4000)}},
+		{{"photographer.id", "=", int64(3)}, {"height", "=", int64(6000)}},
+		{{"photographer.id", "=", int64(3)}, {"height", "=", int64(4000)}},
+	}
+	if sq := spec.subQueries(); !reflect.DeepEqual(sq, expectedSubQueries) {
+		t.Errorf("expected sub-queries %v got %v", expectedSubQueries, sq)
+	}
+}
+
+func TestCountEntities(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 40)
+
+	tests := []struct {
+		params   params
+		shards   int
+		expected int64
+	}{
+		{params{"kind": "photo"}, 4, 40},
+		{params{"kind": "photo", "filters": "photographer.id=2"}, 2, 10},
+		{params{"query": `{"kind": "photo", "filters": [{"property": "photographer.id", "op": "=", "value": 3}]}`}, 2, 10},
+		{params{"query": `{"kind": "photo", "filters": [{"property": "taken", "op": "<", "value": "2015-01-21", "type": "time"}], "projection": ["taken"]}`}, 1, 20},
+		{params{"query": `{"kind": "photo", "filters": [{"property": "photographer.id", "op": "in", "value": [1, 3]}]}`}, 1, 20},
+		{params{"query": `{"kind": "photo", "ancestor": "` + datastore.NewKey(c, "photo", "", 1, nil).Encode() + `"}`}, 1, 1},
+	}
+	for _, test := range tests {
+		p, err := newCountEntities(test.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := newJobOptions(test.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Shards = test.shards
+		key, err := startJob(c, p, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, c, tasks)
+		if n := jobProcessed(t, c, key); n != test.expected {
+			t.Errorf("%v expected %d processed got %d", test.params, test.expected, n)
+		}
+	}
+
+	for _, p := range []params{{}, {"kind": "photo", "query": `{"kind": "photo"}`}} {
+		if _, err := newCountEntities(p); err == nil {
+			t.Errorf("%v expected error", p)
+		}
+	}
+	if _, err := newJobOptions(params{"query": `{"kind": ""}`}); err == nil {
+		t.Errorf("expected error for a query without a kind")
+	}
+
+	// only processors that implement Queryable can be run over a query
+	p, _ := newLogPhotos(params{})
+	opts, err := newJobOptions(params{"query": `{"kind": "photo"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startJob(c, p, opts); err == nil {
+		t.Errorf("expected error running a query with a processor that isn't Queryable")
+	}
+}
+
+func TestExportQuery(t *testing.T) {
+	// the query is applied as it would be when the job starts
+	export := func(params params) (*exportEntities, error) {
+		p, err := newExportEntities(params)
+		if err != nil {
+			return nil, err
+		}
+		opts, err := newJobOptions(params)
+		if err != nil {
+			return nil, err
+		}
+		return p.(*exportEntities), applyQuery(p, opts)
+	}
+
+	if _, err := export(params{"query": `{"kind": "photo", "keys_only": true}`}); err == nil {
+		t.Errorf("expected error exporting keys only")
+	}
+	if _, err := export(params{"query": `{"kind": "photo"}`, "filters": "width=1"}); err == nil {
+		t.Errorf("expected error exporting with filters and a query")
+	}
+	x, err := export(params{"query": `{"kind": "photo", "namespace": "test"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x.Kind != "photo" || x.Namespace != "test" {
+		t.Errorf("expected kind and namespace from the query got %s %s", x.Kind, x.Namespace)
+	}
+	if !strings.HasPrefix(x.Name, "photo-") {
+		t.Errorf("expected the export named for the kind of the query got %s", x.Name)
+	}
+	q, _ := x.Start(nil)
+	if q.kind != "photo" || q.namespace != "test" {
+		t.Errorf("unexpected export query %+v", q)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// keyColumn holds the encoded key for entities loaded as a PropertyList
+const keyColumn = "__key__"
+
+type (
+	// rowWriter writes entities as rows of an export file
+	rowWriter interface {
+		Write(key *datastore.Key, entity interface{}) error
+		Flush() error
+	}
+
+	ndjsonWriter struct {
+		w io.Writer
+	}
+
+	csvWriter struct {
+		w       *csv.Writer
+		columns []string
+	}
+)
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	keyType   = reflect.TypeOf(datastore.Key{})
+	extension = map[string]string{
+		"ndjson": ".ndjson",
+		"csv":    ".csv",
+	}
+)
+
+// newRowWriter returns a writer for the format. CSV files need the columns
+// to write and whether to write them as a header first.
+func newRowWriter(w io.Writer, format string, columns []string, header bool) (rowWriter, error) {
+	switch format {
+	case "ndjson":
+		return &ndjsonWriter{w}, nil
+	case "csv":
+		cw := &csvWriter{csv.NewWriter(w), columns}
+		if header {
+			if err := cw.w.Write(columns); err != nil {
+				return nil, err
+			}
+		}
+		return cw, nil
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+func (w *ndjsonWriter) Write(key *datastore.Key, entity interface{}) error {
+	row, err := entityJSON(key, entity)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(append(row, '\n'))
+	return err
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return nil
+}
+
+func (w *csvWriter) Write(key *datastore.Key, entity interface{}) error {
+	row, err := entityRow(key, entity)
+	if err != nil {
+		return err
+	}
+	record := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		record[i] = csvValue(row[column])
+	}
+	return w.w.Write(record)
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// entityJSON encodes the entity using its json tags, entities loaded as a
+// PropertyList are encoded as an object keyed by property name
+func entityJSON(key *datastore.Key, entity interface{}) ([]byte, error) {
+	if ks, ok := entity.(keySetter); ok {
+		ks.SetKey(key)
+	}
+	if pl, ok := entity.(*datastore.PropertyList); ok {
+		m := map[string]interface{}{keyColumn: key.Encode()}
+		for _, p := range *pl {
+			value := p.Value
+			if k, ok := value.(*datastore.Key); ok {
+				value = k.Encode()
+			}
+			if p.Multiple {
+				values, _ := m[p.Name].([]interface{})
+				value = append(values, value)
+			}
+			m[p.Name] = value
+		}
+		return json.Marshal(m)
+	}
+	return json.Marshal(entity)
+}
+
+// entityRow flattens the JSON encoding of the entity into a map keyed by
+// dotted property paths, e.g. "photographer.name"
+func entityRow(key *datastore.Key, entity interface{}) (map[string]interface{}, error) {
+	b, err := entityJSON(key, entity)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var m map[string]interface{}
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	row := make(map[string]interface{})
+	flatten(row, "", m)
+	return row, nil
+}
+
+func flatten(row map[string]interface{}, prefix string, m map[string]interface{}) {
+	for name, value := range m {
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flatten(row, name, nested)
+		} else {
+			row[name] = value
+		}
+	}
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	}
+	// lists are written as JSON
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// columns returns the CSV columns for a kind from the json tags of its
+// registered type, so they're the same for every shard. Unregistered kinds
+// can't be written as CSV as their properties can differ between entities.
+func columns(kind string) ([]string, error) {
+	t, found := kinds[kind]
+	if !found {
+		return nil, fmt.Errorf("kind %s isn't registered so can't be exported as csv", kind)
+	}
+	return structColumns(t, ""), nil
+}
+
+func structColumns(t reflect.Type, prefix string) []string {
+	names := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType && ft != keyType {
+			names = append(names, structColumns(ft, name)...)
+		} else {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// decodeRow decodes a line of an import file into a new entity of the type.
+// It also returns the encoded key if the row has a key column.
+func decodeRow(t reflect.Type, format string, columns []string, line []byte) (interface{}, string, error) {
+	var b []byte
+	switch format {
+	case "ndjson":
+		b = line
+	case "csv":
+		record, err := csv.NewReader(bytes.NewReader(line)).Read()
+		if err != nil {
+			return nil, "", err
+		}
+		if b, err = csvJSON(t, columns, record); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", fmt.Errorf("unsupported format %s", format)
+	}
+
+	var k struct {
+		Key string `json:"__key__"`
+	}
+	if err := json.Unmarshal(b, &k); err != nil {
+		return nil, "", err
+	}
+	entity := reflect.New(t).Interface()
+	if err := json.Unmarshal(b, entity); err != nil {
+		return nil, "", err
+	}
+	return entity, k.Key, nil
+}
+
+// csvJSON converts a CSV record to the JSON the struct would be encoded as
+// so that it can be decoded using the json tags
+func csvJSON(t reflect.Type, columns []string, record []string) ([]byte, error) {
+	if len(record) != len(columns) {
+		return nil, fmt.Errorf("expected %d columns got %d", len(columns), len(record))
+	}
+	m := make(map[string]interface{})
+	for i, column := range columns {
+		if record[i] == "" {
+			continue
+		}
+		value, err := csvField(fieldType(t, column), record[i])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %s", column, err.Error())
+		}
+
+		// build nested objects for dotted column names
+		parts := strings.Split(column, ".")
+		parent := m
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := parent[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[part] = child
+			}
+			parent = child
+		}
+		parent[parts[len(parts)-1]] = value
+	}
+	return json.Marshal(m)
+}
+
+func csvField(t reflect.Type, s string) (interface{}, error) {
+	if t == nil {
+		return s, nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if _, err := strconv.ParseFloat(s, 64); err != nil {
+			return nil, err
+		}
+		return json.Number(s), nil
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	case reflect.Slice, reflect.Map:
+		// written as JSON on export
+		return json.RawMessage(s), nil
+	}
+	return s, nil
+}
+
+// fieldType returns the type of the field for a dotted json name, or nil if
+// there isn't one
+func fieldType(t reflect.Type, name string) reflect.Type {
+	for _, part := range strings.Split(name, ".") {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("json"), ",")[0]
+			if tag == part || (tag == "" && f.Name == part) {
+				t = f.Type
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return t
+}
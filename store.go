@@ -0,0 +1,219 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/taskqueue"
+)
+
+type (
+	// Datastore is the subset of datastore operations the processors use so
+	// that they can be run against the in-memory implementation in tests.
+	// The default is the App Engine datastore (via nds for caching).
+	Datastore interface {
+		Run(c context.Context, q *Query) Iterator
+		Get(c context.Context, key *datastore.Key, dst interface{}) error
+		GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error
+		Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error)
+		PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)
+		DeleteMulti(c context.Context, keys []*datastore.Key) error
+
+		// RunInTransaction runs f in a transaction, any datastore operations
+		// f makes must use the context it is passed
+		RunInTransaction(c context.Context, f func(tc context.Context) error) error
+	}
+
+	// Iterator is the result of running a query
+	Iterator interface {
+		// Next returns the key of the next result, loading the entity into
+		// dst unless it's nil. It returns datastore.Done when there are no
+		// more results.
+		Next(dst interface{}) (*datastore.Key, error)
+
+		// Cursor returns the encoded cursor after the last result returned
+		Cursor() (string, error)
+	}
+
+	// Tasks enqueues calls to task functions, the default uses the delay
+	// package to run them on the App Engine task queue
+	Tasks interface {
+		Call(c context.Context, fn *taskFunc, args ...interface{}) error
+
+		// CallAfter is like Call but the task isn't run until after the delay
+		CallAfter(c context.Context, delay time.Duration, fn *taskFunc, args ...interface{}) error
+
+		// Post adds a task to a named queue that posts the json payload to a
+		// path of the app
+		Post(c context.Context, queue, path string, payload []byte) error
+	}
+
+	// taskFunc is a delay.Function that also keeps the function it calls so
+	// that tasks can be run without the task queue
+	taskFunc struct {
+		name  string
+		fn    interface{}
+		delay *delay.Function
+	}
+
+	appengineDatastore struct{}
+
+	appengineIterator struct {
+		it *datastore.Iterator
+	}
+
+	errIterator struct {
+		err error
+	}
+
+	appengineTasks struct{}
+
+	contextKey int
+)
+
+const (
+	datastoreContextKey contextKey = iota
+	tasksContextKey
+	logContextKey
+	emitterContextKey
+	httpClientContextKey
+)
+
+// newTaskFunc creates a task function, it must be called during program
+// initialization (like delay.Func)
+func newTaskFunc(name string, fn interface{}) *taskFunc {
+	return &taskFunc{
+		name:  name,
+		fn:    fn,
+		delay: delay.Func(name, fn),
+	}
+}
+
+// Call enqueues a call to the function using the Tasks from the context
+func (f *taskFunc) Call(c context.Context, args ...interface{}) error {
+	return getTasks(c).Call(c, f, args...)
+}
+
+// CallAfter enqueues a call to the function to run after the delay
+func (f *taskFunc) CallAfter(c context.Context, delay time.Duration, args ...interface{}) error {
+	return getTasks(c).CallAfter(c, delay, f, args...)
+}
+
+func withDatastore(c context.Context, ds Datastore) context.Context {
+	return context.WithValue(c, datastoreContextKey, ds)
+}
+
+func getDatastore(c context.Context) Datastore {
+	if ds, ok := c.Value(datastoreContextKey).(Datastore); ok {
+		return ds
+	}
+	return appengineDatastore{}
+}
+
+func withTasks(c context.Context, tasks Tasks) context.Context {
+	return context.WithValue(c, tasksContextKey, tasks)
+}
+
+func getTasks(c context.Context) Tasks {
+	if tasks, ok := c.Value(tasksContextKey).(Tasks); ok {
+		return tasks
+	}
+	return appengineTasks{}
+}
+
+// getAllKeys returns the keys of all the results of a query
+func getAllKeys(c context.Context, q *Query) ([]*datastore.Key, error) {
+	it := getDatastore(c).Run(c, q.KeysOnly())
+	keys := []*datastore.Key{}
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+}
+
+func (appengineDatastore) Run(c context.Context, q *Query) Iterator {
+	dq, c, err := q.toDatastore(c)
+	if err != nil {
+		return &errIterator{err}
+	}
+	return &appengineIterator{dq.Run(c)}
+}
+
+func (appengineDatastore) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	return nds.Get(c, key, dst)
+}
+
+func (appengineDatastore) GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error {
+	return nds.GetMulti(c, keys, dst)
+}
+
+func (appengineDatastore) Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	return nds.Put(c, key, src)
+}
+
+func (appengineDatastore) PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	return nds.PutMulti(c, keys, src)
+}
+
+func (appengineDatastore) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	return nds.DeleteMulti(c, keys)
+}
+
+func (appengineDatastore) RunInTransaction(c context.Context, f func(tc context.Context) error) error {
+	return nds.RunInTransaction(c, f, nil)
+}
+
+func (i *appengineIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return i.it.Next(dst)
+}
+
+func (i *appengineIterator) Cursor() (string, error) {
+	cursor, err := i.it.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return cursor.String(), nil
+}
+
+func (i *errIterator) Next(dst interface{}) (*datastore.Key, error) {
+	return nil, i.err
+}
+
+func (i *errIterator) Cursor() (string, error) {
+	return "", i.err
+}
+
+func (appengineTasks) Call(c context.Context, fn *taskFunc, args ...interface{}) error {
+	return fn.delay.Call(c, args...)
+}
+
+func (appengineTasks) CallAfter(c context.Context, delay time.Duration, fn *taskFunc, args ...interface{}) error {
+	t, err := fn.delay.Task(args...)
+	if err != nil {
+		return err
+	}
+	t.Delay = delay
+	_, err = taskqueue.Add(c, t, "")
+	return err
+}
+
+func (appengineTasks) Post(c context.Context, queue, path string, payload []byte) error {
+	t := &taskqueue.Task{
+		Path:    path,
+		Payload: payload,
+		Header:  http.Header{"Content-Type": []string{"application/json"}},
+		Method:  "POST",
+	}
+	_, err := taskqueue.Add(c, t, queue)
+	return err
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// memoryStore is an in-memory Datastore for testing processors without
+	// the dev appserver. Queries support kind, namespace, ancestor, filters,
+	// orders, projections, limits and cursors (including
+	// __namespace__ metadata queries) and, like the real datastore, can't
+	// filter, sort or project on noindex properties. A projection only
+	// returns the first value of a multi-valued property rather than a
+	// result for each. Query results are a snapshot taken when the query is
+	// run. Every entity has a __scatter__ value, not just a sample of them,
+	// and transactions are run one at a time. A transaction that fails is
+	// rolled back, including the tasks added in it, and they can't be
+	// nested.
+	memoryStore struct {
+		mu        sync.Mutex
+		txMu      sync.Mutex
+		entities  map[string]*memoryEntity
+		positions []*memoryPosition
+		nextID    int64
+	}
+
+	memoryEntity struct {
+		key    *datastore.Key
+		props  datastore.PropertyList
+		values []interface{}
+	}
+
+	// memoryPosition is what a cursor points to, the sort values and key of
+	// the last result returned
+	memoryPosition struct {
+		values []interface{}
+		key    *datastore.Key
+	}
+
+	memoryIterator struct {
+		store    *memoryStore
+		q        *Query
+		results  []*memoryEntity
+		position *memoryPosition
+	}
+
+	// memoryTasks queues tasks in memory to be run by calling Run. Arguments
+	// are gob encoded when the task is queued and decoded when it is run,
+	// the same as the delay package, so anything not serialized is lost.
+	// Delays are recorded but not waited for and tasks posted to a named
+	// queue are only recorded.
+	memoryTasks struct {
+		mu     sync.Mutex
+		queue  []*memoryTask
+		posted []*memoryPost
+	}
+
+	memoryTask struct {
+		fn    *taskFunc
+		args  []byte
+		delay time.Duration
+	}
+
+	memoryPost struct {
+		queue   string
+		path    string
+		payload []byte
+	}
+
+	// memoryTx is a transaction of the memory store, the entities are put
+	// back from the copy taken when it started if it fails and the tasks
+	// added in it are only queued once it succeeds
+	memoryTx struct {
+		entities map[string]*memoryEntity
+		commit   []func()
+	}
+
+	memoryTxKey struct{}
+)
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entities: make(map[string]*memoryEntity),
+	}
+}
+
+func (s *memoryStore) Run(c context.Context, q *Query) Iterator {
+	if q.err != nil {
+		return &errIterator{q.err}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := &memoryIterator{store: s, q: q}
+	namespace := q.namespace
+	if namespace == "" {
+		namespace = datastore.NewKey(c, "ns", "", 1, nil).Namespace()
+	}
+
+	var start, end *memoryPosition
+	var err error
+	if start, err = s.position(q.start); err != nil {
+		return &errIterator{err}
+	}
+	if end, err = s.position(q.end); err != nil {
+		return &errIterator{err}
+	}
+	it.position = start
+
+	for _, e := range s.candidates(c, q.kind, namespace) {
+		if q.ancestor != nil && !hasAncestor(e.key, q.ancestor) {
+			continue
+		}
+		if !matchesFilters(e.key, e.props, q.filters) {
+			continue
+		}
+		values, ok := sortValues(e.key, e.props, q.orders)
+		if !ok {
+			continue
+		}
+		props := e.props
+		if len(q.projection) > 0 {
+			if props, ok = projectProperties(e.props, q.projection); !ok {
+				continue
+			}
+		}
+		result := &memoryEntity{e.key, props, values}
+		if start != nil && compareResults(result.values, result.key, start.values, start.key, q.orders) <= 0 {
+			continue
+		}
+		if end != nil && compareResults(result.values, result.key, end.values, end.key, q.orders) > 0 {
+			continue
+		}
+		it.results = append(it.results, result)
+	}
+
+	sort.Sort(&memoryResults{it.results, q.orders})
+	if q.limit > 0 && len(it.results) > q.limit {
+		it.results = it.results[:q.limit]
+	}
+	return it
+}
+
+// candidates returns the entities of a kind in the namespace, including the
+// __namespace__ metadata entities
+func (s *memoryStore) candidates(c context.Context, kind, namespace string) []*memoryEntity {
+	results := []*memoryEntity{}
+	if kind == namespaceKind {
+		c, _ = appengine.Namespace(c, "")
+		seen := make(map[string]bool)
+		for _, e := range s.entities {
+			ns := e.key.Namespace()
+			if seen[ns] {
+				continue
+			}
+			seen[ns] = true
+			// the default namespace has an ID of 1 rather than a name
+			key := datastore.NewKey(c, namespaceKind, ns, 0, nil)
+			if ns == "" {
+				key = datastore.NewKey(c, namespaceKind, "", 1, nil)
+			}
+			results = append(results, &memoryEntity{key: key})
+		}
+		return results
+	}
+
+	for _, e := range s.entities {
+		if e.key.Namespace() == namespace && (kind == "" || e.key.Kind() == kind) {
+			results = append(results, e)
+		}
+	}
+	return results
+}
+
+func (s *memoryStore) Get(c context.Context, key *datastore.Key, dst interface{}) error {
+	s.mu.Lock()
+	e, found := s.entities[key.Encode()]
+	s.mu.Unlock()
+	if !found {
+		return datastore.ErrNoSuchEntity
+	}
+	return loadEntity(dst, e.props)
+}
+
+func (s *memoryStore) GetMulti(c context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return fmt.Errorf("dst must be a slice the same length as keys")
+	}
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if errs[i] = s.Get(c, key, element(v, i)); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (s *memoryStore) Put(c context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	props, err := saveEntity(src)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key.Incomplete() {
+		s.nextID++
+		nc, err := appengine.Namespace(c, key.Namespace())
+		if err != nil {
+			return nil, err
+		}
+		key = datastore.NewKey(nc, key.Kind(), "", s.nextID, key.Parent())
+	}
+	s.entities[key.Encode()] = &memoryEntity{key: key, props: props}
+	return key, nil
+}
+
+func (s *memoryStore) PutMulti(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, fmt.Errorf("src must be a slice the same length as keys")
+	}
+	results := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		var err error
+		if results[i], err = s.Put(c, key, element(v, i)); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) DeleteMulti(c context.Context, keys []*datastore.Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entities, key.Encode())
+	}
+	return nil
+}
+
+func (s *memoryStore) RunInTransaction(c context.Context, f func(tc context.Context) error) error {
+	if _, ok := c.Value(memoryTxKey{}).(*memoryTx); ok {
+		return fmt.Errorf("nested transactions are not supported")
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	// entities are replaced rather than changed so copying the map is
+	// enough to roll back
+	s.mu.Lock()
+	tx := &memoryTx{entities: make(map[string]*memoryEntity, len(s.entities))}
+	for k, e := range s.entities {
+		tx.entities[k] = e
+	}
+	s.mu.Unlock()
+
+	if err := f(context.WithValue(c, memoryTxKey{}, tx)); err != nil {
+		s.mu.Lock()
+		s.entities = tx.entities
+		s.mu.Unlock()
+		return err
+	}
+	for _, fn := range tx.commit {
+		fn()
+	}
+	return nil
+}
+
+// position returns the position for a cursor created by the store
+func (s *memoryStore) position(cursor string) (*memoryPosition, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(cursor, "m"))
+	if err != nil || !strings.HasPrefix(cursor, "m") || i < 0 || i >= len(s.positions) {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return s.positions[i], nil
+}
+
+func (i *memoryIterator) Next(dst interface{}) (*datastore.Key, error) {
+	if len(i.results) == 0 {
+		return nil, datastore.Done
+	}
+	e := i.results[0]
+	i.results = i.results[1:]
+	i.position = &memoryPosition{e.values, e.key}
+
+	if dst != nil && !i.q.keysOnly {
+		if err := loadEntity(dst, e.props); err != nil {
+			return e.key, err
+		}
+	}
+	return e.key, nil
+}
+
+func (i *memoryIterator) Cursor() (string, error) {
+	if i.position == nil {
+		return "", nil
+	}
+	i.store.mu.Lock()
+	defer i.store.mu.Unlock()
+	i.store.positions = append(i.store.positions, i.position)
+	return fmt.Sprintf("m%d", len(i.store.positions)-1), nil
+}
+
+type memoryResults struct {
+	results []*memoryEntity
+	orders  []order
+}
+
+func (r *memoryResults) Len() int      { return len(r.results) }
+func (r *memoryResults) Swap(i, j int) { r.results[i], r.results[j] = r.results[j], r.results[i] }
+func (r *memoryResults) Less(i, j int) bool {
+	a, b := r.results[i], r.results[j]
+	return compareResults(a.values, a.key, b.values, b.key, r.orders) < 0
+}
+
+// element returns a pointer to (or the pointer in) a slice element
+func element(v reflect.Value, i int) interface{} {
+	e := v.Index(i)
+	if e.Kind() == reflect.Ptr || e.Kind() == reflect.Interface {
+		return e.Interface()
+	}
+	return e.Addr().Interface()
+}
+
+// sortValues returns the values the entity sorts by, the smallest value
+// of a multi-valued property for ascending orders and the largest for
+// descending. Entities without a value aren't in the index so aren't
+// returned by the query.
+func sortValues(key *datastore.Key, props datastore.PropertyList, orders []order) ([]interface{}, bool) {
+	values := make([]interface{}, len(orders))
+	for i, o := range orders {
+		candidates := indexedValues(key, props, o.Property)
+		if len(candidates) == 0 {
+			return nil, false
+		}
+		values[i] = candidates[0]
+		for _, v := range candidates[1:] {
+			cmp := compareValues(v, values[i])
+			if (o.Descending && cmp > 0) || (!o.Descending && cmp < 0) {
+				values[i] = v
+			}
+		}
+	}
+	return values, true
+}
+
+func compareResults(av []interface{}, ak *datastore.Key, bv []interface{}, bk *datastore.Key, orders []order) int {
+	for i, o := range orders {
+		cmp := compareValues(av[i], bv[i])
+		if o.Descending {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return compareKeys(ak, bk)
+}
+
+func hasAncestor(key, ancestor *datastore.Key) bool {
+	for k := key; k != nil; k = k.Parent() {
+		if k.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *memoryTasks) Call(c context.Context, fn *taskFunc, args ...interface{}) error {
+	return t.CallAfter(c, 0, fn, args...)
+}
+
+func (t *memoryTasks) CallAfter(c context.Context, delay time.Duration, fn *taskFunc, args ...interface{}) error {
+	ft := reflect.TypeOf(fn.fn)
+	if ft.NumIn() != len(args)+1 {
+		return fmt.Errorf("task %s expects %d args got %d", fn.name, ft.NumIn()-1, len(args))
+	}
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for i, arg := range args {
+		var err error
+		if ft.In(i+1).Kind() == reflect.Interface {
+			err = enc.Encode(&arg)
+		} else {
+			err = enc.Encode(arg)
+		}
+		if err != nil {
+			return fmt.Errorf("task %s arg %d: %s", fn.name, i, err.Error())
+		}
+	}
+
+	task := &memoryTask{fn, buf.Bytes(), delay}
+	t.inTransaction(c, func() {
+		t.mu.Lock()
+		t.queue = append(t.queue, task)
+		t.mu.Unlock()
+	})
+	return nil
+}
+
+func (t *memoryTasks) Post(c context.Context, queue, path string, payload []byte) error {
+	post := &memoryPost{queue, path, payload}
+	t.inTransaction(c, func() {
+		t.mu.Lock()
+		t.posted = append(t.posted, post)
+		t.mu.Unlock()
+	})
+	return nil
+}
+
+// inTransaction adds a task now, or once the transaction of the context
+// succeeds if there is one
+func (t *memoryTasks) inTransaction(c context.Context, add func()) {
+	if tx, ok := c.Value(memoryTxKey{}).(*memoryTx); ok {
+		tx.commit = append(tx.commit, add)
+		return
+	}
+	add()
+}
+
+// Posted returns the tasks posted to named queues
+func (t *memoryTasks) Posted() []*memoryPost {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*memoryPost{}, t.posted...)
+}
+
+// Len returns the number of tasks waiting to be run
+func (t *memoryTasks) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queue)
+}
+
+// Run runs the queued tasks in order, including any tasks they queue,
+// until there are none left. It stops at the first task that fails.
+func (t *memoryTasks) Run(c context.Context) error {
+	for {
+		t.mu.Lock()
+		if len(t.queue) == 0 {
+			t.mu.Unlock()
+			return nil
+		}
+		task := t.queue[0]
+		t.queue = t.queue[1:]
+		t.mu.Unlock()
+
+		if err := task.run(c); err != nil {
+			return fmt.Errorf("task %s: %s", task.fn.name, err.Error())
+		}
+	}
+}
+
+func (t *memoryTask) run(c context.Context) error {
+	fv := reflect.ValueOf(t.fn.fn)
+	ft := fv.Type()
+	in := []reflect.Value{reflect.ValueOf(c)}
+	dec := gob.NewDecoder(bytes.NewReader(t.args))
+	for i := 1; i < ft.NumIn(); i++ {
+		arg := reflect.New(ft.In(i))
+		if err := dec.Decode(arg.Interface()); err != nil {
+			return err
+		}
+		in = append(in, arg.Elem())
+	}
+	out := fv.Call(in)
+	if len(out) > 0 && !out[0].IsNil() {
+		return out[0].Interface().(error)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func queryIDs(t *testing.T, it Iterator) []int64 {
+	ids := []int64{}
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			return ids
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, key.IntID())
+	}
+}
+
+func equalIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryStoreQueries(t *testing.T) {
+	c, store, _ := newTestContext(t)
+	putPhotos(t, c, 8)
+
+	from := time.Date(2015, 1, 3, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		q    *Query
+		ids  []int64
+	}{
+		{"all", NewQuery("photo"), []int64{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"equality", NewQuery("photo").Filter("photographer.id =", 2), []int64{2, 6}},
+		{"inequality", NewQuery("photo").Filter("taken >=", from).Filter("taken <", from.Add(72*time.Hour)), []int64{3, 4, 5}},
+		{"descending", NewQuery("photo").Filter("photographer.id <=", 2).Order("-taken"), []int64{6, 5, 2, 1}},
+		{"ordered", NewQuery("photo").Order("-photographer.id").Order("taken"), []int64{4, 8, 3, 7, 2, 6, 1, 5}},
+		{"limit", NewQuery("photo").Order("taken").Limit(3), []int64{1, 2, 3}},
+		{"key", NewQuery("photo").Filter("__key__ >", datastore.NewKey(c, "photo", "", 6, nil)), []int64{7, 8}},
+		{"noindex", NewQuery("photo").Filter("width =", 8000), []int64{}},
+		{"other kind", NewQuery("video"), []int64{}},
+	}
+	for _, test := range tests {
+		if ids := queryIDs(t, store.Run(c, test.q)); !equalIDs(ids, test.ids) {
+			t.Errorf("%s expected %v got %v", test.name, test.ids, ids)
+		}
+	}
+}
+
+func TestMemoryStoreCursors(t *testing.T) {
+	c, store, _ := newTestContext(t)
+	putPhotos(t, c, 8)
+
+	q := NewQuery("photo").Order("-taken").Limit(3).KeysOnly()
+	ids := []int64{}
+	cursor := ""
+	for {
+		it := store.Run(c, q.Start(cursor))
+		batch := queryIDs(t, it)
+		if len(batch) == 0 {
+			break
+		}
+		ids = append(ids, batch...)
+		var err error
+		if cursor, err = it.Cursor(); err != nil {
+			t.Fatal(err)
+		}
+
+		// deleting entities mustn't affect where the cursor resumes
+		if len(ids) == 3 {
+			store.DeleteMulti(c, []*datastore.Key{datastore.NewKey(c, "photo", "", 6, nil)})
+		}
+	}
+	if expected := []int64{8, 7, 6, 5, 4, 3, 2, 1}; !equalIDs(ids, expected) {
+		t.Errorf("expected %v got %v", expected, ids)
+	}
+
+	// an end cursor is inclusive of the last entity before it
+	it := store.Run(c, q.Limit(2))
+	queryIDs(t, it)
+	end, _ := it.Cursor()
+	if ids := queryIDs(t, store.Run(c, NewQuery("photo").Order("-taken").End(end))); !equalIDs(ids, []int64{8, 7}) {
+		t.Errorf("expected end cursor to stop after 7 got %v", ids)
+	}
+
+	if _, err := store.Run(c, q.Start("bogus")).Next(nil); err == nil {
+		t.Errorf("expected invalid cursor error")
+	}
+}
+
+func TestMemoryStoreProjection(t *testing.T) {
+	c, store, _ := newTestContext(t)
+	putPhotos(t, c, 4)
+
+	it := store.Run(c, NewQuery("photo").Filter("taken >=", time.Date(2015, 1, 3, 0, 0, 0, 0, time.UTC)).Order("taken").Project("photographer.id"))
+	ids := []int64{}
+	for {
+		props := datastore.PropertyList{}
+		_, err := it.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(props) != 1 || props[0].Name != "photographer.id" {
+			t.Fatalf("expected only the projected property got %v", props)
+		}
+		ids = append(ids, props[0].Value.(int64))
+	}
+	if !equalIDs(ids, []int64{3, 4}) {
+		t.Errorf("expected photographers 3 and 4 got %v", ids)
+	}
+
+	// a struct is only partly loaded
+	photo := new(Photo)
+	if _, err := store.Run(c, NewQuery("photo").Project("taken")).Next(photo); err != nil {
+		t.Fatal(err)
+	}
+	if photo.Taken.IsZero() || photo.Photographer.ID != 0 || photo.Width != 0 {
+		t.Errorf("expected only taken to be loaded got %+v", photo)
+	}
+
+	// noindex properties can't be projected
+	if ids := queryIDs(t, store.Run(c, NewQuery("photo").Project("width"))); len(ids) != 0 {
+		t.Errorf("expected no results projecting width got %v", ids)
+	}
+}
+
+func TestMemoryStoreNamespaces(t *testing.T) {
+	c, store, _ := newTestContext(t)
+	putPhotos(t, c, 2)
+	for _, namespace := range []string{"b", "a"} {
+		nc, _ := appengine.Namespace(c, namespace)
+		putPhotos(t, nc, 1)
+	}
+
+	if ids := queryIDs(t, store.Run(c, NewQuery("photo").Namespace("a"))); !equalIDs(ids, []int64{1}) {
+		t.Errorf("expected 1 photo in namespace a got %v", ids)
+	}
+	nc, _ := appengine.Namespace(c, "b")
+	if ids := queryIDs(t, store.Run(nc, NewQuery("photo"))); !equalIDs(ids, []int64{1}) {
+		t.Errorf("expected 1 photo in context namespace b got %v", ids)
+	}
+
+	keys, err := getAllKeys(c, NewQuery(namespaceKind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaces := []string{}
+	for _, key := range keys {
+		namespaces = append(namespaces, key.StringID())
+	}
+	if len(namespaces) != 3 || namespaces[0] != "" || namespaces[1] != "a" || namespaces[2] != "b" {
+		t.Errorf("expected namespaces '', a, b got %q", namespaces)
+	}
+}
+
+func TestMemoryStoreGetPut(t *testing.T) {
+	c, store, _ := newTestContext(t)
+
+	key, err := store.Put(c, datastore.NewIncompleteKey(c, "photo", nil), &Photo{Width: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Incomplete() {
+		t.Fatalf("expected key to be allocated")
+	}
+
+	photos := make([]*Photo, 2)
+	photos[0] = new(Photo)
+	err = store.GetMulti(c, []*datastore.Key{key, datastore.NewKey(c, "photo", "", 999, nil)}, photos)
+	merr, ok := err.(appengine.MultiError)
+	if !ok || merr[0] != nil || merr[1] != datastore.ErrNoSuchEntity {
+		t.Fatalf("expected ErrNoSuchEntity for the missing photo only, got %v", err)
+	}
+	if photos[0].Width != 10 {
+		t.Errorf("expected width 10 got %d", photos[0].Width)
+	}
+}
+
+func TestMemoryStoreTransactions(t *testing.T) {
+	c, store, tasks := newTestContext(t)
+	key := datastore.NewKey(c, "photo", "", 1, nil)
+	if _, err := store.Put(c, key, &Photo{Width: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed transaction leaves nothing behind, including its tasks
+	failed := errors.New("failed")
+	err := store.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := store.Put(tc, key, &Photo{Width: 20}); err != nil {
+			return err
+		}
+		if _, err := store.Put(tc, datastore.NewKey(tc, "photo", "", 2, nil), &Photo{}); err != nil {
+			return err
+		}
+		if err := tasks.Post(tc, "notify", "/done", nil); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("expected the transaction error got %v", err)
+	}
+	photo := new(Photo)
+	if err := store.Get(c, key, photo); err != nil || photo.Width != 10 {
+		t.Errorf("expected the photo rolled back got %d %v", photo.Width, err)
+	}
+	if err := store.Get(c, datastore.NewKey(c, "photo", "", 2, nil), photo); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected the new photo rolled back got %v", err)
+	}
+	if n := len(tasks.Posted()); n != 0 {
+		t.Errorf("expected no tasks from the failed transaction got %d", n)
+	}
+
+	// one that succeeds adds its tasks once it's done
+	err = store.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := store.Put(tc, key, &Photo{Width: 20}); err != nil {
+			return err
+		}
+		return tasks.Post(tc, "notify", "/done", nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Get(c, key, photo); err != nil || photo.Width != 20 {
+		t.Errorf("expected the photo updated got %d %v", photo.Width, err)
+	}
+	if n := len(tasks.Posted()); n != 1 {
+		t.Errorf("expected the task from the transaction got %d", n)
+	}
+
+	// nesting them is an error rather than a deadlock
+	err = store.RunInTransaction(c, func(tc context.Context) error {
+		return store.RunInTransaction(tc, func(context.Context) error { return nil })
+	})
+	if err == nil {
+		t.Errorf("expected error nesting transactions")
+	}
+}
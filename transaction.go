@@ -0,0 +1,59 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// Transactional is an optional interface for processors that read,
+	// modify and write the entities they process. When Transactional
+	// returns true ProcessInTransaction is called for each entity instead
+	// of Process, in a transaction with the entity reloaded into the slot
+	// from Start inside it, so the query can be keys only and a write made
+	// since the query ran isn't lost. It's called again if the transaction
+	// fails because of contention so it should only change entities through
+	// the context it's given, not the processor's own state. Returning an
+	// error rolls the transaction back and fails the slice.
+	Transactional interface {
+		Transactional() bool
+		ProcessInTransaction(c context.Context, key *datastore.Key) error
+	}
+)
+
+var (
+	// how many times an entity's transaction is run before it's skipped and
+	// counted as contended, each on top of the datastore's own retries
+	transactionAttempts = 3
+)
+
+// processInTransaction calls ProcessInTransaction for the entity in a
+// transaction, retrying if it fails because of contention. It returns
+// whether the entity was skipped because every attempt did. An entity that
+// has been deleted since the query ran isn't processed.
+func processInTransaction(c context.Context, processor Transactional, key *datastore.Key, e interface{}) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		deleted := false
+		err := getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+			if e != nil {
+				resetEntity(e)
+				if err := getDatastore(tc).Get(tc, key, e); err != nil {
+					deleted = err == datastore.ErrNoSuchEntity
+					return err
+				}
+			}
+			return processor.ProcessInTransaction(tc, key)
+		})
+		switch {
+		case deleted:
+			log.Debugf(c, "%s was deleted before it was processed", key.String())
+			return false, nil
+		case err != datastore.ErrConcurrentTransaction:
+			return false, err
+		case attempt >= transactionAttempts:
+			log.Warningf(c, "skipped %s after %d attempts failed because of contention", key.String(), attempt)
+			return true, nil
+		}
+		log.Debugf(c, "retrying %s after contention", key.String())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// halvePhotos sets the height of each photo to half its width, as a
+	// derived field recomputed in a transaction, failing after it's written
+	// the photo with the Fail ID
+	halvePhotos struct {
+		Divisor int
+		Fail    int64
+
+		photo *Photo
+	}
+
+	// contendedStore fails the transactions that process photos as if
+	// they'd been written by someone else, a failed transaction's writes
+	// are rolled back and the concurrent write is made instead
+	contendedStore struct {
+		*memoryStore
+		contention map[int64]int
+		concurrent map[int64]*Photo
+	}
+)
+
+var (
+	// the photo processed by the last transaction and how many times each
+	// photo has been processed
+	halving int64
+	halved  map[int64]int
+)
+
+func init() {
+	gob.Register(new(halvePhotos))
+}
+
+func (x *halvePhotos) Start(c context.Context) (*Query, interface{}) {
+	x.photo = new(Photo)
+	return NewQuery("photo").Limit(2), x.photo
+}
+
+func (x *halvePhotos) Transactional() bool {
+	return true
+}
+
+func (x *halvePhotos) ProcessInTransaction(c context.Context, key *datastore.Key) error {
+	halving = key.IntID()
+	halved[key.IntID()]++
+	x.photo.Height = x.photo.Width / x.Divisor
+	if _, err := getDatastore(c).Put(c, key, x.photo); err != nil {
+		return err
+	}
+	if key.IntID() == x.Fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+// Process isn't called as the photos are halved in transactions
+func (x *halvePhotos) Process(c context.Context, key *datastore.Key) {}
+
+func (x *halvePhotos) Complete(c context.Context) {}
+
+func (s *contendedStore) RunInTransaction(c context.Context, f func(tc context.Context) error) error {
+	s.mu.Lock()
+	saved := make(map[string]*memoryEntity, len(s.entities))
+	for k, e := range s.entities {
+		saved[k] = e
+	}
+	s.mu.Unlock()
+
+	halving = 0
+	if err := s.memoryStore.RunInTransaction(c, f); err != nil || s.contention[halving] == 0 {
+		return err
+	}
+	s.contention[halving]--
+	s.mu.Lock()
+	s.entities = saved
+	s.mu.Unlock()
+	if p := s.concurrent[halving]; p != nil {
+		if _, err := s.Put(c, datastore.NewKey(c, "photo", "", halving, nil), p); err != nil {
+			return err
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+func TestTransactional(t *testing.T) {
+	c, store, tasks := newTestContext(t)
+	putPhotos(t, c, 6)
+
+	// photo 2 is written once while it's processed and photo 3 every time
+	contended := &contendedStore{
+		memoryStore: store,
+		contention:  map[int64]int{2: 1, 3: transactionAttempts},
+		concurrent:  map[int64]*Photo{2: {Width: 100}},
+	}
+	c = withDatastore(c, contended)
+	halved = map[int64]int{}
+	key := runShards(t, c, tasks, &halvePhotos{Divisor: 2}, 1)
+
+	s := new(shard)
+	if err := getDatastore(c).Get(c, shardKey(c, key, 0), s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Processed != 6 || s.Contended != 1 || s.Status != shardComplete {
+		t.Errorf("expected 6 processed with 1 contended got %d %d %s", s.Processed, s.Contended, s.Status)
+	}
+
+	for id := int64(1); id <= 6; id++ {
+		attempts, height := 1, 4000
+		switch id {
+		case 2:
+			// the retry sees the concurrent write
+			attempts, height = 2, 50
+		case 3:
+			attempts, height = transactionAttempts, 6000
+		}
+		if halved[id] != attempts {
+			t.Errorf("photo %d expected %d attempts got %d", id, attempts, halved[id])
+		}
+		p := new(Photo)
+		if err := getDatastore(c).Get(c, datastore.NewKey(c, "photo", "", id, nil), p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Height != height {
+			t.Errorf("photo %d expected height %d got %d", id, height, p.Height)
+		}
+	}
+}
+
+func TestTransactionalError(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 4)
+
+	// the failed photo's write is rolled back and its slice fails
+	halved = map[int64]int{}
+	if _, err := startJob(c, &halvePhotos{Divisor: 2, Fail: 3}, &jobOptions{Shards: 1, Split: splitEven}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tasks.Run(c); err == nil {
+		t.Errorf("expected the slice to fail")
+	}
+	for id := int64(1); id <= 4; id++ {
+		height := 6000
+		if id < 3 {
+			height = 4000
+		}
+		p := new(Photo)
+		if err := getDatastore(c).Get(c, datastore.NewKey(c, "photo", "", id, nil), p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Height != height {
+			t.Errorf("photo %d expected height %d got %d", id, height, p.Height)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// saveEntity returns the properties of an entity as they'd be stored
+func saveEntity(src interface{}) (datastore.PropertyList, error) {
+	switch x := src.(type) {
+	case *datastore.PropertyList:
+		return append(datastore.PropertyList(nil), *x...), nil
+	case datastore.PropertyLoadSaver:
+		return x.Save()
+	}
+	return datastore.SaveStruct(src)
+}
+
+// loadEntity loads the properties into an entity as they'd be loaded from
+// the datastore
+func loadEntity(dst interface{}, props datastore.PropertyList) error {
+	props = append(datastore.PropertyList(nil), props...)
+	switch x := dst.(type) {
+	case *datastore.PropertyList:
+		*x = append(*x, props...)
+		return nil
+	case datastore.PropertyLoadSaver:
+		return x.Load(props)
+	}
+	return datastore.LoadStruct(dst, props)
+}
+
+// indexedValues returns the values of a property that can be queried
+func indexedValues(key *datastore.Key, props datastore.PropertyList, name string) []interface{} {
+	if name == "__key__" {
+		return []interface{}{key}
+	}
+	if name == "__scatter__" {
+		// a stable pseudo-random value so sampling spreads over the keys
+		h := sha1.Sum([]byte(key.Encode()))
+		return []interface{}{int64(binary.BigEndian.Uint64(h[:8]) >> 1)}
+	}
+	values := []interface{}{}
+	for _, p := range props {
+		if p.Name == name && !p.NoIndex {
+			values = append(values, normalizeValue(p.Value))
+		}
+	}
+	return values
+}
+
+// matchesFilters returns whether the entity matches all the filters. For
+// multi-valued properties any value can match each filter.
+func matchesFilters(key *datastore.Key, props datastore.PropertyList, filters []filter) bool {
+	for _, f := range filters {
+		value := normalizeValue(f.Value)
+		matched := false
+		for _, v := range indexedValues(key, props, f.Property) {
+			cmp := compareValues(v, value)
+			switch f.Operator {
+			case "=":
+				matched = cmp == 0
+			case "<":
+				matched = cmp < 0
+			case "<=":
+				matched = cmp <= 0
+			case ">":
+				matched = cmp > 0
+			case ">=":
+				matched = cmp >= 0
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int:
+		return int64(x)
+	case int8:
+		return int64(x)
+	case int16:
+		return int64(x)
+	case int32:
+		return int64(x)
+	case float32:
+		return float64(x)
+	case []byte:
+		return string(x)
+	case datastore.ByteString:
+		return string(x)
+	}
+	return v
+}
+
+// valueRank orders values of different types the same way as the datastore
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
+	case bool:
+		return 2
+	case string:
+		return 3
+	case float64:
+		return 4
+	case appengine.GeoPoint:
+		return 5
+	case *datastore.Key:
+		return 6
+	}
+	return 7
+}
+
+// projectProperties returns just the projected properties of an entity,
+// entities without an indexed value for all of them aren't in the results
+func projectProperties(props datastore.PropertyList, projection []string) (datastore.PropertyList, bool) {
+	projected := make(datastore.PropertyList, len(projection))
+	for i, name := range projection {
+		found := false
+		for _, p := range props {
+			if p.Name == name && !p.NoIndex {
+				projected[i] = datastore.Property{Name: name, Value: p.Value}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return projected, true
+}
+
+// compareValues orders property values the same way as the datastore
+func compareValues(a, b interface{}) int {
+	a, b = normalizeValue(a), normalizeValue(b)
+	ra, rb := valueRank(a), valueRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case int64, time.Time:
+		return compareInts(integerValue(a), integerValue(b))
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(x, b.(string))
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case appengine.GeoPoint:
+		y := b.(appengine.GeoPoint)
+		if x.Lat != y.Lat {
+			return compareValues(x.Lat, y.Lat)
+		}
+		return compareValues(x.Lng, y.Lng)
+	case *datastore.Key:
+		return compareKeys(x, b.(*datastore.Key))
+	}
+	return 0
+}
+
+// times are stored as microseconds so compare the same as integers
+func integerValue(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return t.UnixNano() / 1e3
+	}
+	return v.(int64)
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareKeys orders keys by their path from the root, integer IDs sort
+// before string IDs
+func compareKeys(a, b *datastore.Key) int {
+	ap, bp := keyPath(a), keyPath(b)
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		x, y := ap[i], bp[i]
+		if cmp := strings.Compare(x.Kind(), y.Kind()); cmp != 0 {
+			return cmp
+		}
+		switch {
+		case x.StringID() == "" && y.StringID() != "":
+			return -1
+		case x.StringID() != "" && y.StringID() == "":
+			return 1
+		case x.StringID() != "":
+			if cmp := strings.Compare(x.StringID(), y.StringID()); cmp != 0 {
+				return cmp
+			}
+		default:
+			if cmp := compareInts(x.IntID(), y.IntID()); cmp != 0 {
+				return cmp
+			}
+		}
+	}
+	return len(ap) - len(bp)
+}
+
+func keyPath(key *datastore.Key) []*datastore.Key {
+	path := []*datastore.Key{}
+	for k := key; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
@@ -7,7 +7,6 @@ import (
 	"math/rand"
 
 	"github.com/labstack/echo"
-	"github.com/qedus/nds"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 )
@@ -20,7 +19,8 @@ func warmupHandler(c *echo.Context) error {
 	if appengine.IsDevAppServer() {
 		k := datastore.NewKey(c, "photo", "", 1, nil)
 		p := new(Photo)
-		err := nds.Get(c, k, p)
+		ds := getDatastore(c)
+		err := ds.Get(c, k, p)
 		if err != datastore.ErrNoSuchEntity {
 			return c.NoContent(http.StatusOK)
 		}
@@ -47,7 +47,7 @@ func warmupHandler(c *echo.Context) error {
 				}
 				id++
 				k = datastore.NewKey(c, "photo", "", id, nil)
-				nds.Put(c, k, p)
+				ds.Put(c, k, p)
 			}
 		}
 	}
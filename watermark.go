@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type (
+	// Windowed is a processor whose property range is a window of time that
+	// can be set by the runner, so it can be run incrementally from the
+	// watermark left by the last run
+	Windowed interface {
+		PropertyRanger
+
+		// SetWindow sets the processor to process the entities with the
+		// time property in [from, to), it returns an error if the processor
+		// can't be windowed by the property
+		SetWindow(property string, from, to time.Time) error
+	}
+
+	// watermark is how far a processor has processed the entities by a
+	// property, it's keyed by the processor and property names
+	watermark struct {
+		Processor string         `datastore:"processor"`
+		Property  string         `datastore:"property,noindex"`
+		Value     time.Time      `datastore:"value,noindex"`
+		Job       *datastore.Key `datastore:"job,noindex"`
+		Updated   time.Time      `datastore:"updated"`
+	}
+)
+
+const watermarkKind = "watermark"
+
+// watermarkNow is the end of the window of a job run from a watermark
+var watermarkNow = time.Now
+
+func init() {
+	// reset endpoint will be something like
+	// "/_ah/cron/watermark/aggregatePhotos/reset?property=uploaded&to=2015-06-01"
+	// to process again from a date, or without "to" to start from scratch
+	cron.Post("/watermark/:name/reset", resetWatermarkHandler)
+}
+
+func watermarkKey(c context.Context, processor, property string) *datastore.Key {
+	return datastore.NewKey(c, watermarkKind, processor+"/"+property, 0, nil)
+}
+
+// applyWatermark sets the window of a processor to run from the watermark,
+// less the overlap, up to now and returns the end of the window. Without a
+// watermark it runs from the start of its own range.
+func applyWatermark(c context.Context, processor Processor, opts *jobOptions) (time.Time, error) {
+	w, ok := processor.(Windowed)
+	if !ok {
+		return time.Time{}, fmt.Errorf("processor %s can't be run from a watermark", processorName(processor))
+	}
+	from, ok := w.PropertyRange().Start.(time.Time)
+	if !ok {
+		return time.Time{}, fmt.Errorf("processor %s isn't windowed by time", processorName(processor))
+	}
+
+	mark := new(watermark)
+	err := getDatastore(c).Get(c, watermarkKey(c, processorName(processor), opts.Watermark), mark)
+	switch err {
+	case nil:
+		from = mark.Value.Add(-opts.Overlap)
+	case datastore.ErrNoSuchEntity:
+	default:
+		return time.Time{}, err
+	}
+
+	to := watermarkNow().UTC()
+	if err := w.SetWindow(opts.Watermark, from, to); err != nil {
+		return time.Time{}, err
+	}
+	log.Infof(c, "running %s by %s from %s to %s", processorName(processor), opts.Watermark, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	return to, nil
+}
+
+// advanceWatermark moves the watermark of a processor on to the end of the
+// window a job completed, it never moves it back
+func advanceWatermark(c context.Context, jobKey *datastore.Key, j *job) error {
+	return getDatastore(c).RunInTransaction(c, func(tc context.Context) error {
+		ds := getDatastore(tc)
+		key := watermarkKey(tc, j.Processor, j.Watermark)
+		mark := new(watermark)
+		if err := ds.Get(tc, key, mark); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if !mark.Value.Before(j.Until) {
+			return nil
+		}
+		mark.Processor = j.Processor
+		mark.Property = j.Watermark
+		mark.Value = j.Until
+		mark.Job = jobKey
+		mark.Updated = time.Now().UTC()
+		_, err := ds.Put(tc, key, mark)
+		return err
+	})
+}
+
+// resetWatermark sets the watermark of a processor back to a time, or
+// removes it if the time is zero
+func resetWatermark(c context.Context, processor, property string, to time.Time) error {
+	ds := getDatastore(c)
+	key := watermarkKey(c, processor, property)
+	if to.IsZero() {
+		return ds.DeleteMulti(c, []*datastore.Key{key})
+	}
+	mark := &watermark{
+		Processor: processor,
+		Property:  property,
+		Value:     to,
+		Updated:   time.Now().UTC(),
+	}
+	_, err := ds.Put(c, key, mark)
+	return err
+}
+
+func resetWatermarkHandler(c *echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	name := c.Param("name")
+	if _, found := processors[name]; !found {
+		return echo.NewHTTPError(http.StatusNotFound, "processor not found")
+	}
+	property := c.Query("property")
+	if property == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "property is required")
+	}
+	var to time.Time
+	if s := c.Query("to"); s != "" {
+		var err error
+		if to, err = time.Parse(dateFormat, s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid to date")
+		}
+	}
+
+	if err := resetWatermark(ctx, name, property, to); err != nil {
+		log.Errorf(ctx, "reset watermark error %s", err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	log.Infof(ctx, "reset %s watermark for %s", property, name)
+	return c.NoContent(http.StatusOK)
+}
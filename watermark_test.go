@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// jobProcessed returns how many entities the shards of a job processed
+func jobProcessed(t *testing.T, c context.Context, key *datastore.Key) int64 {
+	it := getDatastore(c).Run(c, NewQuery(shardKind).Ancestor(key))
+	var processed int64
+	for {
+		s := new(shard)
+		_, err := it.Next(s)
+		if err == datastore.Done {
+			return processed
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		processed += s.Processed
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	c, _, tasks := newTestContext(t)
+	putPhotos(t, c, 10)
+
+	// each run ends a second after the last so photos uploaded in between
+	// are always in the next window
+	defer func(now func() time.Time) { watermarkNow = now }(watermarkNow)
+	clock := time.Now()
+	watermarkNow = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	run := func(overlap string) (*datastore.Key, *job) {
+		p, _ := newLogPhotos(params{"from": "2015-01-01"})
+		opts, err := newJobOptions(params{"shards": "2", "watermark": "uploaded", "overlap": overlap})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := startJob(c, p, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTasks(t, c, tasks)
+		j := new(job)
+		if err := getDatastore(c).Get(c, key, j); err != nil {
+			t.Fatal(err)
+		}
+		return key, j
+	}
+	watermarkValue := func() time.Time {
+		mark := new(watermark)
+		if err := getDatastore(c).Get(c, watermarkKey(c, "logPhotos", "uploaded"), mark); err != nil {
+			t.Fatal(err)
+		}
+		return mark.Value
+	}
+	putLate := func(id int64, uploaded time.Time) {
+		p := &Photo{
+			Photographer: Photographer{1, "Mr Canon"},
+			Uploaded:     uploaded,
+			Taken:        time.Date(2015, 1, 2, 12, 0, 0, 0, time.UTC),
+		}
+		if _, err := getDatastore(c).Put(c, datastore.NewKey(c, "photo", "", id, nil), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// without a watermark it starts from the processor's own range
+	key, j := run("")
+	if n := jobProcessed(t, c, key); n != 10 {
+		t.Errorf("expected 10 processed got %d", n)
+	}
+	if !watermarkValue().Equal(j.Until) {
+		t.Errorf("expected watermark %s got %s", j.Until, watermarkValue())
+	}
+
+	// a photo taken earlier but uploaded since is picked up by the next run
+	mark := watermarkValue()
+	putLate(100, mark.Add(time.Millisecond))
+	key, j = run("")
+	if n := jobProcessed(t, c, key); n != 1 {
+		t.Errorf("expected the late photo processed got %d", n)
+	}
+	if !watermarkValue().After(mark) {
+		t.Errorf("expected watermark after %s got %s", mark, watermarkValue())
+	}
+
+	// a photo uploaded just before the watermark is only picked up with
+	// enough overlap
+	mark = watermarkValue()
+	putLate(101, mark.Add(-time.Minute))
+	key, _ = run("")
+	if n := jobProcessed(t, c, key); n != 0 {
+		t.Errorf("expected nothing processed without overlap got %d", n)
+	}
+	key, _ = run("1h")
+	if n := jobProcessed(t, c, key); n != 2 {
+		t.Errorf("expected 2 photos processed with overlap got %d", n)
+	}
+
+	// resetting the watermark processes everything since
+	if err := resetWatermark(c, "logPhotos", "uploaded", time.Date(2015, 1, 5, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	key, _ = run("")
+	if n := jobProcessed(t, c, key); n != 8 {
+		t.Errorf("expected 8 photos processed after reset got %d", n)
+	}
+	if err := resetWatermark(c, "logPhotos", "uploaded", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	key, _ = run("")
+	if n := jobProcessed(t, c, key); n != 12 {
+		t.Errorf("expected 12 photos processed after removing the watermark got %d", n)
+	}
+
+	// a cancelled job doesn't move the watermark on, even if it completes
+	// as it's cancelled
+	mark = watermarkValue()
+	p, _ := newLogPhotos(params{"from": "2015-01-01"})
+	key, err := startJob(c, p, &jobOptions{Shards: 1, Split: splitEven, Watermark: "uploaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := closeJob(c, key, jobCancelled, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeJob(c, key, jobCompleted, ""); err != nil {
+		t.Fatal(err)
+	}
+	runTasks(t, c, tasks)
+	if !watermarkValue().Equal(mark) {
+		t.Errorf("expected watermark %s got %s", mark, watermarkValue())
+	}
+}
+
+func TestWatermarkOptions(t *testing.T) {
+	c, _, _ := newTestContext(t)
+
+	if _, err := newJobOptions(params{"overlap": "1h"}); err == nil {
+		t.Errorf("expected error for an overlap without a watermark")
+	}
+	if _, err := newJobOptions(params{"watermark": "uploaded", "overlap": "an hour"}); err == nil {
+		t.Errorf("expected error for an invalid overlap")
+	}
+
+	p, _ := newLogPhotos(params{})
+	if _, err := startJob(c, p, &jobOptions{Shards: 1, Split: splitEven, Watermark: "width"}); err == nil {
+		t.Errorf("expected error for a property photos can't be windowed by")
+	}
+	m, _ := newPhotosPerMonth(params{})
+	if _, err := startJob(c, m, &jobOptions{Shards: 1, Split: splitEven, Watermark: "uploaded"}); err == nil {
+		t.Errorf("expected error for a processor that isn't windowed")
+	}
+}